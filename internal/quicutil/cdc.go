@@ -0,0 +1,95 @@
+package quicutil
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// FastCDC content defined chunking, qs and qc must cut at the same boundaries
+// so that chunks of uploads made either way deduplicate
+const (
+	CDCMinSize = 256 << 10
+	CDCAvgSize = 1 << 20
+	CDCMaxSize = 4 << 20
+	// the gear hash shifts left, so the high bits depend on the most bytes
+	cdcMaskS = ^(uint64(1)<<(64-22) - 1) // harder to match before CDCAvgSize
+	cdcMaskL = ^(uint64(1)<<(64-18) - 1) // easier to match after CDCAvgSize
+)
+
+var cdcGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return
+}()
+
+// CDCCut returns the length of the first chunk of data
+func CDCCut(data []byte) int {
+	n := len(data)
+	if n <= CDCMinSize {
+		return n
+	}
+	if n > CDCMaxSize {
+		n = CDCMaxSize
+	}
+	normal := CDCAvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+	i := CDCMinSize
+	for ; i < normal; i++ {
+		h = h<<1 + cdcGear[data[i]]
+		if h&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + cdcGear[data[i]]
+		if h&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker splits a stream into content defined chunks
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	off int // start of the next chunk in buf
+	n   int // bytes in buf
+	eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, CDCMaxSize),
+	}
+}
+
+// Next returns the next chunk, valid until the next call, or io.EOF
+func (c *Chunker) Next() ([]byte, error) {
+	c.n = copy(c.buf, c.buf[c.off:c.n])
+	c.off = 0
+	if !c.eof {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	c.off = CDCCut(c.buf[:c.n])
+	return c.buf[:c.off], nil
+}
@@ -0,0 +1,104 @@
+package quicutil
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkSizes(t *testing.T, data []byte) []int {
+	sizes := []int{}
+	joined := []byte{}
+	ch := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("chunks don't add up to the data")
+	}
+	return sizes
+}
+
+// go test -run ^TestCDCCut$ .
+func TestCDCCut(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		cut  int
+	}{
+		{"empty", nil, 0},
+		{"small", make([]byte, 100), 100},
+		{"min", make([]byte, CDCMinSize), CDCMinSize},
+	}
+	for _, v := range cases {
+		if cut := CDCCut(v.data); cut != v.cut {
+			t.Errorf("%s expect: %d, got: %d", v.name, v.cut, cut)
+		}
+	}
+	if cut := CDCCut(make([]byte, 2*CDCMaxSize)); cut <= CDCMinSize || cut > CDCMaxSize {
+		t.Errorf("zeros expect: (%d, %d], got: %d", CDCMinSize, CDCMaxSize, cut)
+	}
+}
+
+// go test -run ^TestChunkerBoundaries$ .
+func TestChunkerBoundaries(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"below min", CDCMinSize - 1},
+		{"max", CDCMaxSize},
+		{"max plus one", CDCMaxSize + 1},
+		{"many", 20 << 20},
+	}
+	for _, v := range cases {
+		data := testData(1, v.size)
+		sizes := chunkSizes(t, data)
+		if v.size == 0 && len(sizes) != 0 {
+			t.Errorf("%s expect: no chunks, got: %v", v.name, sizes)
+		}
+		for i, n := range sizes {
+			if n > CDCMaxSize || (i < len(sizes)-1 && n <= CDCMinSize) {
+				t.Errorf("%s chunk %d expect: (%d, %d], got: %d", v.name, i, CDCMinSize, CDCMaxSize, n)
+			}
+		}
+	}
+}
+
+// go test -run ^TestChunkerStable$ .
+func TestChunkerStable(t *testing.T) {
+	// chunks stored by earlier releases only deduplicate as long as these sizes don't change
+	expect := []int{1402035, 1143696, 1480347, 1191008, 1111829, 1067830, 991863}
+	sizes := chunkSizes(t, testData(1, 8<<20))
+	if len(sizes) != len(expect) {
+		t.Fatalf("expect: %v, got: %v", expect, sizes)
+	}
+	for i := range expect {
+		if sizes[i] != expect[i] {
+			t.Fatalf("expect: %v, got: %v", expect, sizes)
+		}
+	}
+
+	// an insert at the front only changes the chunks up to the next common boundary
+	shifted := chunkSizes(t, append(testData(2, 1000), testData(1, 8<<20)...))
+	if len(shifted) < 2 || shifted[len(shifted)-1] != expect[len(expect)-1] || shifted[len(shifted)-2] != expect[len(expect)-2] {
+		t.Errorf("shifted expect: tail of %v, got: %v", expect, shifted)
+	}
+}
@@ -0,0 +1,124 @@
+package quicutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"go.uber.org/zap"
+)
+
+// webtransport-go v0.5(the last release for quic-go v0.33) doesn't expose
+// datagrams, so sessions frame HTTP/3 datagrams(RFC 9297) themselves: the
+// quarter stream id of the CONNECT stream followed by the payload
+
+// ErrSessionClosed is returned by Receive once the session or its connection is closed
+var ErrSessionClosed = errors.New("session closed")
+
+// DatagramConn is the part of quic.Connection used for datagrams
+type DatagramConn interface {
+	Context() context.Context
+	SendMessage([]byte) error
+	ReceiveMessage() ([]byte, error)
+}
+
+// DatagramMux dispatches the datagrams of one connection to its sessions
+type DatagramMux struct {
+	conn     DatagramConn
+	mu       sync.Mutex
+	sessions map[uint64]chan []byte
+}
+
+var datagramMuxes sync.Map // DatagramConn -> *DatagramMux
+
+// DatagramMuxOf returns the mux of conn, the first call starts reading datagrams
+func DatagramMuxOf(conn DatagramConn) *DatagramMux {
+	mux := &DatagramMux{
+		conn:     conn,
+		sessions: map[uint64]chan []byte{},
+	}
+	if v, loaded := datagramMuxes.LoadOrStore(conn, mux); loaded {
+		return v.(*DatagramMux)
+	}
+	go mux.run()
+	return mux
+}
+
+func (m *DatagramMux) run() {
+	defer datagramMuxes.Delete(m.conn)
+	for {
+		msg, err := m.conn.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(msg)
+		qid, err := quicvarint.Read(r)
+		if err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		ch, ok := m.sessions[qid]
+		m.mu.Unlock()
+		if !ok {
+			zap.L().Debug("datagram for unknown session",
+				zap.Uint64("quarter-stream-id", qid),
+			)
+			continue
+		}
+		select {
+		case ch <- msg[len(msg)-r.Len():]:
+		default: // datagrams are unreliable, drop instead of blocking other sessions
+		}
+	}
+}
+
+// Session registers the session created by the CONNECT request on streamID
+func (m *DatagramMux) Session(streamID quic.StreamID) *SessionDatagrams {
+	qid := uint64(streamID) / 4
+	ch := make(chan []byte, 64)
+	m.mu.Lock()
+	m.sessions[qid] = ch
+	m.mu.Unlock()
+	return &SessionDatagrams{
+		mux:    m,
+		qid:    qid,
+		header: quicvarint.Append(nil, qid),
+		ch:     ch,
+	}
+}
+
+// SessionDatagrams sends and receives the datagrams of one session
+type SessionDatagrams struct {
+	mux    *DatagramMux
+	qid    uint64
+	header []byte
+	ch     chan []byte
+}
+
+// Send sends p as a datagram of the session
+func (d *SessionDatagrams) Send(p []byte) error {
+	return d.mux.conn.SendMessage(append(append(make([]byte, 0, len(d.header)+len(p)), d.header...), p...))
+}
+
+// Receive returns the next datagram, ctx is usually the session context
+func (d *SessionDatagrams) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-d.ch:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ErrSessionClosed
+	case <-d.mux.conn.Context().Done():
+		return nil, ErrSessionClosed
+	}
+}
+
+// Close unregisters the session, its later datagrams are dropped
+func (d *SessionDatagrams) Close() {
+	d.mux.mu.Lock()
+	delete(d.mux.sessions, d.qid)
+	d.mux.mu.Unlock()
+}
@@ -0,0 +1,4 @@
+// Package quicutil holds the code qs and qc must agree on: FastCDC chunk
+// boundaries, HTTP/3 datagram framing of WebTransport sessions and the
+// TLS key log and qlog setup
+package quicutil
@@ -0,0 +1,74 @@
+package quicutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+	"go.uber.org/zap"
+)
+
+// OpenKeyLog opens the TLS key log file(NSS key log format) for Wireshark,
+// falls back to the SSLKEYLOGFILE environment variable
+func OpenKeyLog(filename string) (*os.File, error) {
+	if filename == "" {
+		filename = os.Getenv("SSLKEYLOGFILE")
+	}
+	if filename == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open key log file %s err: %w", filename, err)
+	}
+	zap.L().Info("tls key log",
+		zap.String("filename", filename),
+	)
+	return f, nil
+}
+
+type bufferedWriteCloser struct {
+	*bufio.Writer
+	io.Closer
+}
+
+func (b *bufferedWriteCloser) Close() error {
+	if err := b.Writer.Flush(); err != nil {
+		b.Closer.Close()
+		return err
+	}
+	return b.Closer.Close()
+}
+
+// QlogTracer writes one qlog file per connection into dir
+func QlogTracer(dir string) (logging.Tracer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create qlog dir %s err: %w", dir, err)
+	}
+
+	return qlog.NewTracer(func(p logging.Perspective, connID []byte) io.WriteCloser {
+		role := "server"
+		if p == logging.PerspectiveClient {
+			role = "client"
+		}
+		filename := filepath.Join(dir, fmt.Sprintf("%s_%x_%s.qlog", time.Now().UTC().Format("20060102T150405"), connID, role))
+		f, err := os.Create(filename)
+		if err != nil {
+			zap.L().Warn("create qlog file error",
+				zap.String("filename", filename),
+				zap.Error(err),
+			)
+			return nil
+		}
+		zap.L().Debug("qlog",
+			zap.String("filename", filename),
+		)
+		return &bufferedWriteCloser{Writer: bufio.NewWriter(f), Closer: f}
+	}), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxCtrlMessage   = 64 << 10
+	ctrlWriteTimeout = 10 * time.Second
+)
+
+// ctrlConn is a tcp control connection carrying one json data message per line,
+// tcp may split or coalesce messages so they can't be read with a single Read.
+// nt/ctrl.go and ntn/ctrl.go are the same file, change both
+type ctrlConn struct {
+	net.Conn
+	scanner    *bufio.Scanner
+	sync.Mutex // serializes writes, the ntn server pushes notifications from other goroutines
+}
+
+func newCtrlConn(conn net.Conn) *ctrlConn {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxCtrlMessage)
+	return &ctrlConn{
+		Conn:    conn,
+		scanner: scanner,
+	}
+}
+
+// readData returns the next message, io.EOF if the peer closed the connection
+func (c *ctrlConn) readData() (dat data, e error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			e = fmt.Errorf("read err: %w", err)
+			return
+		}
+		e = io.EOF
+		return
+	}
+	if err := json.Unmarshal(c.scanner.Bytes(), &dat); err != nil {
+		e = &decodeError{fmt.Errorf("unmarshal from %s err: %w", c.RemoteAddr().String(), err)}
+	}
+	return
+}
+
+func (c *ctrlConn) writeData(dat *data) error {
+	buf, err := json.Marshal(dat)
+	if err != nil {
+		return fmt.Errorf("marshal err: %w", err)
+	}
+	buf = append(buf, '\n')
+
+	c.Lock()
+	defer c.Unlock()
+	c.SetWriteDeadline(time.Now().Add(ctrlWriteTimeout))
+	if _, err = c.Write(buf); err != nil {
+		return fmt.Errorf("write err: %w", err)
+	}
+	return nil
+}
+
+// request sends dat and returns the first response with op, skipping pushed notifications
+func (c *ctrlConn) request(dat *data, op string, timeout time.Duration) (rsp data, e error) {
+	if err := c.writeData(dat); err != nil {
+		return rsp, err
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+	for {
+		rsp, e = c.readData()
+		if e != nil || rsp.Op == op {
+			return
+		}
+		if rsp.Op == "error" {
+			return rsp, fmt.Errorf("%s error: %s", dat.Op, rsp.Msg)
+		}
+	}
+}
+
+// decodeError is a malformed message, the connection is still usable
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+func isDecodeError(err error) bool {
+	var de *decodeError
+	return errors.As(err, &de)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -113,24 +114,60 @@ nt uc
 	udpClientCmd.Flags().UintVar(&pongPeerDelay, "pong-peer-delay", pongPeerDelay, "pong(response) peer delay in millisecond")
 	rootCmd.AddCommand(udpClientCmd)
 
+	sendOpt := UDPSendOption{
+		Format:   "text",
+		Count:    1,
+		Interval: time.Second,
+		Timeout:  3 * time.Second,
+	}
 	udpSendCmd := &cobra.Command{
 		Use:   "udp-send <data> <server-addr> [client-addr]",
 		Short: "udp client send data",
 		Long: `udp client send data:
 * udp client send data
 nt udp-send test-data-001 172.16.1.1:9234
+* ping 10 times every 200ms, print rtt, loss and jitter
+nt udp-send test-data-001 172.16.1.1:9234 --count 10 --interval 200ms --timeout 1s
+* send binary payloads
+nt udp-send --format hex 0001ff 172.16.1.1:9234
+nt udp-send --format base64 AAH/ 172.16.1.1:9234
+nt udp-send --format file packet.bin 172.16.1.1:9234
+* talk to a udp-server by hand, data is the msg, the relay reply goes to the peer
+nt udp-send --op ping1 --id c001 "" 172.16.1.1:20019
+nt udp-send --op ping2 --id c001 "" 172.16.1.2:20019
+nt udp-send --op relay --peer 1.2.3.4:5678 hello 172.16.1.1:20019
+* print received datagrams and echo them, e.g. the other side of a ping
+nt udp-send --listen :9234 --echo
 `,
-		Args: cobra.RangeArgs(2, 3),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if sendOpt.Listen != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.RangeArgs(2, 3)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			if sendOpt.Listen != "" {
+				return UDPSend(ctx, "", "", "", dialTimeout, &sendOpt)
+			}
 			laddr := ""
 			if len(args) == 3 {
 				laddr = args[2]
 			}
-			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-			defer stop()
-			return UDPSend(ctx, laddr, args[1], args[0], 3)
+			return UDPSend(ctx, laddr, args[1], args[0], dialTimeout, &sendOpt)
 		},
 	}
+	udpSendCmd.Flags().StringVar(&sendOpt.Format, "format", sendOpt.Format, "data format: text, hex, base64 or file(data is a file name)")
+	udpSendCmd.Flags().IntVarP(&sendOpt.Count, "count", "c", sendOpt.Count, "probes to send, 0 means until interrupted")
+	udpSendCmd.Flags().DurationVarP(&sendOpt.Interval, "interval", "i", sendOpt.Interval, "interval between probes")
+	udpSendCmd.Flags().DurationVarP(&sendOpt.Timeout, "timeout", "W", sendOpt.Timeout, "wait for a reply at most this long")
+	udpSendCmd.Flags().StringVar(&sendOpt.Op, "op", "", "send udp-server json: ping1, ping2 or relay, data is the msg")
+	udpSendCmd.Flags().BoolVar(&sendOpt.NoSeq, "no-seq", false, "send the data unchanged when probing, by default \" seq=<n>\" is appended(the seq field with --op) to match the replies")
+	udpSendCmd.Flags().StringVar(&sendOpt.ID, "id", "", "client id of --op, random if empty")
+	udpSendCmd.Flags().StringVar(&sendOpt.Peer, "peer", "", "peer address of --op relay")
+	udpSendCmd.Flags().StringVar(&sendOpt.Listen, "listen", "", "receive datagrams on addr instead of sending")
+	udpSendCmd.Flags().BoolVar(&sendOpt.Echo, "echo", false, "send received datagrams back in --listen mode")
 	rootCmd.AddCommand(udpSendCmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -37,12 +36,21 @@ func TCPServer(port uint) error {
 	}
 }
 
+// processTCPConn serves newline delimited json requests until the client closes the connection
 func processTCPConn(conn net.Conn) {
+	c := newCtrlConn(conn)
 	defer conn.Close()
-	buf := make([]byte, 2048)
 	for {
-		n, err := conn.Read(buf)
+		rcvData, err := c.readData()
 		if err != nil {
+			if isDecodeError(err) {
+				logger.Warn("recv success but decode error",
+					zap.String("laddr", conn.LocalAddr().String()),
+					zap.String("raddr", conn.RemoteAddr().String()),
+					zap.Error(err),
+				)
+				continue
+			}
 			if err == io.EOF {
 				logger.Info("conn closed",
 					zap.String("laddr", conn.LocalAddr().String()),
@@ -58,24 +66,11 @@ func processTCPConn(conn net.Conn) {
 			break
 		}
 
-		rcvData := &data{}
-		if err := json.Unmarshal(buf[:n], rcvData); err != nil {
-			logger.Warn("readFrom success but decode error",
-				zap.Int("len", n),
-				zap.String("laddr", conn.LocalAddr().String()),
-				zap.String("raddr", conn.RemoteAddr().String()),
-				zap.ByteString("content", buf[:n]),
-				zap.Error(err),
-			)
-			continue
-		}
-
 		if rcvData.ID == "" {
-			logger.Warn("readFrom success but no ID",
-				zap.Int("len", n),
+			logger.Warn("recv success but no ID",
 				zap.String("laddr", conn.LocalAddr().String()),
 				zap.String("raddr", conn.RemoteAddr().String()),
-				zap.ByteString("content", buf[:n]),
+				zap.Object("data", &rcvData),
 			)
 			continue
 		}
@@ -93,11 +88,14 @@ func processTCPConn(conn net.Conn) {
 			rspData.Op = "pong1"
 		case "ping2":
 			rspData.Op = "pong2"
+		case "ping": // keepalive
+			rspData.Op = "pong"
+		default:
+			rspData.Op = "error"
+			rspData.Msg = fmt.Sprintf("unknown op %q", rcvData.Op)
 		}
 
-		rspBuf, _ := json.Marshal(rspData)
-		n, err = conn.Write(rspBuf)
-		if err != nil {
+		if err := c.writeData(rspData); err != nil {
 			logger.Warn("send error",
 				zap.String("laddr", conn.LocalAddr().String()),
 				zap.String("raddr", conn.RemoteAddr().String()),
@@ -109,7 +107,7 @@ func processTCPConn(conn net.Conn) {
 		logger.Debug("send success",
 			zap.String("laddr", conn.LocalAddr().String()),
 			zap.String("raddr", conn.RemoteAddr().String()),
-			zap.Int("len", n),
+			zap.Object("data", rspData),
 		)
 	}
 }
@@ -143,35 +141,17 @@ func TCPClient(ctx context.Context, port uint, raddr1, raddr2 string, dialTimeou
 	}
 	reqData.Remote = conn1.RemoteAddr().String()
 	reqData.Op = "ping1"
-	reqBuf, _ := json.Marshal(reqData)
-	n, err := conn1.Write(reqBuf)
+	ctrl1 := newCtrlConn(conn1)
+	rcvData1, err := ctrl1.request(reqData, "pong1", time.Duration(dialTimeout)*time.Second)
 	if err != nil {
-		e = fmt.Errorf("write to server %s err: %w", conn1.RemoteAddr().String(), err)
-		return
-	}
-
-	logger.Info("send ping1 success",
-		zap.String("laddr", conn1.LocalAddr().String()),
-		zap.String("raddr", conn1.RemoteAddr().String()),
-		zap.Int("len", n),
-	)
-
-	buf := make([]byte, 2048)
-	n, err = conn1.Read(buf)
-	if err != nil {
-		e = fmt.Errorf("read server %s err: %w", conn1.RemoteAddr().String(), err)
-		return
-	}
-	rcvData1 := &data{}
-	if err := json.Unmarshal(buf[:n], rcvData1); err != nil {
-		e = fmt.Errorf("decode server %s err: %w", conn1.RemoteAddr().String(), err)
+		e = fmt.Errorf("ping1 server %s err: %w", conn1.RemoteAddr().String(), err)
 		return
 	}
 
 	logger.Info("recv(ping1) success",
 		zap.String("laddr", conn1.LocalAddr().String()),
 		zap.String("raddr", conn1.RemoteAddr().String()),
-		zap.Object("data", rcvData1),
+		zap.Object("data", &rcvData1),
 	)
 
 	if raddr2 != "" {
@@ -183,34 +163,17 @@ func TCPClient(ctx context.Context, port uint, raddr1, raddr2 string, dialTimeou
 
 		reqData.Remote = conn2.RemoteAddr().String()
 		reqData.Op = "ping2"
-		reqBuf2, _ := json.Marshal(reqData)
-		n, err = conn2.Write(reqBuf2)
-		if err != nil {
-			e = fmt.Errorf("write to server %s err: %w", conn2.RemoteAddr().String(), err)
-			return
-		}
-
-		logger.Info("send ping2 success",
-			zap.String("laddr", conn2.LocalAddr().String()),
-			zap.String("raddr", conn2.RemoteAddr().String()),
-			zap.Int("len", n),
-		)
-
-		n, err = conn2.Read(buf)
+		ctrl2 := newCtrlConn(conn2)
+		rcvData2, err := ctrl2.request(reqData, "pong2", time.Duration(dialTimeout)*time.Second)
 		if err != nil {
-			e = fmt.Errorf("read server %s err: %w", conn2.RemoteAddr().String(), err)
-			return
-		}
-		rcvData2 := &data{}
-		if err := json.Unmarshal(buf[:n], rcvData2); err != nil {
-			e = fmt.Errorf("decode server %s err: %w", conn2.RemoteAddr().String(), err)
+			e = fmt.Errorf("ping2 server %s err: %w", conn2.RemoteAddr().String(), err)
 			return
 		}
 
 		logger.Info("recv(ping2) success",
 			zap.String("laddr", conn2.LocalAddr().String()),
 			zap.String("raddr", conn2.RemoteAddr().String()),
-			zap.Object("data", rcvData2),
+			zap.Object("data", &rcvData2),
 			zap.Bool("cone", rcvData1.Public == rcvData2.Public),
 		)
 	}
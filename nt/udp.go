@@ -23,6 +23,7 @@ type data struct {
 	Peer   string `json:"peer,omitempty"`
 	Msg    string `json:"msg,omitempty"`
 	Op     string `json:"op,omitempty"`
+	Seq    int    `json:"seq,omitempty"` // probe sequence of udp-send, echoed in the reply
 }
 
 type store struct {
@@ -52,6 +53,9 @@ func (f *data) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if f.Op != "" {
 		enc.AddString("op", f.Op)
 	}
+	if f.Seq != 0 {
+		enc.AddInt("seq", f.Seq)
+	}
 	return nil
 }
 
@@ -180,6 +184,7 @@ func (s *UDPServer) startUDPServer(ctx context.Context, lc *net.ListenConfig, ad
 				ID: rcvData.ID,
 				//Local:  conn.LocalAddr().String(),
 				Public: rcvData.Public,
+				Seq:    rcvData.Seq,
 			}
 
 			var relayPeerAddr *net.UDPAddr
@@ -655,61 +660,3 @@ func (u *UDPClient) gotPeer() bool {
 
 	return len(u.peerAddress) > 3
 }
-
-func UDPSend(ctx context.Context, laddr, raddr, data string, dialTimeout uint) (e error) {
-	networkType := "udp4"
-	var nla *net.UDPAddr
-	var err error
-	if laddr != "" {
-		nla, err = net.ResolveUDPAddr(networkType, laddr)
-		if err != nil {
-			return fmt.Errorf("resolve local addr err:%w", err)
-		}
-	}
-
-	d := net.Dialer{
-		Control:   reuseport.Control,
-		LocalAddr: nla,
-		Timeout:   time.Duration(dialTimeout) * time.Second,
-	}
-
-	conn, err := d.DialContext(ctx, networkType, raddr)
-	if err != nil {
-		return fmt.Errorf("dial %s failed, err: %w", raddr, err)
-	}
-	defer conn.Close()
-
-	logger.Debug("dial success",
-		zap.String("raddr", conn.RemoteAddr().String()),
-		zap.String("laddr", conn.LocalAddr().String()),
-	)
-
-	n, err := conn.Write([]byte(data))
-	if err != nil {
-		e = fmt.Errorf("send to %s err: %w", conn.RemoteAddr(), err)
-		return
-	}
-
-	logger.Info("send success",
-		zap.String("raddr", conn.RemoteAddr().String()),
-		zap.String("data", data),
-		zap.Int("len", n),
-	)
-
-	buff := make([]byte, 2048)
-
-	n, err = conn.Read(buff)
-	if err != nil {
-		e = fmt.Errorf("read err: %w", err)
-		return
-	}
-
-	logger.Info("recv success",
-		zap.Int("len", n),
-		zap.String("laddr", conn.LocalAddr().String()),
-		zap.String("raddr", conn.RemoteAddr().String()),
-		zap.ByteString("content", buff[:n]),
-	)
-
-	return
-}
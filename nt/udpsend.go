@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-reuseport"
+	"go.uber.org/zap"
+)
+
+// UDPSendOption controls udp-send, by default one text payload is sent and one reply awaited
+type UDPSendOption struct {
+	Format   string        // payload format: text, hex, base64 or file(payload is a file name)
+	Count    int           // probes to send, 0 means until interrupted
+	Interval time.Duration // between probes
+	Timeout  time.Duration // read deadline of a reply
+	Op       string        // send data{op: ping1, ping2 or relay} json instead of the payload
+	ID       string        // data id of Op, random if empty
+	Peer     string        // data peer of Op relay
+	Listen   string        // receive datagrams on this address instead of sending
+	Echo     bool          // send received datagrams back in listen mode
+	NoSeq    bool          // send the payload unchanged when probing, replies are then taken in order
+}
+
+// seqMarker precedes the sequence number appended to a raw payload, an echo of it matches the reply to its probe
+const seqMarker = " seq="
+
+// sequenced reports whether probes carry a sequence number, a single probe is sent as is
+func (o *UDPSendOption) sequenced() bool {
+	return o.Count != 1 && !o.NoSeq
+}
+
+// probe returns payload carrying seq, in the seq field of op json or after seqMarker
+func (o *UDPSendOption) probe(payload []byte, seq int) []byte {
+	if !o.sequenced() {
+		return payload
+	}
+	if o.Op != "" {
+		d := &data{}
+		if err := json.Unmarshal(payload, d); err == nil {
+			d.Seq = seq
+			if b, err := json.Marshal(d); err == nil {
+				return b
+			}
+		}
+		return payload
+	}
+	return append(append([]byte(nil), payload...), seqMarker+strconv.Itoa(seq)...)
+}
+
+// replySeq returns the sequence number a reply carries
+func (o *UDPSendOption) replySeq(b []byte) (int, bool) {
+	if o.Op != "" {
+		d := &data{}
+		if err := json.Unmarshal(b, d); err != nil || d.Seq == 0 {
+			return 0, false
+		}
+		return d.Seq, true
+	}
+	i := bytes.LastIndex(b, []byte(seqMarker))
+	if i < 0 {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(string(b[i+len(seqMarker):]))
+	return seq, err == nil
+}
+
+// payload returns the bytes to send for arg
+func (o *UDPSendOption) payload(arg string) ([]byte, error) {
+	if o.Op != "" {
+		switch o.Op {
+		case "ping1", "ping2":
+		case "relay":
+			if o.Peer == "" {
+				return nil, errors.New("op relay requires peer")
+			}
+		default:
+			return nil, fmt.Errorf("unsupported op %q", o.Op)
+		}
+		if o.ID == "" {
+			o.ID = RandomString(4)
+		}
+		return json.Marshal(&data{ID: o.ID, Op: o.Op, Peer: o.Peer, Msg: arg})
+	}
+
+	switch o.Format {
+	case "", "text":
+		return []byte(arg), nil
+	case "hex":
+		return hex.DecodeString(arg)
+	case "base64":
+		return base64.StdEncoding.DecodeString(arg)
+	case "file":
+		return os.ReadFile(arg)
+	}
+	return nil, fmt.Errorf("unsupported format %q", o.Format)
+}
+
+// contentField logs text as is and binary data as hex
+func contentField(b []byte) zap.Field {
+	if utf8.Valid(b) {
+		return zap.ByteString("content", b)
+	}
+	return zap.String("hex", hex.EncodeToString(b))
+}
+
+// probeStats summarizes the round trips of udp-send like ping
+type probeStats struct {
+	sent int
+	rtts []time.Duration
+}
+
+func (p *probeStats) String() string {
+	s := fmt.Sprintf("%d packets transmitted, %d received, %.1f%% packet loss",
+		p.sent, len(p.rtts), float64(p.sent-len(p.rtts))*100/math.Max(float64(p.sent), 1))
+	if len(p.rtts) == 0 {
+		return s
+	}
+
+	min, max := p.rtts[0], p.rtts[0]
+	var sum, sum2, jitter float64
+	for i, v := range p.rtts {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+		ms := float64(v) / float64(time.Millisecond)
+		sum += ms
+		sum2 += ms * ms
+		if i > 0 {
+			jitter += math.Abs(float64(v-p.rtts[i-1]) / float64(time.Millisecond))
+		}
+	}
+	n := float64(len(p.rtts))
+	avg := sum / n
+	mdev := math.Sqrt(math.Max(sum2/n-avg*avg, 0))
+	if n > 1 {
+		jitter /= n - 1
+	}
+	return s + fmt.Sprintf("\nrtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms, jitter %.3f ms",
+		float64(min)/float64(time.Millisecond), avg, float64(max)/float64(time.Millisecond), mdev, jitter)
+}
+
+// UDPSend sends the payload to raddr opt.Count times and waits for a reply after each,
+// replies to earlier probes arriving late are discarded
+func UDPSend(ctx context.Context, laddr, raddr, arg string, dialTimeout uint, opt *UDPSendOption) (e error) {
+	if opt.Listen != "" {
+		return udpListen(ctx, opt.Listen, opt.Echo)
+	}
+	if opt.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s", opt.Timeout)
+	}
+	payload, err := opt.payload(arg)
+	if err != nil {
+		return fmt.Errorf("invalid payload err: %w", err)
+	}
+
+	networkType := "udp4"
+	var nla *net.UDPAddr
+	if laddr != "" {
+		nla, err = net.ResolveUDPAddr(networkType, laddr)
+		if err != nil {
+			return fmt.Errorf("resolve local addr err:%w", err)
+		}
+	}
+
+	d := net.Dialer{
+		Control:   reuseport.Control,
+		LocalAddr: nla,
+		Timeout:   time.Duration(dialTimeout) * time.Second,
+	}
+
+	conn, err := d.DialContext(ctx, networkType, raddr)
+	if err != nil {
+		return fmt.Errorf("dial %s failed, err: %w", raddr, err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now()) // unblock Read
+	}()
+
+	logger.Debug("dial success",
+		zap.String("raddr", conn.RemoteAddr().String()),
+		zap.String("laddr", conn.LocalAddr().String()),
+	)
+
+	stats := &probeStats{}
+	defer func() {
+		fmt.Printf("--- %s udp-send statistics ---\n%s\n", conn.RemoteAddr(), stats)
+	}()
+	buff := make([]byte, 65536)
+	for seq := 1; opt.Count == 0 || seq <= opt.Count; seq++ {
+		probe := opt.probe(payload, seq)
+		begin := time.Now()
+		n, err := conn.Write(probe)
+		if err != nil {
+			return fmt.Errorf("send to %s err: %w", conn.RemoteAddr(), err)
+		}
+		stats.sent++
+		logger.Debug("send success",
+			zap.Int("seq", seq),
+			zap.String("raddr", conn.RemoteAddr().String()),
+			zap.Int("len", n),
+			contentField(probe),
+		)
+
+		conn.SetReadDeadline(begin.Add(opt.Timeout))
+		for {
+			n, err = conn.Read(buff)
+			if err != nil || !opt.sequenced() {
+				break
+			}
+			reply, ok := opt.replySeq(buff[:n])
+			if ok && reply == seq {
+				break
+			}
+			logger.Warn("discard stale reply",
+				zap.Int("seq", seq),
+				zap.Int("reply", reply),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Int("len", n),
+			)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		var ne net.Error
+		switch {
+		case errors.As(err, &ne) && ne.Timeout():
+			logger.Warn("recv timeout",
+				zap.Int("seq", seq),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Duration("timeout", opt.Timeout),
+			)
+		case err != nil:
+			// e.g. connection refused(ICMP port unreachable), count as lost
+			logger.Warn("recv error",
+				zap.Int("seq", seq),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Error(err),
+			)
+		default:
+			rtt := time.Since(begin)
+			stats.rtts = append(stats.rtts, rtt)
+			logger.Info("recv success",
+				zap.Int("seq", seq),
+				zap.Int("len", n),
+				zap.String("laddr", conn.LocalAddr().String()),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Duration("rtt", rtt),
+				contentField(buff[:n]),
+			)
+		}
+
+		if opt.Count != 0 && seq >= opt.Count {
+			break
+		}
+		select {
+		case <-time.After(time.Until(begin.Add(opt.Interval))):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// udpListen logs the datagrams received on laddr, sending them back if echo
+func udpListen(ctx context.Context, laddr string, echo bool) error {
+	conn, err := reuseport.ListenPacket("udp4", laddr)
+	if err != nil {
+		return fmt.Errorf("listen addr %s err: %w", laddr, err)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	logger.Info("udp listen",
+		zap.String("laddr", conn.LocalAddr().String()),
+		zap.Bool("echo", echo),
+	)
+	buf := make([]byte, 65536)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read err: %w", err)
+		}
+		logger.Info("recv success",
+			zap.Int("len", n),
+			zap.String("laddr", conn.LocalAddr().String()),
+			zap.String("raddr", raddr.String()),
+			contentField(buf[:n]),
+		)
+		if !echo {
+			continue
+		}
+		if _, err := conn.WriteTo(buf[:n], raddr); err != nil {
+			logger.Warn("WriteTo error",
+				zap.String("raddr", raddr.String()),
+				zap.Error(err),
+			)
+		}
+	}
+}
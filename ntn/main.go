@@ -27,6 +27,7 @@ var (
 	dialTimeout      uint32 = 5
 	reportInterval   uint32 = 20
 	pingPeerInterval uint32 = 100
+	tcpCtrl                 = true
 )
 
 func main() {
@@ -56,12 +57,13 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&serverAddress2, "s2", serverAddress2, "server address2")
 	rootCmd.PersistentFlags().Uint32Var(&reportInterval, "report-interval", reportInterval, "report status to public server interval in second")
 	rootCmd.PersistentFlags().Uint32Var(&pingPeerInterval, "ping-peer-interval", pingPeerInterval, "ping peer random interval in millsecond")
+	rootCmd.PersistentFlags().BoolVar(&tcpCtrl, "tcp-ctrl", tcpCtrl, "also report/request over a tcp control connection to server1, for networks blocking udp to the server")
 
 	serverCmd := &cobra.Command{
 		Use:   "server",
 		Short: "public server",
 		Long: `public server:
-* start udp server
+* start udp server, and the tcp control server on the same port
 ntn server
 `,
 		Args: cobra.ExactArgs(0),
@@ -102,10 +104,12 @@ ntn tc
 		Long: `udp peer server:
 * start udp peer server
 ntn us
+* udp signaling only, without the tcp control connection
+ntn us --tcp-ctrl=false
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := context.Background()
-			u := NewUdpPeer(clientID, serverAddress1, serverAddress2)
+			u := NewUdpPeer(clientID, serverAddress1, serverAddress2, tcpCtrl)
 			return u.UDPPeerServer(ctx, localPort, dialTimeout, reportInterval, pingPeerInterval)
 		},
 	}
@@ -123,7 +127,7 @@ ntn uc
 `,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := context.Background()
-			u := NewUdpPeer(clientID, serverAddress1, serverAddress2)
+			u := NewUdpPeer(clientID, serverAddress1, serverAddress2, tcpCtrl)
 			return u.UDPPeerClient(ctx, localPort, dialTimeout, reportInterval, pingPeerInterval, pingPeerNum, helloInterval)
 		},
 	}
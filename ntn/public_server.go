@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,19 +14,25 @@ import (
 	"go.uber.org/zap"
 )
 
+// maxPingNum caps the pings a notified peer server sends to the requesting client
+const maxPingNum = 100
+
 type store struct {
 	expire int64
 	status int
 	data
+	udp net.PacketConn // the server conn the udp report came in on, nil if only reported over tcp
 }
 
 type PublicServer struct {
 	reportInterval uint32
 	sync.RWMutex
-	v map[string]store
+	v    map[string]store
+	ctrl map[string]*ctrlConn // tcp control connections of reporting clients by id
 }
 
 func (s *PublicServer) Start(ctx context.Context, port uint) error {
+	s.initStore(ctx)
 	go func() {
 		if err := s.TCPServer(port); err != nil {
 			panic(fmt.Sprintf("start tcp server error %s", err))
@@ -63,12 +70,25 @@ func (s *PublicServer) TCPServer(port uint) error {
 	}
 }
 
+// processTCPConn serves a control connection, a client reporting over it gets
+// the pong3 notifications of requests pushed down the connection
 func (s *PublicServer) processTCPConn(conn net.Conn) {
+	c := newCtrlConn(conn)
 	defer conn.Close()
-	buf := make([]byte, 2048)
+	defer s.removeCtrl(c)
 	for {
-		n, err := conn.Read(buf)
+		// reports keep a control connection alive
+		conn.SetReadDeadline(time.Now().Add(time.Duration(s.reportInterval)*time.Second*3 + 10*time.Second))
+		rcvData, err := c.readData()
 		if err != nil {
+			if isDecodeError(err) {
+				logger.Warn("tcp decode json error",
+					zap.String("laddr", conn.LocalAddr().String()),
+					zap.String("raddr", conn.RemoteAddr().String()),
+					zap.Error(err),
+				)
+				continue
+			}
 			if err == io.EOF {
 				logger.Info("tcp conn closed",
 					zap.String("laddr", conn.LocalAddr().String()),
@@ -81,68 +101,160 @@ func (s *PublicServer) processTCPConn(conn net.Conn) {
 					zap.Error(err),
 				)
 			}
-			break
-		}
-
-		rcvData := &data{}
-		if err := json.Unmarshal(buf[:n], rcvData); err != nil {
-			logger.Warn("tcp decode json error",
-				zap.Int("len", n),
-				zap.String("laddr", conn.LocalAddr().String()),
-				zap.String("raddr", conn.RemoteAddr().String()),
-				zap.ByteString("content", buf[:n]),
-				zap.Error(err),
-			)
-			continue
+			return
 		}
 
 		if rcvData.ID == "" {
 			logger.Warn("tcp req data no ID",
-				zap.Int("len", n),
 				zap.String("laddr", conn.LocalAddr().String()),
 				zap.String("raddr", conn.RemoteAddr().String()),
-				zap.ByteString("content", buf[:n]),
+				zap.Object("req", &rcvData),
 			)
 			continue
 		}
-		// set public addr
-		rcvData.Public = conn.RemoteAddr().String()
 
 		rspData := &data{
 			ID:     rcvData.ID,
-			Public: rcvData.Public,
+			Public: conn.RemoteAddr().String(),
 		}
-
 		switch rcvData.Op {
 		case "ping1":
 			rspData.Op = "pong1"
 		case "ping2":
 			rspData.Op = "pong2"
+		case "ping": // keepalive
+			rspData.Op = "pong"
+		case "report":
+			// the udp public address if the client learned it, else the tcp one,
+			// which is the same with a reused local port and a port preserving nat
+			if rcvData.Public, err = claimedPublic(rcvData.Public, conn); err != nil {
+				rspData.Op = "error"
+				rspData.Msg = err.Error()
+				break
+			}
+			if !s.setCtrl(rcvData.ID, c) {
+				logger.Warn("tcp report id bound to another conn",
+					zap.String("raddr", conn.RemoteAddr().String()),
+					zap.Object("req", &rcvData),
+				)
+				rspData.Op = "error"
+				rspData.Msg = fmt.Sprintf("id %q is reported on another control connection", rcvData.ID)
+				break
+			}
+			s.set(rcvData, 3, nil)
+			logger.Info("tcp report",
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Object("req", &rcvData),
+			)
+			continue
+		case "request":
+			if rcvData.Public, err = claimedPublic(rcvData.Public, conn); err != nil {
+				rspData.Op = "error"
+				rspData.Msg = err.Error()
+				break
+			}
+			rspData.Op = "pong3"
+			rspData.Msg, rspData.Peer = s.selectOnePeer(rcvData.ID, 3)
+			if rspData.Peer == "" {
+				logger.Warn("no peer server candidate",
+					zap.String("raddr", conn.RemoteAddr().String()),
+					zap.Object("req", &rcvData),
+				)
+				rspData.Op = "error"
+				rspData.Msg = "no peer server candidate"
+				break
+			}
+			if err := s.notifyPeer(nil, rspData.Msg, rspData.Peer, rcvData.Public, rcvData.PingNum); err != nil {
+				logger.Warn("notify peer server error",
+					zap.String("peer server", rspData.Peer),
+					zap.String("peer client", rcvData.Public),
+					zap.String("peer id", rspData.Msg),
+					zap.Error(err),
+				)
+			}
+		default:
+			rspData.Op = "error"
+			rspData.Msg = fmt.Sprintf("unknown op %q", rcvData.Op)
 		}
 
-		rspBuf, _ := json.Marshal(rspData)
-		n, err = conn.Write(rspBuf)
-		if err != nil {
+		if err := c.writeData(rspData); err != nil {
 			logger.Warn("tcp send resp error",
 				zap.String("laddr", conn.LocalAddr().String()),
 				zap.String("raddr", conn.RemoteAddr().String()),
 				zap.Error(err),
 			)
-			break
+			return
 		}
 
 		logger.Debug("tcp send resp success",
 			zap.String("laddr", conn.LocalAddr().String()),
 			zap.String("raddr", conn.RemoteAddr().String()),
-			zap.Int("len", n),
+			zap.Object("req", &rcvData),
+			zap.Object("resp", rspData),
 		)
 	}
 }
 
-func (s *PublicServer) set(v data, status int) {
+// claimedPublic returns the public address a tcp client claims, the conn's remote address if none.
+// Only the port may differ, the udp mapping of a client behind nat isn't its tcp one
+func claimedPublic(claimed string, conn net.Conn) (string, error) {
+	raddr := conn.RemoteAddr().String()
+	if claimed == "" {
+		return raddr, nil
+	}
+	host, _, err := net.SplitHostPort(claimed)
+	if err != nil {
+		return "", fmt.Errorf("invalid public %q", claimed)
+	}
+	rhost, _, _ := net.SplitHostPort(raddr)
+	if ip, rip := net.ParseIP(host), net.ParseIP(rhost); ip == nil || !ip.Equal(rip) {
+		return "", fmt.Errorf("public %q isn't the address of the connection", claimed)
+	}
+	return claimed, nil
+}
+
+// setCtrl binds id to c, an id stays bound to the first control connection reporting it
+// until that one closes so that other connections can't take over its notifications
+func (s *PublicServer) setCtrl(id string, c *ctrlConn) bool {
+	s.Lock()
+	defer s.Unlock()
+	if prev, ok := s.ctrl[id]; ok && prev != c {
+		return false
+	}
+	s.ctrl[id] = c
+	return true
+}
+
+func (s *PublicServer) removeCtrl(c *ctrlConn) {
+	s.Lock()
+	defer s.Unlock()
+	for k, v := range s.ctrl {
+		if v == c {
+			delete(s.ctrl, k)
+		}
+	}
+}
+
+func (s *PublicServer) getCtrl(id string) *ctrlConn {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ctrl[id]
+}
+
+func (s *PublicServer) set(v data, status int, udp net.PacketConn) {
 	s.Lock()
 	defer s.Unlock()
-	s.v[v.ID] = store{expire: time.Now().Unix() + int64(s.reportInterval) + 10, data: v, status: status}
+	if prev, ok := s.v[v.ID]; ok && udp == nil && prev.udp != nil {
+		// also reported over udp, its public address is the one to punch
+		v.Public, udp = prev.Public, prev.udp
+	}
+	s.v[v.ID] = store{expire: time.Now().Unix() + int64(s.reportInterval) + 10, data: v, status: status, udp: udp}
+}
+
+func (s *PublicServer) getUDPConn(k string) net.PacketConn {
+	s.RLock()
+	defer s.RUnlock()
+	return s.v[k].udp
 }
 
 func (s *PublicServer) delete(k string) {
@@ -165,6 +277,9 @@ func (s *PublicServer) initStore(ctx context.Context) {
 	if s.v == nil {
 		s.v = map[string]store{}
 	}
+	if s.ctrl == nil {
+		s.ctrl = map[string]*ctrlConn{}
+	}
 
 	go func() {
 		tick := time.Tick(2 * time.Second)
@@ -172,6 +287,7 @@ func (s *PublicServer) initStore(ctx context.Context) {
 			now := time.Now().Unix()
 			select {
 			case <-tick:
+				s.Lock()
 				for k, v := range s.v {
 					if v.expire < now {
 						logger.Debug("record expired",
@@ -180,6 +296,7 @@ func (s *PublicServer) initStore(ctx context.Context) {
 						delete(s.v, k)
 					}
 				}
+				s.Unlock()
 			case <-ctx.Done():
 				return
 			}
@@ -222,6 +339,47 @@ func (s *PublicServer) notify(conn net.PacketConn, ID, addr, peerAddr string, pi
 	return s.writeData(conn, pAddr, rspData)
 }
 
+// notifyPeer tells peer ID at addr to ping peerAddr, pushing pong3 down its control connection
+// and sending it over udp with conn or the conn the peer reported on
+func (s *PublicServer) notifyPeer(conn net.PacketConn, ID, addr, peerAddr string, pingNum uint32) error {
+	if pingNum > maxPingNum {
+		pingNum = maxPingNum
+	}
+	var errs []error
+	sent := false
+	if c := s.getCtrl(ID); c != nil {
+		err := c.writeData(&data{
+			ID:      ID,
+			Public:  addr,
+			Peer:    peerAddr,
+			Op:      "pong3",
+			PingNum: pingNum,
+		})
+		if err == nil {
+			sent = true
+		} else {
+			errs = append(errs, fmt.Errorf("tcp notify err: %w", err))
+		}
+	}
+	if conn == nil {
+		conn = s.getUDPConn(ID)
+	}
+	if conn != nil {
+		if err := s.notify(conn, ID, addr, peerAddr, pingNum); err == nil {
+			sent = true
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	if sent {
+		return nil
+	}
+	if len(errs) == 0 {
+		return fmt.Errorf("peer %s has no notify channel", ID)
+	}
+	return errors.Join(errs...)
+}
+
 func (u *PublicServer) readData(conn net.PacketConn) (dat data, raddr net.Addr, e error) {
 	buf := make([]byte, 1024)
 	n, raddr, err := conn.ReadFrom(buf)
@@ -307,7 +465,7 @@ func (s *PublicServer) startUDPServer(ctx context.Context, lc *net.ListenConfig,
 					)
 					rspData.Op = "pong2"
 				case "report":
-					s.set(rcvData, 3)
+					s.set(rcvData, 3, conn)
 					logger.Info("report",
 						zap.String("raddr", raddr.String()),
 						zap.Object("req", &rcvData),
@@ -326,7 +484,7 @@ func (s *PublicServer) startUDPServer(ctx context.Context, lc *net.ListenConfig,
 						)
 						return
 					}
-					if err := s.notify(conn, rspData.Msg, rspData.Peer, rcvData.Public, rcvData.PingNum); err != nil {
+					if err := s.notifyPeer(conn, rspData.Msg, rspData.Peer, rcvData.Public, rcvData.PingNum); err != nil {
 						logger.Warn("notify peer server error",
 							zap.String("laddr", conn.LocalAddr().String()),
 							zap.String("peer server", rspData.Peer),
@@ -376,7 +534,6 @@ func (s *PublicServer) UDPServer(ctx context.Context, port uint) error {
 	if err != nil {
 		return fmt.Errorf("get interfaces addrs err:%w", err)
 	}
-	s.initStore(ctx)
 	lc := &net.ListenConfig{
 		Control: reuseport.Control,
 	}
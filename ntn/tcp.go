@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	mrand "math/rand"
 	"net"
@@ -48,35 +47,17 @@ func (c *TCPClient) TCPClient(ctx context.Context, port uint, serverAddress1, se
 	}
 
 	reqData.Op = "ping1"
-	reqBuf, _ := json.Marshal(reqData)
-	n, err := conn1.Write(reqBuf)
+	ctrl1 := newCtrlConn(conn1)
+	rcvData1, err := ctrl1.request(reqData, "pong1", time.Duration(dialTimeout)*time.Second)
 	if err != nil {
-		e = fmt.Errorf("write to server %s err: %w", conn1.RemoteAddr().String(), err)
-		return
-	}
-
-	logger.Debug("ping1 send success",
-		zap.String("laddr", conn1.LocalAddr().String()),
-		zap.String("raddr", conn1.RemoteAddr().String()),
-		zap.Int("len", n),
-	)
-
-	buf := make([]byte, 2048)
-	n, err = conn1.Read(buf)
-	if err != nil {
-		e = fmt.Errorf("read server %s err: %w", conn1.RemoteAddr().String(), err)
-		return
-	}
-	rcvData1 := &data{}
-	if err := json.Unmarshal(buf[:n], rcvData1); err != nil {
-		e = fmt.Errorf("decode server %s err: %w", conn1.RemoteAddr().String(), err)
+		e = fmt.Errorf("ping1 server %s err: %w", conn1.RemoteAddr().String(), err)
 		return
 	}
 
 	logger.Info("ping1 success",
 		zap.String("laddr", conn1.LocalAddr().String()),
 		zap.String("raddr", conn1.RemoteAddr().String()),
-		zap.Object("data", rcvData1),
+		zap.Object("data", &rcvData1),
 	)
 
 	if serverAddress2 != "" {
@@ -88,34 +69,17 @@ func (c *TCPClient) TCPClient(ctx context.Context, port uint, serverAddress1, se
 		defer conn2.Close()
 
 		reqData.Op = "ping2"
-		reqBuf2, _ := json.Marshal(reqData)
-		n, err = conn2.Write(reqBuf2)
+		ctrl2 := newCtrlConn(conn2)
+		rcvData2, err := ctrl2.request(reqData, "pong2", time.Duration(dialTimeout)*time.Second)
 		if err != nil {
-			e = fmt.Errorf("write to server %s err: %w", conn2.RemoteAddr().String(), err)
-			return
-		}
-
-		logger.Debug("send ping2 success",
-			zap.String("laddr", conn2.LocalAddr().String()),
-			zap.String("raddr", conn2.RemoteAddr().String()),
-			zap.Int("len", n),
-		)
-
-		n, err = conn2.Read(buf)
-		if err != nil {
-			e = fmt.Errorf("read server %s err: %w", conn2.RemoteAddr().String(), err)
-			return
-		}
-		rcvData2 := &data{}
-		if err := json.Unmarshal(buf[:n], rcvData2); err != nil {
-			e = fmt.Errorf("decode server %s err: %w", conn2.RemoteAddr().String(), err)
+			e = fmt.Errorf("ping2 server %s err: %w", conn2.RemoteAddr().String(), err)
 			return
 		}
 
 		logger.Info("ping2 success",
 			zap.String("laddr", conn2.LocalAddr().String()),
 			zap.String("raddr", conn2.RemoteAddr().String()),
-			zap.Object("data", rcvData2),
+			zap.Object("data", &rcvData2),
 			zap.Bool("cone", rcvData1.Public == rcvData2.Public),
 		)
 	}
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	mrand "math/rand"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-reuseport"
@@ -50,12 +52,17 @@ func (f *data) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	return nil
 }
 
-func NewUdpPeer(id, server1, server2 string) *UDPPeer {
+const ctrlRetryDelay = 5 * time.Second
+
+var errNoCtrl = errors.New("no tcp control connection")
+
+func NewUdpPeer(id, server1, server2 string, tcpCtrl bool) *UDPPeer {
 	p := &UDPPeer{
 		networkType:    "udp4",
 		peerID:         id,
 		serverAddress1: server1,
 		serverAddress2: server2,
+		tcpCtrl:        tcpCtrl,
 	}
 
 	return p
@@ -68,6 +75,10 @@ type UDPPeer struct {
 	serverAddress2 string
 	serverAddr1    *net.UDPAddr
 	serverAddr2    *net.UDPAddr
+	publicAddress  string // learned by ping1, empty if udp signaling failed
+	tcpCtrl        bool   // also signal over a tcp control connection to server1
+	ctrlMu         sync.Mutex
+	ctrl           *ctrlConn
 }
 
 func (u *UDPPeer) readData(conn net.PacketConn) (dat data, raddr net.Addr, e error) {
@@ -133,12 +144,31 @@ func (u *UDPPeer) prepare(port uint) (conn net.PacketConn, e error) {
 		zap.Uint32("dial-timeout", dialTimeout),
 	)
 
+	if err := u.ping(conn); err != nil {
+		var netErr *net.OpError // e.g. timeout or blocked, not a symmetric nat
+		if !u.tcpCtrl || !errors.As(err, &netErr) {
+			conn.Close()
+			return nil, err
+		}
+		logger.Warn("udp signaling failed, fallback to tcp control connection",
+			zap.String("server", u.serverAddress1),
+			zap.Error(err),
+		)
+	}
+	return conn, nil
+}
+
+// ping learns the public address of conn from ping1/ping2, which must match for a cone nat
+func (u *UDPPeer) ping(conn net.PacketConn) (e error) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(dialTimeout) * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
 	reqData := data{
 		ID: u.peerID,
 		Op: "ping1",
 	}
 
-	err = u.writeData(conn, u.serverAddr1, &reqData)
+	err := u.writeData(conn, u.serverAddr1, &reqData)
 	if err != nil {
 		e = fmt.Errorf("send ping1 %s err: %w", u.serverAddr1.String(), err)
 		return
@@ -211,10 +241,150 @@ func (u *UDPPeer) prepare(port uint) (conn net.PacketConn, e error) {
 		zap.String("public", rcvData2.Public),
 		zap.Object("resp", &rcvData2),
 	)
+	u.publicAddress = rcvData1.Public
 
 	return
 }
 
+func (u *UDPPeer) setCtrl(c *ctrlConn) {
+	u.ctrlMu.Lock()
+	defer u.ctrlMu.Unlock()
+	u.ctrl = c
+}
+
+// sendCtrl sends dat over the tcp control connection
+func (u *UDPPeer) sendCtrl(dat *data) error {
+	u.ctrlMu.Lock()
+	c := u.ctrl
+	u.ctrlMu.Unlock()
+	if c == nil {
+		return errNoCtrl
+	}
+	return c.writeData(dat)
+}
+
+// keepCtrl keeps a tcp control connection to server1 from the local port of conn,
+// redialing when it breaks. connected is called on every new connection,
+// handle with every message the server sends or pushes
+func (u *UDPPeer) keepCtrl(ctx context.Context, conn net.PacketConn, connected func(), handle func(data)) {
+	dialer := net.Dialer{
+		Control: reuseport.Control,
+		Timeout: time.Duration(dialTimeout) * time.Second,
+	}
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		// same port as udp, a port preserving nat then maps tcp like udp
+		dialer.LocalAddr = &net.TCPAddr{Port: laddr.Port}
+	}
+
+	for {
+		tcpConn, err := dialer.DialContext(ctx, "tcp4", u.serverAddress1)
+		if err != nil {
+			logger.Warn("dial tcp control error",
+				zap.String("server", u.serverAddress1),
+				zap.Error(err),
+			)
+		} else {
+			c := newCtrlConn(tcpConn)
+			u.setCtrl(c)
+			logger.Info("tcp control connected",
+				zap.String("laddr", tcpConn.LocalAddr().String()),
+				zap.String("raddr", tcpConn.RemoteAddr().String()),
+			)
+			connected()
+			for {
+				rcvData, err := c.readData()
+				if err != nil {
+					if isDecodeError(err) {
+						continue
+					}
+					logger.Warn("tcp control closed",
+						zap.String("raddr", tcpConn.RemoteAddr().String()),
+						zap.Error(err),
+					)
+					break
+				}
+				handle(rcvData)
+			}
+			u.setCtrl(nil)
+			tcpConn.Close()
+		}
+
+		select {
+		case <-time.After(ctrlRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// report tells the public server this peer accepts pings, over udp and the tcp control connection
+func (u *UDPPeer) report(conn net.PacketConn, reqData *data) error {
+	reqData.Op = "report"
+	reqData.Public = u.publicAddress
+	err := u.writeData(conn, u.serverAddr1, reqData)
+	if err != nil && !u.tcpCtrl {
+		return fmt.Errorf("report to server %s err: %w", u.serverAddr1.String(), err)
+	}
+	if u.tcpCtrl {
+		if cerr := u.sendCtrl(reqData); cerr != nil {
+			if err != nil {
+				return fmt.Errorf("report to server %s err: %w, tcp err: %v", u.serverAddr1.String(), err, cerr)
+			}
+			logger.Debug("tcp report error",
+				zap.Error(cerr),
+			)
+		}
+	}
+
+	logger.Info("report",
+		zap.String("raddr", u.serverAddr1.String()),
+		zap.Object("req", reqData),
+	)
+	return nil
+}
+
+// pingPeer sends pingNum spings to peerAddress, the pong3 of a peer client's request
+func (u *UDPPeer) pingPeer(conn net.PacketConn, peerAddress string, pingNum, pingPeerInterval uint32) {
+	peerAddr, err := net.ResolveUDPAddr(u.networkType, peerAddress)
+	if err != nil {
+		logger.Warn("resolve peer address faled",
+			zap.String("address", peerAddress),
+			zap.Error(err),
+		)
+		return
+	}
+	reqData := &data{
+		ID: u.peerID,
+	}
+	ticker := time.NewTicker(time.Duration(mrand.Uint32()%pingPeerInterval) * time.Millisecond)
+	defer ticker.Stop()
+	if pingNum < 1 {
+		pingNum = 10
+	}
+	for i := uint32(0); i < pingNum; i++ {
+		reqData.Op = "sping"
+		reqData.Msg = "sping peer"
+		reqData.Peer = peerAddr.String()
+		reqData.PingNum = i
+		err = u.writeData(conn, peerAddr, reqData)
+		if err != nil {
+			logger.Warn("sping error",
+				zap.String("paddr", peerAddr.String()),
+				zap.Error(err),
+			)
+		} else {
+			logger.Debug("sping success",
+				zap.String("paddr", peerAddr.String()),
+				zap.Uint32("num", i),
+			)
+		}
+		select {
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
 func (u *UDPPeer) UDPPeerServer(ctx context.Context, port uint, dialTimeout, reportInterval, pingPeerInterval uint32) (e error) {
 	conn, err := u.prepare(port)
 	if err != nil {
@@ -238,46 +408,7 @@ func (u *UDPPeer) UDPPeerServer(ctx context.Context, port uint, dialTimeout, rep
 			switch rcvData.Op {
 			case "pong3": // response of peer server's report from public server
 				if rcvData.Peer != "" {
-					go func(peerAddress string) {
-						peerAddr, err := net.ResolveUDPAddr(u.networkType, peerAddress)
-						if err != nil {
-							logger.Warn("resolve peer address faled",
-								zap.String("address", peerAddress),
-								zap.Error(err),
-							)
-							return
-						}
-						reqData := &data{
-							ID: u.peerID,
-						}
-						ticker := time.NewTicker(time.Duration(mrand.Uint32()%pingPeerInterval) * time.Millisecond)
-						defer ticker.Stop()
-						if rcvData.PingNum < 1 {
-							rcvData.PingNum = 10
-						}
-						for i := uint32(0); i < rcvData.PingNum; i++ {
-							reqData.Op = "sping"
-							reqData.Msg = "sping peer"
-							reqData.Peer = peerAddr.String()
-							reqData.PingNum = i
-							err = u.writeData(conn, peerAddr, reqData)
-							if err != nil {
-								logger.Warn("sping error",
-									zap.String("paddr", peerAddr.String()),
-									zap.Error(err),
-								)
-							} else {
-								logger.Debug("sping success",
-									zap.String("paddr", peerAddr.String()),
-									zap.Uint32("num", i),
-								)
-							}
-							select {
-							case <-ticker.C:
-								continue
-							}
-						}
-					}(rcvData.Peer)
+					go u.pingPeer(conn, rcvData.Peer, rcvData.PingNum, pingPeerInterval)
 				}
 			case "cping": // peer client ping
 				go func(clientAddr net.Addr, rcvd data) {
@@ -316,19 +447,38 @@ func (u *UDPPeer) UDPPeerServer(ctx context.Context, port uint, dialTimeout, rep
 
 	}()
 
+	if u.tcpCtrl {
+		go u.keepCtrl(ctx, conn, func() {
+			// register right away, the report loop may sleep for long
+			if err := u.sendCtrl(&data{ID: u.peerID, Op: "report", Public: u.publicAddress}); err != nil {
+				logger.Warn("tcp report error",
+					zap.Error(err),
+				)
+			}
+		}, func(rcvData data) {
+			switch rcvData.Op {
+			case "pong3": // pushed by the public server when a peer client requests
+				logger.Info("recv tcp msg",
+					zap.String("server", u.serverAddress1),
+					zap.Object("data", &rcvData),
+				)
+				if rcvData.Peer != "" {
+					go u.pingPeer(conn, rcvData.Peer, rcvData.PingNum, pingPeerInterval)
+				}
+			default:
+				logger.Debug("recv tcp msg",
+					zap.String("server", u.serverAddress1),
+					zap.Object("data", &rcvData),
+				)
+			}
+		})
+	}
+
 	for {
-		reqData.Op = "report"
-		err = u.writeData(conn, u.serverAddr1, reqData)
-		if err != nil {
-			e = fmt.Errorf("report to server %s err: %w", u.serverAddr1.String(), err)
-			return
+		if err := u.report(conn, reqData); err != nil {
+			return err
 		}
 
-		logger.Info("report",
-			zap.String("raddr", u.serverAddr1.String()),
-			zap.Object("req", reqData),
-		)
-
 		time.Sleep(time.Duration(reportInterval) * time.Second)
 	}
 
@@ -342,10 +492,27 @@ func (u *UDPPeer) UDPPeerClient(ctx context.Context, port uint, dialTimeout, req
 	}
 
 	punchedMessage := make(chan bool)
-	peerAddressMessage := make(chan string)
+	peerAddressMessage := make(chan string, 1)
+	var pong3Once sync.Once
+	// the pong3 of a request may come over udp and tcp, take the first
+	gotPeer := func(peerAddress string) {
+		pong3Once.Do(func() {
+			peerAddressMessage <- peerAddress
+		})
+	}
+	if u.tcpCtrl {
+		go u.keepCtrl(ctx, conn, func() {}, func(rcvData data) {
+			logger.Info("recv tcp msg",
+				zap.String("server", u.serverAddress1),
+				zap.Object("data", &rcvData),
+			)
+			if rcvData.Op == "pong3" && rcvData.Peer != "" {
+				gotPeer(rcvData.Peer)
+			}
+		})
+	}
 	go func() {
 		punched := false
-		gotpong3 := false
 		for {
 			rcvData, raddr, err := u.readData(conn)
 			if err != nil {
@@ -363,9 +530,8 @@ func (u *UDPPeer) UDPPeerClient(ctx context.Context, port uint, dialTimeout, req
 				}
 				continue
 			case "pong3":
-				if !gotpong3 && rcvData.Peer != "" {
-					peerAddressMessage <- rcvData.Peer
-					gotpong3 = true
+				if rcvData.Peer != "" {
+					gotPeer(rcvData.Peer)
 				}
 				continue
 			case "cping": // peer client ping(peer server's reply)
@@ -398,10 +564,16 @@ func (u *UDPPeer) UDPPeerClient(ctx context.Context, port uint, dialTimeout, req
 requestLoop:
 	for i := 0; i < 10; i++ {
 		reqData.Op = "request" // request peer address
+		reqData.Public = u.publicAddress
 		err = u.writeData(conn, u.serverAddr1, reqData)
-		if err != nil {
+		if err != nil && !u.tcpCtrl {
 			return fmt.Errorf("write to server %s err: %w", u.serverAddr1.String(), err)
 		}
+		if u.tcpCtrl {
+			if cerr := u.sendCtrl(reqData); cerr != nil && err != nil {
+				return fmt.Errorf("write to server %s err: %w, tcp err: %v", u.serverAddr1.String(), err, cerr)
+			}
+		}
 
 		logger.Info("request",
 			zap.String("server", u.serverAddr1.String()),
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type backendState struct {
+	URL          string     `json:"url"`
+	Weight       int        `json:"weight"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	InFlight     int64      `json:"in_flight"`
+	Circuit      string     `json:"circuit"`
+	CircuitFails int64      `json:"circuit_fails"`
+	Available    bool       `json:"available"`
+}
+
+type poolState struct {
+	Name         string          `json:"name"`
+	Strategy     string          `json:"strategy"`
+	MaxConns     int64           `json:"max_conns,omitempty"`
+	CircuitFails int             `json:"circuit_fails,omitempty"`
+	Backends     []*backendState `json:"backends"`
+}
+
+type limitState struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Key   string  `json:"key"`
+	Keys  int     `json:"keys"` // buckets tracked
+}
+
+type proxyAdminState struct {
+	RateLimit *limitState  `json:"rate_limit,omitempty"`
+	Pools     []*poolState `json:"pools"`
+}
+
+// adminHandler serves /metrics, the backend and rate limit state at /state and the cache at /cache.
+// Nothing is authenticated and DELETE /cache purges the cache, -admin-addr must not be reachable from outside
+func adminHandler(l *limiter) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/state", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, adminState(l))
+	})
+	mux.HandleFunc("/cache", adminCache)
+	return mux
+}
+
+func writeJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminCache shows the cache size on GET, DELETE purges the urls starting with
+// the prefix parameter, host and path like example.com/static/, or all of them without it,
+// of the route parameter or of every route without it
+func adminCache(rw http.ResponseWriter, r *http.Request) {
+	if responseCache == nil {
+		http.Error(rw, "cache disabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(rw, responseCache.store.stats())
+	case http.MethodDelete, "PURGE":
+		route, prefix := r.URL.Query().Get("route"), r.URL.Query().Get("prefix")
+		n := responseCache.purge(route, prefix)
+		slog.Info("cache purged",
+			slog.String("route", route),
+			slog.String("prefix", prefix),
+			slog.Int("entries", n),
+		)
+		writeJSON(rw, map[string]int{"purged": n})
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, DELETE, PURGE")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func adminState(l *limiter) *proxyAdminState {
+	s := &proxyAdminState{Pools: []*poolState{}}
+	if l != nil && l.Rate > 0 {
+		s.RateLimit = &limitState{Rate: l.Rate, Burst: l.Burst, Key: l.Key, Keys: l.size()}
+	}
+	now := time.Now()
+	for name, p := range currentRouter.Load().pools {
+		ps := &poolState{
+			Name:         name,
+			Strategy:     p.Strategy,
+			MaxConns:     p.MaxConns,
+			CircuitFails: p.CircuitFails,
+		}
+		for _, b := range p.backends {
+			bs := &backendState{
+				URL:          b.url.String(),
+				Weight:       b.weight,
+				Healthy:      b.healthy.Load(),
+				InFlight:     b.conns.Load(),
+				Circuit:      b.breaker.String(),
+				CircuitFails: b.breaker.fails.Load(),
+				Available:    p.available(b, now, nil),
+			}
+			if until := time.Unix(0, b.ejectedUntil.Load()); until.After(now) {
+				bs.EjectedUntil = &until
+			}
+			ps.Backends = append(ps.Backends, bs)
+		}
+		s.Pools = append(s.Pools, ps)
+	}
+	sort.Slice(s.Pools, func(i, j int) bool { return s.Pools[i].Name < s.Pools[j].Name })
+	return s
+}
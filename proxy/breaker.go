@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// circuit breaker states
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitNames = [...]string{"closed", "open", "half-open"}
+
+// outcome of a request to a backend
+type outcome int
+
+const (
+	outcomeOK          outcome = iota
+	outcomeCanceled            // the client went away, says nothing about the backend
+	outcomeServerError         // 5xx response
+	outcomeFailed              // transport error
+)
+
+// breaker opens after consecutive failures, rejects requests for the cooldown,
+// then lets a single trial request through and closes if it succeeds
+type breaker struct {
+	state    atomic.Int32
+	fails    atomic.Int64
+	openedAt atomic.Int64 // unix nano
+}
+
+func (c *breaker) String() string {
+	return circuitNames[c.state.Load()]
+}
+
+// ready reports whether the breaker would let a request through at now
+func (c *breaker) ready(now time.Time, cooldown time.Duration) bool {
+	switch c.state.Load() {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		return now.UnixNano() >= c.openedAt.Load()+int64(cooldown)
+	}
+	return false // the half-open trial is in flight
+}
+
+// allow is ready claiming the half-open trial, only one caller gets it
+func (c *breaker) allow(now time.Time, cooldown time.Duration) bool {
+	switch c.state.Load() {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		return c.ready(now, cooldown) && c.state.CompareAndSwap(circuitOpen, circuitHalfOpen)
+	}
+	return false
+}
+
+// record counts the outcome of an allowed request, threshold 0 disables the breaker
+func (c *breaker) record(o outcome, threshold int, backend string) {
+	if threshold <= 0 {
+		return
+	}
+	switch o {
+	case outcomeOK:
+		c.fails.Store(0)
+		if c.state.CompareAndSwap(circuitHalfOpen, circuitClosed) {
+			slog.Info("circuit closed",
+				slog.String("backend", backend),
+			)
+		}
+	case outcomeCanceled:
+		// give the trial back, the next request may try again
+		if c.state.Load() == circuitHalfOpen {
+			c.openedAt.Store(0)
+			c.state.Store(circuitOpen)
+		}
+	default:
+		fails := c.fails.Add(1)
+		state := c.state.Load()
+		if state == circuitOpen || state == circuitClosed && fails < int64(threshold) {
+			return
+		}
+		// set before opening so a concurrent ready never sees an old time
+		c.openedAt.Store(time.Now().UnixNano())
+		if c.state.CompareAndSwap(state, circuitOpen) {
+			slog.Warn("circuit open",
+				slog.String("backend", backend),
+				slog.Int64("fails", fails),
+			)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// go test -run ^TestBreaker$ .
+func TestBreaker(t *testing.T) {
+	const cooldown = 10 * time.Second
+	steps := []struct {
+		name    string
+		record  bool // record outcome, else allow at after
+		outcome outcome
+		after   time.Duration
+		allowed bool
+		state   string
+	}{
+		{"first fail", true, outcomeFailed, 0, false, "closed"},
+		{"second fail", true, outcomeServerError, 0, false, "closed"},
+		{"success resets the row", true, outcomeOK, 0, false, "closed"},
+		{"fail 1", true, outcomeFailed, 0, false, "closed"},
+		{"canceled doesn't count", true, outcomeCanceled, 0, false, "closed"},
+		{"fail 2", true, outcomeFailed, 0, false, "closed"},
+		{"fail 3 opens", true, outcomeServerError, 0, false, "open"},
+		{"rejected while cooling down", false, 0, cooldown / 2, false, "open"},
+		{"trial after the cooldown", false, 0, cooldown, true, "half-open"},
+		{"one trial at a time", false, 0, cooldown, false, "half-open"},
+		{"canceled trial is given back", true, outcomeCanceled, 0, false, "open"},
+		{"next trial", false, 0, 0, true, "half-open"},
+		{"failed trial reopens", true, outcomeFailed, 0, false, "open"},
+		{"rejected again", false, 0, cooldown / 2, false, "open"},
+		{"another trial", false, 0, cooldown, true, "half-open"},
+		{"successful trial closes", true, outcomeOK, 0, false, "closed"},
+		{"closed allows", false, 0, 0, true, "closed"},
+	}
+	c := &breaker{}
+	for _, v := range steps {
+		if v.record {
+			c.record(v.outcome, 3, "b")
+		} else if allowed := c.allow(time.Now().Add(v.after), cooldown); allowed != v.allowed {
+			t.Errorf("%s expect: allowed %v, got: %v", v.name, v.allowed, allowed)
+		}
+		if c.String() != v.state {
+			t.Fatalf("%s expect: %s, got: %s", v.name, v.state, c.String())
+		}
+	}
+
+	// threshold 0 never opens
+	c = &breaker{}
+	for i := 0; i < 10; i++ {
+		c.record(outcomeFailed, 0, "b")
+	}
+	if !c.allow(time.Now(), cooldown) || c.String() != "closed" {
+		t.Errorf("disabled expect: closed, got: %s", c.String())
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// X-Cache values
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheStale       = "STALE" // served stale while revalidating in the background
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+type cacheOption struct {
+	Enable    bool
+	MemSize   int64  // bytes of the memory tier
+	MaxObject int64  // larger responses are not stored
+	Disk      string // directory of the disk tier, empty disables it
+	DiskSize  int64
+}
+
+var cacheOpt = cacheOption{
+	MemSize:   64 << 20,
+	MaxObject: 8 << 20,
+	DiskSize:  1 << 30,
+}
+
+// responseCache is the shared cache of rfc 9111 in front of the backends
+var responseCache *httpCache
+
+// statuses heuristically cacheable by rfc 9110 15.1
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+type httpCache struct {
+	cacheOption
+	store *cacheStore
+
+	mu      sync.Mutex
+	flights map[string]chan struct{}
+}
+
+func newHTTPCache(opt cacheOption) (*httpCache, error) {
+	var disk *diskStore
+	if opt.Disk != "" {
+		var err error
+		if disk, err = newDiskStore(opt.Disk, opt.DiskSize); err != nil {
+			return nil, err
+		}
+	}
+	return &httpCache{
+		cacheOption: opt,
+		store:       newCacheStore(opt.MemSize, disk),
+		flights:     map[string]chan struct{}{},
+	}, nil
+}
+
+// cacheControl holds the lowercase directives of Cache-Control headers
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if k == "" {
+				continue
+			}
+			cc[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	// http/1.0 Pragma: no-cache, only without Cache-Control
+	if len(cc) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(k string) bool {
+	_, ok := cc[k]
+	return ok
+}
+
+// seconds returns the delta-seconds of k, ok is false if k is missing or invalid
+func (cc cacheControl) seconds(k string) (time.Duration, bool) {
+	v, ok := cc[k]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// age is the current_age of rfc 9111 4.2.3
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := e.ResponseTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// lifetime is the freshness_lifetime of rfc 9111 4.2.1, explicit is false for a heuristic one
+func (e *cacheEntry) lifetime() (d time.Duration, explicit bool) {
+	cc := parseCacheControl(e.Header)
+	if v, ok := cc["no-cache"]; ok && v == "" {
+		return 0, true
+	}
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true // invalid dates mean already expired
+		}
+		return expires.Sub(e.date()), true
+	}
+	// rfc 9111 4.2.2, a tenth of the time since the last modification, at most a day
+	if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && cacheableStatus[e.Status] {
+		d := e.date().Sub(lm) / 10
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
+		if d > 0 {
+			return d, false
+		}
+	}
+	return 0, false
+}
+
+// fresh reports whether e may be served without validation for a request with reqCC
+func (e *cacheEntry) fresh(now time.Time, reqCC cacheControl) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+	age := e.age(now)
+	lifetime, _ := e.lifetime()
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	return age < lifetime
+}
+
+// staleWhileRevalidate reports whether stale e may be served while it is revalidated, rfc 5861
+func (e *cacheEntry) staleWhileRevalidate(now time.Time, reqCC cacheControl) bool {
+	cc := parseCacheControl(e.Header)
+	window, ok := cc.seconds("stale-while-revalidate")
+	if !ok || reqCC.has("no-cache") || cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("no-cache") {
+		return false
+	}
+	lifetime, _ := e.lifetime()
+	return e.age(now) < lifetime+window
+}
+
+// storable reports whether a response may be stored, rfc 9111 3
+func storable(req *http.Request, status int, header http.Header) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") || header.Get("Vary") == "*" ||
+		// a shared cache handing out other people's cookies is worse than a miss
+		header.Get("Set-Cookie") != "" ||
+		strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	e := &cacheEntry{Status: status, Header: header}
+	if _, explicit := e.lifetime(); explicit {
+		return cacheableStatus[status] || status < 500 && status != http.StatusPartialContent && status != http.StatusNotModified
+	}
+	if cacheableStatus[status] {
+		// heuristic freshness or validators to revalidate with
+		return header.Get("Last-Modified") != "" || header.Get("ETag") != ""
+	}
+	return false
+}
+
+// primaryKey is the request target on a route, variants of it by Vary get their own key.
+// Routes keep their own entries, the same url may go to different pools or get other headers
+func primaryKey(route string, r *http.Request) string {
+	return route + "\x00" + targetKey(r)
+}
+
+// targetKey is the part of the keys after the route, purges match it on every route
+func targetKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI() + "\x00"
+}
+
+func varyKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+		b.WriteByte('\x00')
+	}
+	return b.String()
+}
+
+func parseVary(header http.Header) []string {
+	vary := []string{}
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// key is the primary key of r, or its variant key if the primary key holds the Vary of the stored responses
+func (c *httpCache) key(route string, r *http.Request) string {
+	primary := primaryKey(route, r)
+	if e := c.store.get(primary); e != nil && len(e.Vary) > 0 {
+		return varyKey(primary, e.Vary, r)
+	}
+	return primary
+}
+
+// join returns the channel closed when the leader of key is done, leader is true if the caller leads
+func (c *httpCache) join(key string) (done chan struct{}, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done = c.flights[key]; done != nil {
+		return done, false
+	}
+	done = make(chan struct{})
+	c.flights[key] = done
+	return done, true
+}
+
+func (c *httpCache) leave(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// purge removes the entries of route whose keys start with prefix, host + path, those of every route
+// without route, all of them if both are empty
+func (c *httpCache) purge(route, prefix string) int {
+	if route != "" {
+		return c.store.purge(route + "\x00" + prefix)
+	}
+	if prefix == "" {
+		return c.store.purge("")
+	}
+	n := 0
+	for _, rt := range currentRouter.Load().routes {
+		n += c.store.purge(rt.Name + "\x00" + prefix)
+	}
+	return n
+}
+
+// serve answers r from the cache, forwarding misses and revalidations upstream.
+// Concurrent misses of a key wait for the first one instead of all going upstream
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, st *proxyState) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rec := &responseWriter{ResponseWriter: w}
+		st.cache = cacheBypass
+		w.Header().Set("X-Cache", cacheBypass)
+		forward(rec, r, st)
+		// rfc 9111 4.4, unsafe methods invalidate the target
+		if rec.status < 400 && r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+			c.purge("", targetKey(r))
+		}
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	if reqCC.has("no-store") || r.Header.Get("Authorization") != "" {
+		st.cache = cacheBypass
+		w.Header().Set("X-Cache", cacheBypass)
+		forward(w, r, st)
+		return
+	}
+
+	for waited := false; ; waited = true {
+		key := c.key(st.route.Name, r)
+		now := time.Now()
+		e := c.store.get(key)
+		if e != nil && len(e.Vary) > 0 {
+			// the Vary of the primary key was stored after c.key looked
+			e = nil
+		}
+		switch {
+		case e != nil && e.fresh(now, reqCC):
+			c.write(w, r, st, e, cacheHit)
+			return
+		case e != nil && e.staleWhileRevalidate(now, reqCC):
+			c.write(w, r, st, e, cacheStale)
+			go c.revalidate(r.Clone(context.Background()), st.route, key, e)
+			return
+		case e == nil && reqCC.has("only-if-cached"):
+			st.cache = cacheMiss
+			w.Header().Set("X-Cache", cacheMiss)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		case e == nil && r.Method == http.MethodHead:
+			// not worth a GET, just pass it on
+			st.cache = cacheMiss
+			w.Header().Set("X-Cache", cacheMiss)
+			forward(w, r, st)
+			return
+		}
+		if waited {
+			break
+		}
+		done, leader := c.join(key)
+		if leader {
+			defer c.leave(key, done)
+			c.fetch(w, r, st, key, e)
+			return
+		}
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// the leader's response could not be stored, e.g. too large
+	st.cache = cacheMiss
+	w.Header().Set("X-Cache", cacheMiss)
+	forward(w, r, st)
+}
+
+// upstreamRequest is r without the client's validators so the response can be stored,
+// with the validators of e to revalidate it
+func upstreamRequest(ctx context.Context, r *http.Request, e *cacheEntry) *http.Request {
+	up := r.Clone(ctx)
+	for _, k := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		up.Header.Del(k)
+	}
+	if e != nil {
+		if etag := e.Header.Get("ETag"); etag != "" {
+			up.Header.Set("If-None-Match", etag)
+		}
+		if lm := e.Header.Get("Last-Modified"); lm != "" {
+			up.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	return up
+}
+
+// fetch forwards r, stores the response if it may and writes it to w, stale is the entry to revalidate
+func (c *httpCache) fetch(w http.ResponseWriter, r *http.Request, st *proxyState, key string, stale *cacheEntry) {
+	cw := &captureWriter{dst: w, req: r, max: c.MaxObject, revalidate: stale != nil}
+	sent := time.Now()
+	forward(cw, upstreamRequest(r.Context(), r, stale), st)
+	if cw.passthrough {
+		st.cache = cacheMiss
+		return
+	}
+	e, status := c.update(r, st.route.Name, key, stale, cw, sent)
+	if e == nil {
+		// buffered but not stored, a 304 without an entry or an error
+		st.cache = cacheMiss
+		copyHeader(w.Header(), cw.header)
+		w.Header().Set("X-Cache", cacheMiss)
+		w.WriteHeader(cw.status)
+		w.Write(cw.body.Bytes())
+		return
+	}
+	c.write(w, r, st, e, status)
+}
+
+// revalidate refreshes stale e in the background, once per key at a time,
+// r is detached from the client request which is already answered
+func (c *httpCache) revalidate(r *http.Request, rt *route, key string, stale *cacheEntry) {
+	done, leader := c.join(key)
+	if !leader {
+		return
+	}
+	defer c.leave(key, done)
+	cw := &captureWriter{req: r, max: c.MaxObject, revalidate: true}
+	sent := time.Now()
+	forward(cw, upstreamRequest(r.Context(), r, stale), &proxyState{route: rt})
+	if _, status := c.update(r, rt.Name, key, stale, cw, sent); status == "" {
+		slog.Warn("cache background revalidation failed",
+			slog.String("url", r.URL.String()),
+			slog.Int("response", cw.status),
+		)
+	}
+}
+
+// update stores the response captured by cw, returning the entry to serve and its X-Cache
+func (c *httpCache) update(r *http.Request, route, key string, stale *cacheEntry, cw *captureWriter, sent time.Time) (*cacheEntry, string) {
+	now := time.Now()
+	if cw.status == http.StatusNotModified && stale != nil {
+		// rfc 9111 4.3.4, freshen the stored headers with the 304's
+		header := stale.Header.Clone()
+		for k, v := range cw.header {
+			if k != "Content-Length" {
+				header[k] = v
+			}
+		}
+		e := &cacheEntry{Key: stale.Key, Status: stale.Status, Header: header, Body: stale.Body, RequestTime: sent, ResponseTime: now}
+		c.store.put(e)
+		return e, cacheRevalidated
+	}
+	if !cw.storable || cw.overflow {
+		if stale != nil && cw.status < 500 {
+			// the resource changed into something we can't keep
+			c.store.purge(key)
+		}
+		return nil, ""
+	}
+	primary := primaryKey(route, r)
+	vary := parseVary(cw.header)
+	if len(vary) > 0 {
+		// evicted and purged like the variants, a response without Vary replaces it
+		c.store.put(&cacheEntry{Key: primary, Vary: vary, ResponseTime: now})
+	}
+	e := &cacheEntry{
+		Key:          varyKey(primary, vary, r),
+		Status:       cw.status,
+		Header:       cw.header,
+		Body:         cw.body.Bytes(),
+		RequestTime:  sent,
+		ResponseTime: now,
+	}
+	c.store.put(e)
+	return e, cacheMiss
+}
+
+// write serves e to the client, answering its validators with 304
+func (c *httpCache) write(w http.ResponseWriter, r *http.Request, st *proxyState, e *cacheEntry, status string) {
+	st.cache = status
+	h := w.Header()
+	copyHeader(h, e.Header)
+	h.Set("Age", strconv.FormatInt(int64(e.age(time.Now())/time.Second), 10))
+	h.Set("X-Cache", status)
+	if e.Status == http.StatusOK && notModified(r, e.Header) {
+		for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			h.Del(k)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it, rfc 9110 13.2.2
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+// captureWriter buffers a storable response for the cache and streams the others to dst,
+// a storable one larger than max switches to streaming too
+type captureWriter struct {
+	dst        http.ResponseWriter // nil for background revalidations
+	req        *http.Request
+	max        int64
+	revalidate bool // a 304 is the answer to our validators, keep it
+
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	storable    bool
+	overflow    bool
+	passthrough bool
+}
+
+func (w *captureWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *captureWriter) WriteHeader(code int) {
+	if code < 200 {
+		// informational, e.g. 103 early hints
+		if w.dst != nil {
+			copyHeader(w.dst.Header(), w.header)
+			w.dst.WriteHeader(code)
+		}
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	w.storable = storable(w.req, code, w.Header())
+	if !w.storable && !(w.revalidate && code == http.StatusNotModified) {
+		w.stream()
+	}
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.dst.Write(b)
+	}
+	if w.overflow {
+		return len(b), nil
+	}
+	if int64(w.body.Len()+len(b)) > w.max {
+		w.overflow = true
+		if w.dst != nil {
+			w.stream()
+			return w.dst.Write(b)
+		}
+		w.body.Reset()
+		return len(b), nil
+	}
+	return w.body.Write(b)
+}
+
+// stream sends the status and the buffered body to dst and the rest of the response straight to it
+func (w *captureWriter) stream() {
+	if w.dst == nil {
+		return
+	}
+	w.passthrough = true
+	copyHeader(w.dst.Header(), w.header)
+	w.dst.Header().Set("X-Cache", cacheMiss)
+	w.dst.WriteHeader(w.status)
+	if w.body.Len() > 0 {
+		w.dst.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+}
+
+func (w *captureWriter) Flush() {
+	if w.passthrough {
+		http.NewResponseController(w.dst).Flush()
+	}
+}
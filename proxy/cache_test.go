@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testHeader(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		h.Add(kv[i], kv[i+1])
+	}
+	return h
+}
+
+var testNow = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// go test -run ^TestCacheLifetime$ .
+func TestCacheLifetime(t *testing.T) {
+	date := testNow.Format(http.TimeFormat)
+	cases := []struct {
+		name     string
+		status   int
+		header   http.Header
+		lifetime time.Duration
+		explicit bool
+	}{
+		{"s-maxage wins", 200, testHeader("Cache-Control", "max-age=10, s-maxage=20"), 20 * time.Second, true},
+		{"max-age", 200, testHeader("Cache-Control", "max-age=10", "Expires", testNow.Add(time.Hour).Format(http.TimeFormat)), 10 * time.Second, true},
+		{"no-cache", 200, testHeader("Cache-Control", "no-cache, max-age=10"), 0, true},
+		{"expires", 200, testHeader("Date", date, "Expires", testNow.Add(time.Minute).Format(http.TimeFormat)), time.Minute, true},
+		{"invalid expires", 200, testHeader("Expires", "0"), 0, true},
+		{"invalid max-age", 200, testHeader("Cache-Control", "max-age=-1"), 0, false},
+		{"heuristic", 200, testHeader("Date", date, "Last-Modified", testNow.Add(-100*time.Minute).Format(http.TimeFormat)), 10 * time.Minute, false},
+		{"heuristic at most a day", 200, testHeader("Date", date, "Last-Modified", testNow.Add(-30*24*time.Hour).Format(http.TimeFormat)), 24 * time.Hour, false},
+		{"no heuristic for 206", 206, testHeader("Date", date, "Last-Modified", testNow.Add(-time.Hour).Format(http.TimeFormat)), 0, false},
+		{"nothing", 200, testHeader(), 0, false},
+	}
+	for _, v := range cases {
+		e := &cacheEntry{Status: v.status, Header: v.header, RequestTime: testNow, ResponseTime: testNow}
+		if d, explicit := e.lifetime(); d != v.lifetime || explicit != v.explicit {
+			t.Errorf("%s expect: %v %v, got: %v %v", v.name, v.lifetime, v.explicit, d, explicit)
+		}
+	}
+}
+
+// go test -run ^TestCacheFresh$ .
+func TestCacheFresh(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		rtt    time.Duration // between request and response
+		after  time.Duration // since the response
+		reqCC  string
+		fresh  bool
+	}{
+		{"young", testHeader("Cache-Control", "max-age=60"), 0, 30 * time.Second, "", true},
+		{"old", testHeader("Cache-Control", "max-age=60"), 0, 60 * time.Second, "", false},
+		{"age header", testHeader("Cache-Control", "max-age=60", "Age", "50"), 0, 20 * time.Second, "", false},
+		{"response delay", testHeader("Cache-Control", "max-age=60"), 40 * time.Second, 30 * time.Second, "", false},
+		{"apparent age", testHeader("Cache-Control", "max-age=60", "Date", testNow.Add(-time.Minute).Format(http.TimeFormat)), 0, 0, "", false},
+		{"request no-cache", testHeader("Cache-Control", "max-age=60"), 0, 0, "no-cache", false},
+		{"request max-age", testHeader("Cache-Control", "max-age=60"), 0, 30 * time.Second, "max-age=10", false},
+		{"request min-fresh", testHeader("Cache-Control", "max-age=60"), 0, 30 * time.Second, "min-fresh=40", false},
+		{"request min-fresh ok", testHeader("Cache-Control", "max-age=60"), 0, 10 * time.Second, "min-fresh=40", true},
+	}
+	for _, v := range cases {
+		e := &cacheEntry{Status: 200, Header: v.header, RequestTime: testNow.Add(-v.rtt), ResponseTime: testNow}
+		reqCC := parseCacheControl(testHeader("Cache-Control", v.reqCC))
+		if fresh := e.fresh(testNow.Add(v.after), reqCC); fresh != v.fresh {
+			t.Errorf("%s expect: %v, got: %v", v.name, v.fresh, fresh)
+		}
+	}
+}
+
+// go test -run ^TestCacheStorable$ .
+func TestCacheStorable(t *testing.T) {
+	lm := testNow.Format(http.TimeFormat)
+	cases := []struct {
+		name     string
+		method   string
+		status   int
+		header   http.Header
+		storable bool
+	}{
+		{"max-age", "GET", 200, testHeader("Cache-Control", "max-age=60"), true},
+		{"head", "HEAD", 200, testHeader("Cache-Control", "max-age=60"), false},
+		{"no-store", "GET", 200, testHeader("Cache-Control", "no-store, max-age=60"), false},
+		{"private", "GET", 200, testHeader("Cache-Control", "private, max-age=60"), false},
+		{"vary star", "GET", 200, testHeader("Cache-Control", "max-age=60", "Vary", "*"), false},
+		{"set-cookie", "GET", 200, testHeader("Cache-Control", "max-age=60", "Set-Cookie", "a=b"), false},
+		{"event stream", "GET", 200, testHeader("Cache-Control", "max-age=60", "Content-Type", "text/event-stream"), false},
+		{"explicit 302", "GET", 302, testHeader("Cache-Control", "max-age=60"), true},
+		{"explicit 206", "GET", 206, testHeader("Cache-Control", "max-age=60"), false},
+		{"explicit 500", "GET", 500, testHeader("Cache-Control", "max-age=60"), false},
+		{"last-modified", "GET", 200, testHeader("Last-Modified", lm), true},
+		{"etag", "GET", 404, testHeader("ETag", `"x"`), true},
+		{"no validator", "GET", 200, testHeader(), false},
+		{"heuristic 302", "GET", 302, testHeader("Last-Modified", lm), false},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, "/", nil)
+		if storable := storable(r, v.status, v.header); storable != v.storable {
+			t.Errorf("%s expect: %v, got: %v", v.name, v.storable, storable)
+		}
+	}
+}
+
+// go test -run ^TestNotModified$ .
+func TestNotModified(t *testing.T) {
+	lm := testNow.Format(http.TimeFormat)
+	cases := []struct {
+		name        string
+		request     http.Header
+		response    http.Header
+		notModified bool
+	}{
+		{"etag", testHeader("If-None-Match", `"a"`), testHeader("ETag", `"a"`), true},
+		{"weak etag", testHeader("If-None-Match", `W/"a"`), testHeader("ETag", `"a"`), true},
+		{"etag list", testHeader("If-None-Match", `"b", "a"`), testHeader("ETag", `W/"a"`), true},
+		{"star", testHeader("If-None-Match", "*"), testHeader("ETag", `"a"`), true},
+		{"etag changed", testHeader("If-None-Match", `"b"`), testHeader("ETag", `"a"`), false},
+		{"no etag", testHeader("If-None-Match", `"a"`), testHeader("Last-Modified", lm), false},
+		{"if-none-match wins", testHeader("If-None-Match", `"b"`, "If-Modified-Since", lm), testHeader("ETag", `"a"`, "Last-Modified", lm), false},
+		{"not modified since", testHeader("If-Modified-Since", lm), testHeader("Last-Modified", testNow.Add(-time.Hour).Format(http.TimeFormat)), true},
+		{"modified since", testHeader("If-Modified-Since", lm), testHeader("Last-Modified", testNow.Add(time.Hour).Format(http.TimeFormat)), false},
+		{"invalid date", testHeader("If-Modified-Since", "yesterday"), testHeader("Last-Modified", lm), false},
+		{"no validators", testHeader(), testHeader("ETag", `"a"`, "Last-Modified", lm), false},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = v.request
+		if notModified := notModified(r, v.response); notModified != v.notModified {
+			t.Errorf("%s expect: %v, got: %v", v.name, v.notModified, notModified)
+		}
+	}
+}
+
+func testEntry(key string, size int) *cacheEntry {
+	return &cacheEntry{Key: key, Status: 200, Header: http.Header{}, Body: make([]byte, size), ResponseTime: testNow}
+}
+
+// go test -run ^TestCacheStoreDisk$ .
+func TestCacheStoreDisk(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newCacheStore(2000, disk)
+	for i := 0; i < 5; i++ {
+		s.put(testEntry(fmt.Sprintf("k%d", i), 900))
+	}
+	st := s.stats()
+	if st.Entries != 2 || st.DiskEntries != 3 {
+		t.Fatalf("expect: 2 in memory and 3 on disk, got: %+v", st)
+	}
+	if e := s.get("k0"); e == nil || len(e.Body) != 900 {
+		t.Fatalf("k0 expect: read back from disk, got: %v", e)
+	}
+	if st := s.stats(); st.Entries != 2 || st.DiskEntries != 3 {
+		t.Errorf("expect: k0 swapped with k3, got: %+v", st)
+	}
+
+	// a new run indexes what is on disk, one file per entry
+	s.purge("k4")
+	disk, err = newDiskStore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk.lru.Len() != 3 {
+		t.Errorf("restart expect: 3 disk entries, got: %d", disk.lru.Len())
+	}
+	if n := s.purge(""); n != 4 {
+		t.Errorf("purge expect: 4, got: %d", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("purge expect: no files, got: %v", files)
+	}
+}
+
+// go test -race -run ^TestCacheStoreConcurrent$ .
+func TestCacheStoreConcurrent(t *testing.T) {
+	disk, err := newDiskStore(t.TempDir(), 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newCacheStore(5000, disk)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("k%d", (g+i)%20)
+				if i%3 == 0 {
+					s.put(testEntry(key, 1000))
+				} else if e := s.get(key); e != nil && e.Key != key {
+					t.Errorf("%s expect: its entry, got: %s", key, e.Key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	st := s.stats()
+	if st.Bytes > 5000 || st.DiskBytes > 20000 {
+		t.Errorf("expect: within limits, got: %+v", st)
+	}
+}
+
+// go test -run ^TestCacheVary$ .
+func TestCacheVary(t *testing.T) {
+	c, err := newHTTPCache(cacheOption{MemSize: 4000, MaxObject: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://example.com/a", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	primary := primaryKey("default", r)
+	if key := c.key("default", r); key != primary {
+		t.Fatalf("expect: %q, got: %q", primary, key)
+	}
+	c.store.put(&cacheEntry{Key: primary, Vary: parseVary(testHeader("Vary", "accept-encoding")), ResponseTime: testNow})
+	if key := c.key("default", r); key != primary+"Accept-Encoding=gzip\x00" {
+		t.Errorf("expect: variant key, got: %q", key)
+	}
+
+	// the Vary goes with the lru like any entry
+	for i := 0; i < 10; i++ {
+		c.store.put(testEntry(fmt.Sprintf("other%d", i), 1000))
+	}
+	if key := c.key("default", r); key != primary {
+		t.Errorf("evicted expect: %q, got: %q", primary, key)
+	}
+}
+
+// go test -run ^TestCacheRoutes$ .
+func TestCacheRoutes(t *testing.T) {
+	pools := ""
+	for _, name := range []string{"canary", "stable"} {
+		body := name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(body))
+		}))
+		defer upstream.Close()
+		pools += fmt.Sprintf("  %s:\n    backends:\n      - url: %s\n", name, upstream.URL)
+	}
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	routes := "pools:\n" + pools + `routes:
+  - name: canary
+    headers: {X-Canary: "1"}
+    pool: canary
+  - name: stable
+    pool: stable
+`
+	if err := os.WriteFile(file, []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rr, err := loadRouter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentRouter.Store(rr)
+	if responseCache, err = newHTTPCache(cacheOption{MemSize: 1 << 20, MaxObject: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { responseCache = nil }()
+	srv := httptest.NewServer(http.HandlerFunc(proxy))
+	defer srv.Close()
+
+	cases := []struct {
+		canary bool
+		body   string
+		cache  string
+	}{
+		{false, "stable", cacheMiss},
+		{true, "canary", cacheMiss},
+		{false, "stable", cacheHit},
+		{true, "canary", cacheHit},
+	}
+	for i, v := range cases {
+		r, _ := http.NewRequest("GET", srv.URL+"/a", nil)
+		if v.canary {
+			r.Header.Set("X-Canary", "1")
+		}
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != v.body || rsp.Header.Get("X-Cache") != v.cache {
+			t.Errorf("%d expect: %s %s, got: %s %s", i, v.body, v.cache, body, rsp.Header.Get("X-Cache"))
+		}
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if n := responseCache.purge("canary", host+"/a"); n != 1 {
+		t.Errorf("route purge expect: 1, got: %d", n)
+	}
+	responseCache.store.put(&cacheEntry{Key: primaryKey("canary", httptest.NewRequest("GET", srv.URL+"/a", nil)), ResponseTime: testNow})
+	if n := responseCache.purge("", host+"/a"); n != 2 {
+		t.Errorf("purge expect: 2, got: %d", n)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// cacheEntry is a stored response, the exported fields are written to the disk tier
+type cacheEntry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time // when the request was sent upstream
+	ResponseTime time.Time // when the response was received
+	Vary         []string  // only set at the primary key of responses with Vary, which are stored by variant key
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for _, v := range e.Vary {
+		n += int64(len(v))
+	}
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// cacheStore is a memory lru, entries evicted from memory move to the disk tier if there is one.
+// The indexes of both tiers are guarded by mu, the disk files are read and written without it
+type cacheStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // of *cacheEntry, most recently used first
+	items    map[string]*list.Element
+	disk     *diskStore
+}
+
+func newCacheStore(maxBytes int64, disk *diskStore) *cacheStore {
+	return &cacheStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+		disk:     disk,
+	}
+}
+
+// spill is an entry evicted from memory and the disk slot reserved for it
+type spill struct {
+	entry *cacheEntry
+	item  *diskItem
+}
+
+func (s *cacheStore) get(key string) *cacheEntry {
+	s.mu.Lock()
+	if el := s.items[key]; el != nil {
+		s.lru.MoveToFront(el)
+		s.mu.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	var item *diskItem
+	if s.disk != nil {
+		item = s.disk.take(key)
+	}
+	s.mu.Unlock()
+	if item == nil {
+		return nil
+	}
+
+	e, err := s.disk.read(item.file)
+	os.Remove(item.file)
+	if err != nil {
+		slog.Warn("cache read error",
+			slog.String("error", err.Error()),
+		)
+		return nil
+	}
+	s.mu.Lock()
+	if el := s.items[key]; el != nil {
+		// put while reading, the new entry wins
+		s.lru.MoveToFront(el)
+		s.mu.Unlock()
+		return el.Value.(*cacheEntry)
+	}
+	spills := s.add(e)
+	s.mu.Unlock()
+	s.spill(spills)
+	return e
+}
+
+func (s *cacheStore) put(e *cacheEntry) {
+	s.mu.Lock()
+	s.remove(e.Key)
+	var garbage []string
+	if s.disk != nil {
+		s.disk.remove(e.Key)
+		garbage = s.disk.drain()
+	}
+	spills := s.add(e)
+	s.mu.Unlock()
+	removeFiles(garbage)
+	s.spill(spills)
+}
+
+// add inserts e and evicts down to max bytes, reserving disk slots for the evicted entries.
+// The caller holds mu and spills them after unlocking
+func (s *cacheStore) add(e *cacheEntry) []spill {
+	s.items[e.Key] = s.lru.PushFront(e)
+	s.bytes += e.size()
+	var spills []spill
+	for s.bytes > s.maxBytes && s.lru.Len() > 0 {
+		old := s.lru.Back().Value.(*cacheEntry)
+		s.remove(old.Key)
+		if s.disk != nil {
+			spills = append(spills, spill{entry: old, item: s.disk.reserve(old.Key, old.size())})
+		}
+	}
+	return spills
+}
+
+// spill writes evicted entries to their disk slots, the caller doesn't hold mu
+func (s *cacheStore) spill(spills []spill) {
+	for _, v := range spills {
+		file, size, err := s.disk.write(v.entry)
+		if err != nil {
+			slog.Warn("cache write error",
+				slog.String("error", err.Error()),
+			)
+		}
+		s.mu.Lock()
+		s.disk.commit(v.item, file, size)
+		garbage := s.disk.drain()
+		s.mu.Unlock()
+		removeFiles(garbage)
+	}
+}
+
+func (s *cacheStore) remove(key string) bool {
+	el := s.items[key]
+	if el == nil {
+		return false
+	}
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.bytes -= el.Value.(*cacheEntry).size()
+	return true
+}
+
+// purge removes the entries whose key has prefix, all of them for an empty prefix
+func (s *cacheStore) purge(prefix string) int {
+	s.mu.Lock()
+	n := 0
+	for key := range s.items {
+		if strings.HasPrefix(key, prefix) && s.remove(key) {
+			n++
+		}
+	}
+	var garbage []string
+	if s.disk != nil {
+		n += s.disk.purge(prefix)
+		garbage = s.disk.drain()
+	}
+	s.mu.Unlock()
+	removeFiles(garbage)
+	return n
+}
+
+func removeFiles(files []string) {
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+type cacheStats struct {
+	Entries     int   `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+	DiskEntries int   `json:"disk_entries"`
+	DiskBytes   int64 `json:"disk_bytes"`
+}
+
+func (s *cacheStore) stats() cacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := cacheStats{Entries: s.lru.Len(), Bytes: s.bytes}
+	if s.disk != nil {
+		st.DiskEntries, st.DiskBytes = s.disk.lru.Len(), s.disk.bytes
+	}
+	return st
+}
+
+type diskItem struct {
+	key  string
+	file string // empty while the entry is being written
+	size int64
+}
+
+// diskStore keeps every entry in its own file named by the sha256 of its key and a random suffix,
+// so writes of the same key don't clash. The index is guarded by cacheStore.mu,
+// files dropped from it are collected for the caller to remove after unlocking
+type diskStore struct {
+	dir      string
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // of *diskItem, most recently used first
+	items    map[string]*list.Element
+	garbage  []string
+}
+
+// newDiskStore indexes the entries left in dir by a previous run
+func newDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir err: %w", err)
+	}
+	d := &diskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read cache dir err: %w", err)
+	}
+	type stored struct {
+		key   string
+		file  string
+		size  int64
+		mtime time.Time
+	}
+	found := []stored{}
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		file := filepath.Join(dir, f.Name())
+		e, err := d.read(file)
+		if err != nil || !strings.HasPrefix(f.Name(), d.name(e.Key)+"-") {
+			slog.Warn("remove invalid cache file",
+				slog.String("file", f.Name()),
+			)
+			os.Remove(file)
+			continue
+		}
+		found = append(found, stored{key: e.Key, file: file, size: info.Size(), mtime: info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].mtime.Before(found[j].mtime) })
+	for _, v := range found {
+		d.remove(v.key) // an older copy
+		d.items[v.key] = d.lru.PushFront(&diskItem{key: v.key, file: v.file, size: v.size})
+		d.bytes += v.size
+	}
+	d.evict()
+	removeFiles(d.drain())
+	return d, nil
+}
+
+func (d *diskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskStore) read(file string) (*cacheEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &cacheEntry{}
+	if err := gob.NewDecoder(f).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// write stores e in a new file, without touching the index
+func (d *diskStore) write(e *cacheEntry) (string, int64, error) {
+	f, err := os.CreateTemp(d.dir, d.name(e.Key)+"-*")
+	if err != nil {
+		return "", 0, err
+	}
+	err = gob.NewEncoder(f).Encode(e)
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), size, nil
+}
+
+// reserve indexes a slot for key, which counts size until the write is committed
+func (d *diskStore) reserve(key string, size int64) *diskItem {
+	d.remove(key)
+	item := &diskItem{key: key, size: size}
+	d.items[key] = d.lru.PushFront(item)
+	d.bytes += size
+	d.evict()
+	return item
+}
+
+// commit fills the reserved item with the written file, the file is garbage
+// if the slot was taken, removed or evicted meanwhile or the write failed
+func (d *diskStore) commit(item *diskItem, file string, size int64) {
+	el := d.items[item.key]
+	reserved := el != nil && el.Value.(*diskItem) == item
+	if !reserved || file == "" {
+		if reserved {
+			d.remove(item.key)
+		}
+		if file != "" {
+			d.garbage = append(d.garbage, file)
+		}
+		return
+	}
+	item.file = file
+	d.bytes += size - item.size
+	item.size = size
+	d.evict()
+}
+
+// take drops the written entry of key from the index and returns it, the caller reads and removes the file
+func (d *diskStore) take(key string) *diskItem {
+	el := d.items[key]
+	if el == nil || el.Value.(*diskItem).file == "" {
+		return nil
+	}
+	d.unlink(el)
+	return el.Value.(*diskItem)
+}
+
+func (d *diskStore) unlink(el *list.Element) {
+	item := el.Value.(*diskItem)
+	d.lru.Remove(el)
+	delete(d.items, item.key)
+	d.bytes -= item.size
+}
+
+func (d *diskStore) remove(key string) bool {
+	el := d.items[key]
+	if el == nil {
+		return false
+	}
+	d.unlink(el)
+	if file := el.Value.(*diskItem).file; file != "" {
+		d.garbage = append(d.garbage, file)
+	}
+	return true
+}
+
+// drain returns the files dropped from the index
+func (d *diskStore) drain() []string {
+	garbage := d.garbage
+	d.garbage = nil
+	return garbage
+}
+
+func (d *diskStore) evict() {
+	for d.bytes > d.maxBytes && d.lru.Len() > 0 {
+		d.remove(d.lru.Back().Value.(*diskItem).key)
+	}
+}
+
+func (d *diskStore) purge(prefix string) int {
+	n := 0
+	for key := range d.items {
+		if strings.HasPrefix(key, prefix) && d.remove(key) {
+			n++
+		}
+	}
+	return n
+}
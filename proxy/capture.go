@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slog"
+)
+
+type captureOption struct {
+	File    string  // capture file, empty disables capture
+	Format  string  // har or ndjson, by the extension of File if empty
+	Sample  float64 // fraction of the matching requests captured, 0 to 1
+	Filter  string  // comma separated route=, method=, path= (prefix) and status= (404 or 5xx), all keys must match
+	MaxBody int64   // bytes of each body kept
+	Redact  string  // comma separated headers and query:<name> parameters whose values are not written
+}
+
+var captureOpt = captureOption{
+	Sample:  1,
+	MaxBody: 64 << 10,
+	Redact:  "Authorization,Proxy-Authorization,Cookie,Set-Cookie,X-Api-Key,Api-Key,X-Auth-Token,query:access_token,query:api_key,query:token",
+}
+
+const redacted = "[REDACTED]"
+
+// trafficCapture is the running capture, nil if capture is off
+var trafficCapture *capturer
+
+// exchange is a captured request and response pair, one line of an ndjson capture
+type exchange struct {
+	Time     time.Time        `json:"time"`
+	Duration float64          `json:"duration_ms"`
+	Route    string           `json:"route,omitempty"`
+	Backend  string           `json:"backend,omitempty"`
+	Cache    string           `json:"cache,omitempty"`
+	TraceID  string           `json:"trace_id,omitempty"`
+	Request  capturedRequest  `json:"request"`
+	Response capturedResponse `json:"response"`
+}
+
+type capturedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"` // absolute, with the host the client asked for
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	capturedBody
+}
+
+type capturedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	capturedBody
+}
+
+// capturedBody is the start of a body, base64 encoded if it is not utf-8
+type capturedBody struct {
+	Body      string `json:"body,omitempty"`
+	Encoding  string `json:"encoding,omitempty"` // base64 or empty
+	Size      int64  `json:"size"`               // of the whole body
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+func newCapturedBody(b *bodyBuffer) capturedBody {
+	if b == nil {
+		return capturedBody{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	body := capturedBody{Size: b.size, Truncated: b.truncated}
+	if data := b.buf.Bytes(); utf8.Valid(data) {
+		body.Body = string(data)
+	} else {
+		body.Body = base64.StdEncoding.EncodeToString(data)
+		body.Encoding = "base64"
+	}
+	return body
+}
+
+// bytes returns the body as sent
+func (b *capturedBody) bytes() ([]byte, error) {
+	if b.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(b.Body)
+	}
+	return []byte(b.Body), nil
+}
+
+// bodyBuffer keeps the first max bytes of a body, it is written by the transport
+// while the handler may already be recording
+type bodyBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int64
+	size      int64
+	truncated bool
+}
+
+func (b *bodyBuffer) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if room := b.max - int64(b.buf.Len()); int64(len(p)) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+}
+
+// teeBody copies what the proxy reads of a request body to buf
+type teeBody struct {
+	io.ReadCloser
+	buf *bodyBuffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.buf.write(p[:n])
+	return n, err
+}
+
+type captureFilter struct {
+	routes, methods, paths, statuses []string
+}
+
+func parseCaptureFilter(s string) (*captureFilter, error) {
+	f := &captureFilter{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid capture filter %q, want key=value", item)
+		}
+		switch k {
+		case "route":
+			f.routes = append(f.routes, v)
+		case "method":
+			f.methods = append(f.methods, strings.ToUpper(v))
+		case "path":
+			f.paths = append(f.paths, v)
+		case "status":
+			if _, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(v), "xx")); err != nil {
+				return nil, fmt.Errorf("invalid capture status %q, want e.g. 404 or 5xx", v)
+			}
+			f.statuses = append(f.statuses, strings.ToLower(v))
+		default:
+			return nil, fmt.Errorf("invalid capture filter key %q, want route, method, path or status", k)
+		}
+	}
+	return f, nil
+}
+
+func anyOf(values []string, match func(string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// request reports whether the request side of the filter matches
+func (f *captureFilter) request(r *http.Request, routeName string) bool {
+	return anyOf(f.routes, func(v string) bool { return v == routeName }) &&
+		anyOf(f.methods, func(v string) bool { return v == r.Method }) &&
+		anyOf(f.paths, func(v string) bool { return strings.HasPrefix(r.URL.Path, v) })
+}
+
+func (f *captureFilter) status(code int) bool {
+	s := strconv.Itoa(code)
+	return anyOf(f.statuses, func(v string) bool {
+		if class, ok := strings.CutSuffix(v, "xx"); ok {
+			return strings.HasPrefix(s, class)
+		}
+		return v == s
+	})
+}
+
+// capturer writes the exchanges to the capture file from a queue,
+// exchanges are dropped rather than slowing the requests down when the queue is full
+type capturer struct {
+	captureOption
+	filter *captureFilter
+	redact map[string]bool // canonical header keys
+	params map[string]bool // lowercase query parameter names
+	queue  chan *exchange
+	done   chan struct{}
+
+	mu     sync.RWMutex // Close waits for the records in progress
+	closed bool
+}
+
+func newCapturer(opt captureOption) (*capturer, error) {
+	if opt.Format == "" {
+		opt.Format = "ndjson"
+		if strings.EqualFold(filepath.Ext(opt.File), ".har") {
+			opt.Format = "har"
+		}
+	}
+	if opt.Format != "har" && opt.Format != "ndjson" {
+		return nil, fmt.Errorf("invalid capture format %q, want har or ndjson", opt.Format)
+	}
+	if opt.Sample < 0 || opt.Sample > 1 {
+		return nil, fmt.Errorf("invalid capture sample %v, want 0 to 1", opt.Sample)
+	}
+	if opt.MaxBody < 0 {
+		return nil, fmt.Errorf("invalid capture max body %d", opt.MaxBody)
+	}
+	filter, err := parseCaptureFilter(opt.Filter)
+	if err != nil {
+		return nil, err
+	}
+	c := &capturer{
+		captureOption: opt,
+		filter:        filter,
+		redact:        map[string]bool{},
+		params:        map[string]bool{},
+		queue:         make(chan *exchange, 1024),
+		done:          make(chan struct{}),
+	}
+	for _, h := range strings.Split(opt.Redact, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(h, "query:"); ok {
+			c.params[strings.ToLower(name)] = true
+		} else {
+			c.redact[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	// a har file is one json document, so it starts over, ndjson appends
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if opt.Format == "har" {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	f, err := os.OpenFile(opt.File, flags, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open capture file err: %w", err)
+	}
+	go c.run(f)
+	return c, nil
+}
+
+// want reports whether r is sampled and passes the request side of the filter
+func (c *capturer) want(r *http.Request, routeName string) bool {
+	return c.filter.request(r, routeName) && (c.Sample >= 1 || rand.Float64() < c.Sample)
+}
+
+// start captures the request body of r as the proxy reads it
+func (c *capturer) start(r *http.Request) *bodyBuffer {
+	buf := &bodyBuffer{max: c.MaxBody}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &teeBody{ReadCloser: r.Body, buf: buf}
+	}
+	return buf
+}
+
+func (c *capturer) header(h http.Header) http.Header {
+	h = h.Clone()
+	for k := range h {
+		if c.redact[k] {
+			h[k] = []string{redacted}
+		}
+	}
+	return h
+}
+
+// requestURI is uri with the values of the redacted query parameters replaced
+func (c *capturer) requestURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok || len(c.params) == 0 {
+		return uri
+	}
+	pairs := strings.Split(query, "&")
+	for i, kv := range pairs {
+		k, _, _ := strings.Cut(kv, "=")
+		if name, err := url.QueryUnescape(k); err == nil && c.params[strings.ToLower(name)] {
+			pairs[i] = k + "=" + url.QueryEscape(redacted)
+		}
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
+
+// record queues the exchange of r if its status passes the filter
+func (c *capturer) record(e *exchange, r *http.Request, reqBody *bodyBuffer, status int, header http.Header, respBody *bodyBuffer) {
+	if !c.filter.status(status) {
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	e.Request = capturedRequest{
+		Method:       r.Method,
+		URL:          scheme + "://" + r.Host + c.requestURI(r.RequestURI),
+		Proto:        r.Proto,
+		Header:       c.header(r.Header),
+		capturedBody: newCapturedBody(reqBody),
+	}
+	e.Response = capturedResponse{
+		Status:       status,
+		Header:       c.header(header),
+		capturedBody: newCapturedBody(respBody),
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- e:
+		captured.WithLabelValues("queued").Inc()
+	default:
+		captured.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (c *capturer) run(f *os.File) {
+	defer close(c.done)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if c.Format == "har" {
+		w.WriteString(`{"log":{"version":"1.2","creator":{"name":"proxy","version":"` + version + `"},"entries":[`)
+	}
+	first := true
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case e, ok := <-c.queue:
+			if !ok {
+				if c.Format == "har" {
+					w.WriteString("\n]}}\n")
+				}
+				if err := w.Flush(); err != nil {
+					slog.Error("capture write error", err)
+				}
+				f.Close()
+				return
+			}
+			var err error
+			if c.Format == "har" {
+				if !first {
+					w.WriteByte(',')
+				}
+				w.WriteByte('\n')
+				err = enc.Encode(toHAREntry(e))
+			} else {
+				err = enc.Encode(e)
+			}
+			first = false
+			if err != nil {
+				slog.Error("capture write error", err)
+			}
+		case <-flush.C:
+			w.Flush()
+		}
+	}
+}
+
+// Close writes the queued exchanges and closes the capture file
+func (c *capturer) Close() {
+	c.mu.Lock()
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+	<-c.done
+}
+
+// har 1.2, http://www.softwareishard.com/blog/har-12-spec/
+type harLog struct {
+	Log struct {
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+	Route       string `json:"_route,omitempty"`
+	Backend     string `json:"_backend,omitempty"`
+	CacheStatus string `json:"_cache,omitempty"`
+	TraceID     string `json:"_traceId,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *struct {
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text"`
+		Encoding  string `json:"_encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	} `json:"postData,omitempty"`
+	HeadersSize int   `json:"headersSize"`
+	BodySize    int64 `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     struct {
+		Size      int64  `json:"size"`
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text,omitempty"`
+		Encoding  string `json:"encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	} `json:"content"`
+	RedirectURL string `json:"redirectURL"`
+	HeadersSize int    `json:"headersSize"`
+	BodySize    int64  `json:"bodySize"`
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			nvs = append(nvs, harNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+func toHAREntry(e *exchange) *harEntry {
+	h := &harEntry{
+		StartedDateTime: e.Time,
+		Time:            e.Duration,
+		Route:           e.Route,
+		Backend:         e.Backend,
+		CacheStatus:     e.Cache,
+		TraceID:         e.TraceID,
+	}
+	h.Timings.Wait = e.Duration
+	h.Request = harRequest{
+		Method:      e.Request.Method,
+		URL:         e.Request.URL,
+		HTTPVersion: e.Request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(e.Request.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    e.Request.Size,
+	}
+	if i := strings.IndexByte(e.Request.URL, '?'); i >= 0 {
+		for _, kv := range strings.Split(e.Request.URL[i+1:], "&") {
+			k, v, _ := strings.Cut(kv, "=")
+			h.Request.QueryString = append(h.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	if e.Request.Size > 0 {
+		h.Request.PostData = &struct {
+			MimeType  string `json:"mimeType"`
+			Text      string `json:"text"`
+			Encoding  string `json:"_encoding,omitempty"`
+			Truncated bool   `json:"_truncated,omitempty"`
+		}{
+			MimeType:  e.Request.Header.Get("Content-Type"),
+			Text:      e.Request.Body,
+			Encoding:  e.Request.Encoding,
+			Truncated: e.Request.Truncated,
+		}
+	}
+	h.Response = harResponse{
+		Status:      e.Response.Status,
+		StatusText:  http.StatusText(e.Response.Status),
+		HTTPVersion: e.Request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(e.Response.Header),
+		RedirectURL: e.Response.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    e.Response.Size,
+	}
+	h.Response.Content.Size = e.Response.Size
+	h.Response.Content.MimeType = e.Response.Header.Get("Content-Type")
+	h.Response.Content.Text = e.Response.Body
+	h.Response.Content.Encoding = e.Response.Encoding
+	h.Response.Content.Truncated = e.Response.Truncated
+	return h
+}
+
+func fromHAREntry(h *harEntry) *exchange {
+	header := func(nvs []harNameValue) http.Header {
+		hh := http.Header{}
+		for _, nv := range nvs {
+			hh.Add(nv.Name, nv.Value)
+		}
+		return hh
+	}
+	e := &exchange{
+		Time:     h.StartedDateTime,
+		Duration: h.Time,
+		Route:    h.Route,
+		Backend:  h.Backend,
+		Cache:    h.CacheStatus,
+		TraceID:  h.TraceID,
+	}
+	e.Request = capturedRequest{
+		Method: h.Request.Method,
+		URL:    h.Request.URL,
+		Proto:  h.Request.HTTPVersion,
+		Header: header(h.Request.Headers),
+	}
+	e.Request.Size = h.Request.BodySize
+	if p := h.Request.PostData; p != nil {
+		e.Request.Body, e.Request.Encoding, e.Request.Truncated = p.Text, p.Encoding, p.Truncated
+	}
+	e.Response = capturedResponse{
+		Status: h.Response.Status,
+		Header: header(h.Response.Headers),
+		capturedBody: capturedBody{
+			Body:      h.Response.Content.Text,
+			Encoding:  h.Response.Content.Encoding,
+			Size:      h.Response.Content.Size,
+			Truncated: h.Response.Content.Truncated,
+		},
+	}
+	return e
+}
+
+// readCapture reads the exchanges of a har or ndjson capture file
+func readCapture(file string) ([]*exchange, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read capture err: %w", err)
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte(`{"log"`)) {
+		var har harLog
+		if err := json.Unmarshal(trimmed, &har); err != nil {
+			// the proxy was killed before closing the entries
+			if err2 := json.Unmarshal(append(bytes.TrimSuffix(trimmed, []byte(",")), "]}}"...), &har); err2 != nil {
+				return nil, fmt.Errorf("parse har err: %w", err)
+			}
+		}
+		exchanges := make([]*exchange, 0, len(har.Log.Entries))
+		for _, h := range har.Log.Entries {
+			exchanges = append(exchanges, fromHAREntry(h))
+		}
+		return exchanges, nil
+	}
+
+	exchanges := []*exchange{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := &exchange{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("parse capture line %d err: %w", line, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges, scanner.Err()
+}
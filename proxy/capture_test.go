@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// go test -run ^TestCaptureRedactQuery$ .
+func TestCaptureRedactQuery(t *testing.T) {
+	opt := captureOpt
+	opt.File = filepath.Join(t.TempDir(), "capture.ndjson")
+	if _, err := newCapturer(captureOption{File: opt.File, Sample: 1, MaxBody: -1}); err == nil {
+		t.Errorf("negative max body expect: error, got: nil")
+	}
+	c, err := newCapturer(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cases := []struct {
+		uri, expected string
+	}{
+		{"/a", "/a"},
+		{"/a?q=1", "/a?q=1"},
+		{"/a?token=s3cret", "/a?token=%5BREDACTED%5D"},
+		{"/a?q=1&Access_Token=s3cret&api%5Fkey=k&q=2", "/a?q=1&Access_Token=%5BREDACTED%5D&api%5Fkey=%5BREDACTED%5D&q=2"},
+		{"/a?token", "/a?token=%5BREDACTED%5D"},
+		{"/a?tokens=1", "/a?tokens=1"},
+	}
+	for _, v := range cases {
+		if uri := c.requestURI(v.uri); uri != v.expected {
+			t.Errorf("%s expect: %s, got: %s", v.uri, v.expected, uri)
+		}
+	}
+}
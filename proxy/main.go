@@ -4,48 +4,57 @@ import (
 	"context"
 	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/gobike/envflag"
+	"github.com/quic-go/quic-go/http3"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/jaeger"
-	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
 var (
+	version      string = "dev" // set by the Makefile
 	addr         string = ":80"
+	adminAddr    string = "127.0.0.1:9090" // unauthenticated, never expose it publicly
 	backend      string = "http://192.168.56.2:9000"
 	provider     string = "http://192.168.56.2:14268"
-	serviceName  string = "svc-xxx"
+	serviceName  string = "proxy"
 	readTimeout  uint   = 30
 	writeTimeout uint   = 30
 	debug        bool
+	routesFile   string
 )
 
 var (
-	providerURL *url.URL
+	poolOpt = poolOption{
+		Strategy:       "round-robin",
+		HashKey:        "ip",
+		HealthInterval: 10 * time.Second,
+		HealthTimeout:  2 * time.Second,
+		MaxFails:       3,
+		FailTimeout:    30 * time.Second,
+		CircuitFails:   5,
+		CircuitCool:    10 * time.Second,
+	}
 )
 var defaultTransport = &http.Transport{
-	DialContext: (&net.Dialer{
+	DialContext: countDial(connectTimeout((&net.Dialer{
 		Timeout:   20 * time.Second,
 		KeepAlive: 30 * time.Second,
 		DualStack: true,
-	}).DialContext,
+	}).DialContext)),
 	MaxConnsPerHost:       4096,
 	ForceAttemptHTTP2:     true,
 	MaxIdleConns:          2048,
@@ -55,54 +64,240 @@ var defaultTransport = &http.Transport{
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
+// proxyState is the per-request state shared by the handler and the ReverseProxy callbacks
+type proxyState struct {
+	route    *route
+	backend  *upstream
+	failed   bool   // transport error of the backend
+	canceled bool   // the client went away
+	status   int    // status of the backend response, 0 if there was none
+	cache    string // X-Cache of the response, empty if the cache is off
+}
+
+type proxyStateKey struct{}
+
+func stateOf(ctx context.Context) *proxyState {
+	return ctx.Value(proxyStateKey{}).(*proxyState)
+}
+
+// setBackend makes b the backend of the request
+func (st *proxyState) setBackend(ctx context.Context, b *upstream) {
+	st.backend = b
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("proxy.upstream", b.url.Host),
+		semconv.NetPeerNameKey.String(b.url.Hostname()),
+	)
+}
+
+// responseWriter records the status and body bytes written to the client
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	body   *bodyBuffer // start of the body for the capture, nil if not captured
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	if w.body != nil {
+		w.body.write(b[:n])
+	}
+	return n, err
+}
+
+// Flush sends what was written so far to the client, httputil.ReverseProxy only streams
+// responses like text/event-stream to writers implementing http.Flusher
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the other methods of the underlying writer, e.g. SetWriteDeadline
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// reverseProxy is shared by all requests, the route and backend of a request travel in its context
+var reverseProxy = &httputil.ReverseProxy{
+	Transport: &retryTransport{RoundTripper: defaultTransport},
+	Director: func(req *http.Request) {
+		// req is a clone of the inbound request, the inbound one is left intact for logging
+		st := stateOf(req.Context())
+		req.URL.Scheme = st.backend.url.Scheme
+		req.URL.Host = st.backend.url.Host
+		if path := st.route.rewritePath(req.URL.Path); path != req.URL.Path {
+			req.URL.Path = path
+			req.URL.RawPath = ""
+		}
+		req.Header.Set("User-Agent", req.UserAgent())
+		if req.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			req.Header.Set("X-Forwarded-Proto", "http")
+		}
+		st.route.RequestHeaders.apply(req.Header)
+
+		otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	},
+	ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+		st := stateOf(req.Context())
+		if errors.Is(err, context.Canceled) || (req.Method == http.MethodPut && errors.Is(err, io.ErrUnexpectedEOF)) {
+			st.canceled = true
+			upstreamErrors.WithLabelValues(st.route.Name, st.backend.url.String(), "client").Inc()
+			slog.Warn("proxy client error",
+				slog.String("error", err.Error()),
+			)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		st.failed = true
+		upstreamErrors.WithLabelValues(st.route.Name, st.backend.url.String(), "server").Inc()
+		slog.Warn("proxy server error",
+			slog.String("route", st.route.Name),
+			slog.String("backend", st.backend.url.String()),
+			slog.String("error", err.Error()),
+		)
+		trace.SpanFromContext(req.Context()).RecordError(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		rw.WriteHeader(http.StatusBadGateway)
+	},
+	ModifyResponse: func(resp *http.Response) error {
+		st := stateOf(resp.Request.Context())
+		st.status = resp.StatusCode
+		st.route.ResponseHeaders.apply(resp.Header)
+		return nil
+	},
+}
+
 func proxy(rw http.ResponseWriter, r *http.Request) {
-	tr := otel.Tracer("component-main")
-	spanCtx, span := tr.Start(r.Context(), "proxy-handler")
+	start := time.Now()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	// continue the trace of the caller if it sent one
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer("component-main").Start(ctx, "proxy-handler",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(serviceName, "", r)...),
+	)
 	defer span.End()
 
-	proxy := httputil.ReverseProxy{
-		Transport: defaultTransport,
-		Director: func(req *http.Request) {
-			req.Host = r.Host
-			req.URL = r.URL
-			req.URL.Scheme = providerURL.Scheme
-			req.URL.Host = providerURL.Host
-			req.Header.Set("User-Agent", r.UserAgent())
-
-			p := otel.GetTextMapPropagator()
-			p.Inject(spanCtx, propagation.HeaderCarrier(req.Header))
-		},
-		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
-			if errors.Is(err, context.Canceled) || (r.Method == http.MethodPut && errors.Is(err, io.ErrUnexpectedEOF)) {
-				slog.Warn("proxy client error",
-					slog.String("error", err.Error()),
-				)
-			} else {
-				slog.Warn("proxy server error",
-					slog.String("error", err.Error()),
-				)
-			}
-			rw.WriteHeader(http.StatusBadGateway)
-		},
-		ModifyResponse: func(resp *http.Response) error {
-			// data, err := httputil.DumpResponse(resp, respBody)
-			// if err != nil {
-			// 	fmt.Printf("dump response %s error: %s", r.RemoteAddr, err)
-			// } else {
-			// 	os.Stdout.Write(data)
-			// }
-			slog.Info("request",
-				slog.String("remote", r.RemoteAddr),
-				slog.String("method", r.Method),
-				slog.String("host", r.Host),
-				slog.String("url", r.URL.String()),
-				slog.String("uri", r.RequestURI),
-				slog.Int("response", resp.StatusCode),
-			)
-			return nil
-		},
+	w := &responseWriter{ResponseWriter: rw}
+	st := &proxyState{}
+	var reqBody *bodyBuffer
+	defer func() {
+		status := w.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetAttributes(semconv.HTTPResponseContentLengthKey.Int64(w.bytes))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+
+		backend := ""
+		if st.backend != nil {
+			backend = st.backend.url.String()
+		}
+		routeName := "none"
+		if st.route != nil {
+			routeName = st.route.Name
+		}
+		observeRequest(span.SpanContext(), routeName, r.Method, status, time.Since(start))
+		if st.cache != "" {
+			cacheRequests.WithLabelValues(st.cache).Inc()
+		}
+		slog.Info("request",
+			slog.String("remote", r.RemoteAddr),
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("url", r.URL.String()),
+			slog.String("uri", r.RequestURI),
+			slog.String("route", routeName),
+			slog.String("backend", backend),
+			slog.Int("response", status),
+			slog.Int64("bytes", w.bytes),
+			slog.String("cache", st.cache),
+			slog.String("trace", span.SpanContext().TraceID().String()),
+		)
+		if w.body != nil {
+			trafficCapture.record(&exchange{
+				Time:     start,
+				Duration: float64(time.Since(start).Microseconds()) / 1000,
+				Route:    routeName,
+				Backend:  backend,
+				Cache:    st.cache,
+				TraceID:  span.SpanContext().TraceID().String(),
+			}, r, reqBody, status, w.Header(), w.body)
+		}
+	}()
+
+	if st.route = currentRouter.Load().match(r); st.route == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	span.SetAttributes(attribute.String("proxy.route", st.route.Name))
+	r = r.WithContext(ctx)
+	if trafficCapture != nil && trafficCapture.want(r, st.route.Name) {
+		reqBody = trafficCapture.start(r)
+		w.body = &bodyBuffer{max: trafficCapture.MaxBody}
 	}
-	proxy.ServeHTTP(rw, r)
+	if responseCache != nil && (st.route.Cache == nil || *st.route.Cache) {
+		responseCache.serve(w, r, st)
+		return
+	}
+	forward(w, r, st)
+}
+
+// forward sends r to a backend of the route of st and copies the response to rw
+func forward(rw http.ResponseWriter, r *http.Request, st *proxyState) {
+	b, err := st.route.pool.pick(r, nil)
+	if err != nil {
+		slog.Warn("proxy no backend",
+			slog.String("route", st.route.Name),
+			slog.String("url", r.URL.String()),
+		)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	st.setBackend(r.Context(), b)
+	defer func() {
+		// the backend of the last try, retries finish the others
+		o := outcomeOK
+		switch {
+		case st.failed:
+			o = outcomeFailed
+		case st.canceled:
+			o = outcomeCanceled
+		case st.status >= 500:
+			o = outcomeServerError
+		}
+		st.route.pool.done(st.backend, o)
+	}()
+
+	ctx := r.Context()
+	if st.route.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, st.route.Timeout)
+		defer cancel()
+	}
+	ctx = httptrace.WithClientTrace(ctx, connTrace)
+	reverseProxy.ServeHTTP(rw, r.WithContext(context.WithValue(ctx, proxyStateKey{}, st)))
 }
 
 func InitLog(debug bool) error {
@@ -119,55 +314,119 @@ func InitLog(debug bool) error {
 	return nil
 }
 
-func tracerProvider(url string) (tp *tracesdk.TracerProvider, err error) {
-	fmt.Println("init traceProvider")
-	var exporter tracesdk.SpanExporter
-	if url == "" {
-		exporter, err = stdouttrace.New()
-		if err != nil {
-			return
-		}
-	} else {
-		exporter, err = jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
-		if err != nil {
-			return
-		}
-	}
-	tp = tracesdk.NewTracerProvider(
-		tracesdk.WithBatcher(exporter),
-		tracesdk.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(serviceName),
-			attribute.String("environment", "environment"),
-			attribute.Int64("ID", 9999),
-		)),
-	)
-	return
-}
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
 	flag.BoolVar(&debug, "debug", debug, "debug log level")
 	flag.StringVar(&addr, "addr", addr, "server serve address")
-	flag.StringVar(&backend, "b", backend, "backend server address")
-	flag.StringVar(&provider, "tp", provider, "trace provider address")
+	flag.StringVar(&adminAddr, "admin-addr", adminAddr, "admin server address serving /metrics, /state and /cache, empty disables, unauthenticated so keep it on loopback or a private network")
+	flag.StringVar(&backend, "b", backend, "backend server addresses, comma separated url[;weight=n]")
+	flag.StringVar(&poolOpt.Strategy, "lb", poolOpt.Strategy, "load balancing strategy: round-robin, least-conn or hash")
+	flag.StringVar(&poolOpt.HashKey, "hash-key", poolOpt.HashKey, "hash strategy key: header:<name>, cookie:<name>, path or ip")
+	flag.StringVar(&poolOpt.HealthPath, "health-path", poolOpt.HealthPath, "active health check path, e.g. /healthz, empty disables")
+	flag.DurationVar(&poolOpt.HealthInterval, "health-interval", poolOpt.HealthInterval, "active health check interval")
+	flag.DurationVar(&poolOpt.HealthTimeout, "health-timeout", poolOpt.HealthTimeout, "active health check timeout")
+	flag.IntVar(&poolOpt.MaxFails, "max-fails", poolOpt.MaxFails, "eject a backend after this many failed requests in a row, 0 disables")
+	flag.DurationVar(&poolOpt.FailTimeout, "fail-timeout", poolOpt.FailTimeout, "how long an ejected backend is skipped")
+	flag.IntVar(&poolOpt.CircuitFails, "circuit-fails", poolOpt.CircuitFails, "open the circuit of a backend after this many 5xx or transport errors in a row, 0 disables")
+	flag.DurationVar(&poolOpt.CircuitCool, "circuit-cooldown", poolOpt.CircuitCool, "how long an open circuit rejects requests before letting a trial through")
+	flag.Int64Var(&poolOpt.MaxConns, "max-conns", poolOpt.MaxConns, "in-flight requests per backend, 0 is unlimited")
+	flag.Float64Var(&limitOpt.Rate, "rate-limit", limitOpt.Rate, "requests per second per rate limit key, 0 disables")
+	flag.IntVar(&limitOpt.Burst, "rate-burst", limitOpt.Burst, "requests a rate limit key may send at once, 0 is the rate rounded up")
+	flag.StringVar(&limitOpt.Key, "rate-key", limitOpt.Key, "rate limit key: ip, header:<name> or route")
+	flag.IntVar(&limitOpt.MaxKeys, "rate-max-keys", limitOpt.MaxKeys, "rate limit buckets kept at most, requests of new keys are limited while full")
+	flag.StringVar(&tlsOpt.Addr, "tls-addr", tlsOpt.Addr, "https serve address, e.g. :443, empty disables tls")
+	flag.StringVar(&tlsOpt.Cert, "tls-cert", tlsOpt.Cert, "default tls certificate file")
+	flag.StringVar(&tlsOpt.Key, "tls-key", tlsOpt.Key, "default tls key file")
+	flag.StringVar(&tlsOpt.SNICerts, "tls-sni-certs", tlsOpt.SNICerts, "certificates by sni, comma separated host=cert.pem:key.pem, host may be *.example.com")
+	flag.BoolVar(&tlsOpt.Redirect, "https-redirect", tlsOpt.Redirect, "redirect http requests to https")
+	flag.BoolVar(&tlsOpt.HTTP3, "http3", tlsOpt.HTTP3, "serve http/3 on the udp port of -tls-addr")
+	flag.StringVar(&tlsOpt.ACMEDomains, "acme-domains", tlsOpt.ACMEDomains, "comma separated domains to get acme certificates for, empty disables acme")
+	flag.StringVar(&tlsOpt.ACMEDir, "acme-dir", tlsOpt.ACMEDir, "acme directory url, empty for let's encrypt, e.g. https://localhost:14000/dir for pebble")
+	flag.StringVar(&tlsOpt.ACMECA, "acme-ca", tlsOpt.ACMECA, "ca file trusted for the acme directory, e.g. pebble's minica.pem")
+	flag.StringVar(&tlsOpt.ACMEEmail, "acme-email", tlsOpt.ACMEEmail, "acme account contact email")
+	flag.StringVar(&tlsOpt.ACMECache, "acme-cache", tlsOpt.ACMECache, "acme account and certificate cache directory")
+	flag.StringVar(&tlsOpt.UpstreamCert, "upstream-cert", tlsOpt.UpstreamCert, "client certificate file for https backends, mtls")
+	flag.StringVar(&tlsOpt.UpstreamKey, "upstream-key", tlsOpt.UpstreamKey, "client key file for https backends")
+	flag.StringVar(&tlsOpt.UpstreamCA, "upstream-ca", tlsOpt.UpstreamCA, "ca file verifying https backends, empty for the system pool")
+	flag.BoolVar(&tlsOpt.UpstreamInsecure, "upstream-insecure", tlsOpt.UpstreamInsecure, "skip verifying https backend certificates")
+	flag.BoolVar(&cacheOpt.Enable, "cache", cacheOpt.Enable, "cache responses by their Cache-Control, Expires and Vary")
+	flag.Int64Var(&cacheOpt.MemSize, "cache-mem-size", cacheOpt.MemSize, "bytes of responses cached in memory")
+	flag.Int64Var(&cacheOpt.MaxObject, "cache-max-object", cacheOpt.MaxObject, "largest response body cached, in bytes")
+	flag.StringVar(&cacheOpt.Disk, "cache-disk", cacheOpt.Disk, "directory of the disk cache tier taking responses evicted from memory, empty disables")
+	flag.Int64Var(&cacheOpt.DiskSize, "cache-disk-size", cacheOpt.DiskSize, "bytes of responses cached on disk")
+	flag.StringVar(&captureOpt.File, "capture", captureOpt.File, "file capturing request and response pairs for proxy replay, .har for har else ndjson, empty disables")
+	flag.StringVar(&captureOpt.Format, "capture-format", captureOpt.Format, "capture format: har or ndjson, empty by the -capture extension")
+	flag.Float64Var(&captureOpt.Sample, "capture-sample", captureOpt.Sample, "fraction of the requests captured, 0 to 1")
+	flag.StringVar(&captureOpt.Filter, "capture-filter", captureOpt.Filter, "capture only requests matching all keys, comma separated route=, method=, path=<prefix> or status=<404|5xx>, repeated keys match any")
+	flag.Int64Var(&captureOpt.MaxBody, "capture-max-body", captureOpt.MaxBody, "bytes of each request and response body captured")
+	flag.StringVar(&captureOpt.Redact, "capture-redact", captureOpt.Redact, "comma separated headers and query:<name> parameters whose values are not captured")
+	flag.DurationVar(&upstreamOpt.Timeout, "upstream-timeout", upstreamOpt.Timeout, "default route timeout of the whole upstream exchange, retries included, 0 is unlimited")
+	flag.DurationVar(&upstreamOpt.TryTimeout, "upstream-try-timeout", upstreamOpt.TryTimeout, "default route timeout of each upstream try until the response headers, 0 is unlimited")
+	flag.DurationVar(&upstreamOpt.ConnectTimeout, "upstream-connect-timeout", upstreamOpt.ConnectTimeout, "default route backend connect timeout, 0 is 20s")
+	flag.IntVar(&upstreamOpt.Retries, "retries", upstreamOpt.Retries, "default route retries of idempotent requests, on another backend if the pool has one, 0 disables")
+	flag.StringVar(&upstreamOpt.RetryOn, "retry-on", upstreamOpt.RetryOn, "default route retry conditions, comma separated connect-failure, reset, timeout, 5xx or status codes")
+	flag.DurationVar(&upstreamOpt.Backoff, "retry-backoff", upstreamOpt.Backoff, "base of the exponential retry backoff with jitter")
+	flag.DurationVar(&upstreamOpt.MaxBackoff, "retry-max-backoff", upstreamOpt.MaxBackoff, "longest retry backoff")
+	flag.Float64Var(&upstreamOpt.BudgetRatio, "retry-budget", upstreamOpt.BudgetRatio, "retries and hedges a route may send per request over the last 10s")
+	flag.Float64Var(&upstreamOpt.BudgetMin, "retry-budget-min", upstreamOpt.BudgetMin, "retries and hedges per second a route may send regardless of -retry-budget")
+	flag.BoolVar(&upstreamOpt.Hedge, "hedge", upstreamOpt.Hedge, "default route hedging, GET and HEAD requests slower than -hedge-delay are sent to a second backend too")
+	flag.DurationVar(&upstreamOpt.HedgeDelay, "hedge-delay", upstreamOpt.HedgeDelay, "default route hedge delay, 0 is the p95 latency of the route")
+	flag.StringVar(&routesFile, "config", routesFile, "yaml routing table file, reloaded on SIGHUP, empty routes everything to -b")
+	flag.StringVar(&serviceName, "otel-service-name", serviceName, "trace service name")
+	flag.StringVar(&traceOpt.ResourceAttr, "otel-resource-attributes", traceOpt.ResourceAttr, "trace resource attributes, comma separated key=value")
+	flag.StringVar(&traceOpt.Exporter, "otel-traces-exporter", traceOpt.Exporter, "trace exporter: otlp, jaeger, console or none")
+	flag.StringVar(&traceOpt.Protocol, "otel-exporter-otlp-protocol", traceOpt.Protocol, "otlp exporter protocol: grpc or http/protobuf")
+	flag.StringVar(&traceOpt.Endpoint, "otel-exporter-otlp-endpoint", traceOpt.Endpoint, "otlp collector url, e.g. http://collector:4317, empty for localhost")
+	flag.StringVar(&traceOpt.Sampler, "otel-traces-sampler", traceOpt.Sampler, "trace sampler: always_on, always_off, traceidratio, parentbased_always_on, parentbased_always_off or parentbased_traceidratio")
+	flag.StringVar(&traceOpt.SamplerArg, "otel-traces-sampler-arg", traceOpt.SamplerArg, "sampling ratio of the traceidratio samplers, 0 to 1")
+	flag.StringVar(&provider, "tp", provider, "jaeger collector address of the jaeger exporter, alone it selects the deprecated jaeger exporter")
 	flag.UintVar(&readTimeout, "read-timeout", readTimeout, "server read timeout")
 	flag.UintVar(&writeTimeout, "write-timeout", writeTimeout, "server write timeout")
 	envflag.Parse()
+	legacyTraceExporter(&traceOpt)
 
+	// before reloadRoutes starts the health checks using defaultTransport
 	var err error
-	providerURL, err = url.Parse(backend)
-	if err != nil {
+	if defaultTransport.TLSClientConfig, err = upstreamTLSConfig(&tlsOpt); err != nil {
 		panic(err)
 	}
-
-	tp, err := tracerProvider(provider)
+	healthClient := &http.Client{
+		Transport: defaultTransport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if err := reloadRoutes(routesFile, healthClient); err != nil {
+		panic(err)
+	}
+	lim, err := newLimiter(limitOpt)
 	if err != nil {
 		panic(err)
 	}
-	otel.SetTracerProvider(tp)
+	if captureOpt.File != "" {
+		if trafficCapture, err = newCapturer(captureOpt); err != nil {
+			panic(err)
+		}
+	}
+	if cacheOpt.Enable {
+		if responseCache, err = newHTTPCache(cacheOpt); err != nil {
+			panic(err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	tp, err := tracerProvider(ctx, &traceOpt)
+	if err != nil {
+		panic(err)
+	}
+	otel.SetTracerProvider(tp)
+	// w3c traceparent and baggage, the global default propagates nothing
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
 	defer func(ctx context.Context) {
 		ctx, cancel = context.WithTimeout(ctx, time.Second*5)
 		defer cancel()
@@ -180,15 +439,104 @@ func main() {
 
 	exit := make(chan os.Signal, 3)
 	signal.Notify(exit, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	handler := rateLimit(lim, http.HandlerFunc(proxy))
 	server := http.Server{
 		Addr:         addr,
 		ReadTimeout:  time.Duration(readTimeout) * time.Minute,
 		WriteTimeout: time.Duration(writeTimeout) * time.Minute,
-		Handler:      http.HandlerFunc(proxy),
+		Handler:      handler,
+	}
+	var tlsServer *http.Server
+	var h3Server *http3.Server
+	if tlsOpt.Addr != "" {
+		certs, err := newCertStore(&tlsOpt)
+		if err != nil {
+			panic(err)
+		}
+		server.Handler = certs.plainHandler(handler, tlsOpt.Redirect)
+		tlsServer = &http.Server{
+			Addr:         tlsOpt.Addr,
+			ReadTimeout:  server.ReadTimeout,
+			WriteTimeout: server.WriteTimeout,
+			Handler:      handler,
+			TLSConfig:    certs.tlsConfig(),
+		}
+		if tlsOpt.HTTP3 {
+			h3Server = &http3.Server{
+				Addr:      tlsOpt.Addr,
+				Handler:   handler,
+				TLSConfig: certs.tlsConfig(),
+			}
+			// advertise http/3 to the tcp clients
+			tlsServer.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				h3Server.SetQuicHeaders(rw.Header())
+				handler.ServeHTTP(rw, r)
+			})
+		}
+	}
+	admin := http.Server{
+		Addr:    adminAddr,
+		Handler: adminHandler(lim),
+	}
+	if adminAddr != "" {
+		go func() {
+			slog.Info("admin server starting",
+				slog.String("addr", adminAddr),
+			)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("admin server starting error", err,
+					slog.String("addr", adminAddr),
+				)
+			}
+		}()
+	}
+	if tlsServer != nil {
+		go func() {
+			slog.Info("tls server starting",
+				slog.String("addr", tlsOpt.Addr),
+			)
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				slog.Error("tls server starting error", err,
+					slog.String("addr", tlsOpt.Addr),
+				)
+			}
+		}()
+	}
+	if h3Server != nil {
+		go func() {
+			slog.Info("http3 server starting",
+				slog.String("addr", tlsOpt.Addr),
+			)
+			if err := h3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("http3 server starting error", err,
+					slog.String("addr", tlsOpt.Addr),
+				)
+			}
+		}()
 	}
 
 	go func() {
-		<-exit
+		for sig := range exit {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			if err := reloadRoutes(routesFile, healthClient); err != nil {
+				slog.Error("reload routes error, keep the current routes", err,
+					slog.String("file", routesFile),
+				)
+			}
+		}
+		admin.Close()
+		if h3Server != nil {
+			h3Server.Close()
+		}
+		if tlsServer != nil {
+			if err := tlsServer.Shutdown(context.TODO()); err != nil {
+				slog.Error("tls server shutdown error", err,
+					slog.String("addr", tlsOpt.Addr),
+				)
+			}
+		}
 		if err := server.Shutdown(context.TODO()); err != nil {
 			slog.Error("server shutdown error", err,
 				slog.String("addr", addr),
@@ -209,6 +557,9 @@ func main() {
 			)
 		}
 	}
+	if trafficCapture != nil {
+		trafficCapture.Close()
+	}
 	slog.Info("server stopped",
 		slog.String("addr", addr),
 	)
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testProxy serves proxy with a catch all route to the handler of the backend
+func testProxy(t *testing.T, handler http.Handler) *httptest.Server {
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	backend = upstream.URL
+	rr, err := loadRouter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentRouter.Store(rr)
+	srv := httptest.NewServer(http.HandlerFunc(proxy))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// go test -run ^TestProxyStreaming$ .
+func TestProxyStreaming(t *testing.T) {
+	cache, err := newHTTPCache(cacheOption{MemSize: 1 << 20, MaxObject: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		cache *httpCache
+	}{
+		{"no cache", nil},
+		{"cache", cache},
+	}
+	for _, v := range cases {
+		responseCache = v.cache
+		next := make(chan struct{})
+		srv := testProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: 1\n\n"))
+			w.(http.Flusher).Flush()
+			// the second event only once the client got the first one
+			select {
+			case <-next:
+			case <-time.After(5 * time.Second):
+			}
+			w.Write([]byte("data: 2\n\n"))
+		}))
+
+		got := make(chan string, 1)
+		go func() {
+			// without flushing, neither the headers nor the first event arrive before the second one
+			rsp, err := http.Get(srv.URL + "/events")
+			if err != nil {
+				got <- err.Error()
+				return
+			}
+			defer rsp.Body.Close()
+			line, _ := bufio.NewReader(rsp.Body).ReadString('\n')
+			got <- line
+		}()
+		select {
+		case line := <-got:
+			if line != "data: 1\n" {
+				t.Errorf("%s expect: %q, got: %q", v.name, "data: 1\n", line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s expect: first event before the response ends, got: nothing", v.name)
+		}
+		close(next)
+	}
+	responseCache = nil
+}
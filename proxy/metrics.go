@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Requests served by the proxy.",
+	}, []string{"route", "method", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Time from receiving a request to the end of its response.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "status"})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_requests_in_flight",
+		Help: "Requests being served.",
+	})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Failed upstream round trips, kind is client for canceled requests and server for backend errors.",
+	}, []string{"route", "backend", "kind"})
+
+	upstreamDials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_dials_total",
+		Help: "Connections dialed to backends.",
+	}, []string{"result"})
+	upstreamConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_upstream_open_connections",
+		Help: "Open connections to backends, idle ones included.",
+	})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_rate_limited_total",
+		Help: "Requests answered 429 by the rate limit.",
+	})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_cache_requests_total",
+		Help: "Requests through the response cache by X-Cache status.",
+	}, []string{"status"})
+	captured = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_captured_total",
+		Help: "Exchanges captured, dropped when the capture file falls behind.",
+	}, []string{"result"})
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_retries_total",
+		Help: "Upstream tries sent again, by why the previous one failed: connect-failure, reset, timeout or its status.",
+	}, []string{"route", "reason"})
+	retryBudgetExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_retry_budget_exhausted_total",
+		Help: "Retries and hedges not sent because the retry budget of the route was spent.",
+	}, []string{"route"})
+	upstreamHedges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_hedges_total",
+		Help: "Hedged requests, result is won if the hedge answered first.",
+	}, []string{"route", "result"})
+	upstreamConnsReused = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_conn_acquired_total",
+		Help: "Connections taken from the transport pool for a round trip, by whether an idle one was reused.",
+	}, []string{"reused"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		requestsInFlight,
+		upstreamErrors,
+		upstreamDials,
+		upstreamConns,
+		upstreamConnsReused,
+		rateLimited,
+		cacheRequests,
+		captured,
+		upstreamRetries,
+		retryBudgetExhausted,
+		upstreamHedges,
+		poolCollector{},
+	)
+}
+
+// metricsHandler serves the openmetrics format when scraped for it, the only one carrying exemplars
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
+
+// methodLabel keeps arbitrary client methods out of the label values
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// observeRequest records a finished request, linking the sample to its trace
+func observeRequest(sc trace.SpanContext, routeName, method string, status int, d time.Duration) {
+	labels := prometheus.Labels{
+		"route":  routeName,
+		"method": methodLabel(method),
+		"status": strconv.Itoa(status),
+	}
+	if !sc.IsSampled() {
+		requestsTotal.With(labels).Inc()
+		requestDuration.With(labels).Observe(d.Seconds())
+		return
+	}
+	exemplar := prometheus.Labels{"trace_id": sc.TraceID().String()}
+	requestsTotal.With(labels).(prometheus.ExemplarAdder).AddWithExemplar(1, exemplar)
+	requestDuration.With(labels).(prometheus.ExemplarObserver).ObserveWithExemplar(d.Seconds(), exemplar)
+}
+
+// connTrace counts reused and new connections of the transport
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		upstreamConnsReused.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+	},
+}
+
+// countDial wraps a DialContext to track the open connections of the transport
+func countDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			upstreamDials.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		upstreamDials.WithLabelValues("success").Inc()
+		upstreamConns.Inc()
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(upstreamConns.Dec)
+	return c.Conn.Close()
+}
+
+var (
+	backendInFlightDesc = prometheus.NewDesc("proxy_backend_in_flight",
+		"Requests in flight to a backend of a pool.", []string{"pool", "backend"}, nil)
+	backendUpDesc = prometheus.NewDesc("proxy_backend_up",
+		"Whether a backend of a pool is picked, 0 if unhealthy, ejected, its circuit is open or at max conns.", []string{"pool", "backend"}, nil)
+	backendCircuitDesc = prometheus.NewDesc("proxy_backend_circuit_state",
+		"Circuit breaker state of a backend of a pool, 0 closed, 1 open, 2 half-open.", []string{"pool", "backend"}, nil)
+)
+
+// poolCollector reports the backends of the current routes
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendInFlightDesc
+	ch <- backendUpDesc
+	ch <- backendCircuitDesc
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	rr := currentRouter.Load()
+	if rr == nil {
+		return
+	}
+	now := time.Now()
+	for name, p := range rr.pools {
+		for _, b := range p.backends {
+			up := 0.0
+			if p.available(b, now, nil) {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(b.conns.Load()), name, b.url.String())
+			ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, up, name, b.url.String())
+			ch <- prometheus.MustNewConstMetric(backendCircuitDesc, prometheus.GaugeValue, float64(b.breaker.state.Load()), name, b.url.String())
+		}
+	}
+}
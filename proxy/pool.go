@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// virtualNodes per weight unit on the consistent hash ring
+const virtualNodes = 64
+
+var errNoBackend = errors.New("no available backend")
+
+type upstream struct {
+	url    *url.URL
+	weight int
+
+	healthy      atomic.Bool  // result of the last active check
+	conns        atomic.Int64 // in-flight requests
+	fails        atomic.Int64 // consecutive failures seen by the proxy
+	ejectedUntil atomic.Int64 // unix nano, passive ejection after max fails
+	breaker      breaker
+
+	current int // smooth weighted round-robin state, guarded by pool.mu
+}
+
+// parseBackends parses a comma separated list of url[;weight=n]
+func parseBackends(s string) ([]*upstream, error) {
+	backends := []*upstream{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		rawURL, params, _ := strings.Cut(item, ";")
+		weight := 1
+		if params != "" {
+			k, v, _ := strings.Cut(params, "=")
+			if k != "weight" {
+				return nil, fmt.Errorf("backend %s unknown param %q", rawURL, k)
+			}
+			var err error
+			if weight, err = strconv.Atoi(v); err != nil || weight < 1 {
+				return nil, fmt.Errorf("backend %s invalid weight %q", rawURL, v)
+			}
+		}
+		b, err := newBackend(rawURL, weight)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no backend")
+	}
+	return backends, nil
+}
+
+func newBackend(rawURL string, weight int) (*upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend %s: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid backend %s: want http(s)://host:port", rawURL)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	b := &upstream{url: u, weight: weight}
+	b.healthy.Store(true)
+	return b, nil
+}
+
+type poolOption struct {
+	Strategy       string // round-robin, least-conn or hash
+	HashKey        string // header:<name>, cookie:<name>, path or ip
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	MaxFails       int           // passive ejection after consecutive failures, 0 disables
+	FailTimeout    time.Duration // how long an ejected backend is skipped
+	CircuitFails   int           // open the circuit after consecutive 5xx or transport errors, 0 disables
+	CircuitCool    time.Duration // how long an open circuit rejects requests before a trial
+	MaxConns       int64         // in-flight requests per backend, 0 is unlimited
+}
+
+type ringNode struct {
+	hash    uint32
+	backend *upstream
+}
+
+// pool balances requests over backends
+type pool struct {
+	poolOption
+	backends []*upstream
+	ring     []ringNode // sorted by hash
+	next     atomic.Uint32
+	mu       sync.Mutex
+}
+
+func newPool(backends []*upstream, opt poolOption) (*pool, error) {
+	switch opt.Strategy {
+	case "", "round-robin":
+		opt.Strategy = "round-robin"
+	case "least-conn":
+	case "hash":
+		if err := validHashKey(opt.HashKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", opt.Strategy)
+	}
+	if opt.HealthInterval <= 0 {
+		opt.HealthInterval = 10 * time.Second
+	}
+	if opt.HealthTimeout <= 0 {
+		opt.HealthTimeout = 2 * time.Second
+	}
+	if opt.FailTimeout <= 0 {
+		opt.FailTimeout = 30 * time.Second
+	}
+	if opt.CircuitCool <= 0 {
+		opt.CircuitCool = 10 * time.Second
+	}
+
+	p := &pool{poolOption: opt, backends: backends}
+	if opt.Strategy == "hash" {
+		for _, b := range backends {
+			for i := 0; i < b.weight*virtualNodes; i++ {
+				p.ring = append(p.ring, ringNode{hash: hashString(fmt.Sprintf("%s#%d", b.url.Host, i)), backend: b})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p, nil
+}
+
+func validHashKey(key string) error {
+	kind, name, _ := strings.Cut(key, ":")
+	switch {
+	case (kind == "header" || kind == "cookie") && name != "":
+	case key == "path", key == "ip":
+	default:
+		return fmt.Errorf("invalid hash key %q, want header:<name>, cookie:<name>, path or ip", key)
+	}
+	return nil
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// hashValue returns the value of the hash key of r, the client ip if the request has none
+func (p *pool) hashValue(r *http.Request) string {
+	kind, name, _ := strings.Cut(p.HashKey, ":")
+	switch kind {
+	case "header":
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	case "path":
+		return r.URL.Path
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// available reports whether b may be picked at now, skip holds the backends refused this request
+func (p *pool) available(b *upstream, now time.Time, skip map[*upstream]bool) bool {
+	return b.healthy.Load() &&
+		now.UnixNano() >= b.ejectedUntil.Load() &&
+		(p.CircuitFails <= 0 || b.breaker.ready(now, p.CircuitCool)) &&
+		(p.MaxConns <= 0 || b.conns.Load() < p.MaxConns) &&
+		!skip[b]
+}
+
+// acquire counts b as in-flight if its circuit and max conns let the request through
+func (p *pool) acquire(b *upstream, now time.Time) bool {
+	if n := b.conns.Add(1); p.MaxConns > 0 && n > p.MaxConns ||
+		p.CircuitFails > 0 && !b.breaker.allow(now, p.CircuitCool) {
+		b.conns.Add(-1)
+		return false
+	}
+	return true
+}
+
+// pick returns the backend for r and counts it as in-flight, call done when the request is finished.
+// A backend refusing the request by its circuit or max conns is skipped and the next one tried,
+// so are the backends in skip
+func (p *pool) pick(r *http.Request, skip map[*upstream]bool) (*upstream, error) {
+	now := time.Now()
+	refused := map[*upstream]bool{}
+	for b := range skip {
+		refused[b] = true
+	}
+	for range p.backends {
+		b := p.choose(r, now, refused)
+		if b == nil {
+			break
+		}
+		if p.acquire(b, now) {
+			return b, nil
+		}
+		refused[b] = true
+	}
+	return nil, errNoBackend
+}
+
+func (p *pool) choose(r *http.Request, now time.Time, skip map[*upstream]bool) *upstream {
+	var picked *upstream
+	switch p.Strategy {
+	case "least-conn":
+		// rotate the start so ties don't all go to the first backend
+		start := int(p.next.Add(1))
+		for i := range p.backends {
+			b := p.backends[(start+i)%len(p.backends)]
+			if !p.available(b, now, skip) {
+				continue
+			}
+			// compare conns/weight without division
+			if picked == nil || b.conns.Load()*int64(picked.weight) < picked.conns.Load()*int64(b.weight) {
+				picked = b
+			}
+		}
+	case "hash":
+		h := hashString(p.hashValue(r))
+		i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		// walk the ring past unavailable backends, keeping the other keys in place
+		for n := 0; n < len(p.ring); n++ {
+			if b := p.ring[(i+n)%len(p.ring)].backend; p.available(b, now, skip) {
+				picked = b
+				break
+			}
+		}
+	default:
+		picked = p.roundRobin(now, skip)
+	}
+	return picked
+}
+
+// roundRobin is nginx's smooth weighted round-robin
+func (p *pool) roundRobin(now time.Time, skip map[*upstream]bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *upstream
+	total := 0
+	for _, b := range p.backends {
+		if !p.available(b, now, skip) {
+			continue
+		}
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// done finishes a request picked from the pool, max transport errors in a row seen
+// by the ErrorHandler eject the backend for fail timeout, only a success breaks the row
+func (p *pool) done(b *upstream, o outcome) {
+	b.conns.Add(-1)
+	b.breaker.record(o, p.CircuitFails, b.url.String())
+	switch o {
+	case outcomeOK:
+		b.fails.Store(0)
+		return
+	case outcomeCanceled, outcomeServerError:
+		return
+	}
+	if fails := b.fails.Add(1); p.MaxFails > 0 && fails >= int64(p.MaxFails) {
+		b.fails.Store(0)
+		b.ejectedUntil.Store(time.Now().Add(p.FailTimeout).UnixNano())
+		slog.Warn("backend ejected",
+			slog.String("backend", b.url.String()),
+			slog.Int64("fails", fails),
+			slog.Duration("duration", p.FailTimeout),
+		)
+	}
+}
+
+// healthCheck probes GET <backend><health path> every health interval until ctx is done,
+// 2xx and 3xx responses are healthy
+func (p *pool) healthCheck(ctx context.Context, client *http.Client) {
+	if p.HealthPath == "" {
+		return
+	}
+	ticker := time.NewTicker(p.HealthInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *upstream) {
+				defer wg.Done()
+				err := p.probe(ctx, client, b)
+				if healthy := err == nil; b.healthy.Swap(healthy) != healthy {
+					if healthy {
+						slog.Info("backend healthy",
+							slog.String("backend", b.url.String()),
+						)
+					} else {
+						slog.Warn("backend unhealthy",
+							slog.String("backend", b.url.String()),
+							slog.String("error", err.Error()),
+						)
+					}
+				}
+			}(b)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *pool) probe(ctx context.Context, client *http.Client, b *upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, p.HealthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.JoinPath(p.HealthPath).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
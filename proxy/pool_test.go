@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testBackends(t *testing.T, weights ...int) []*upstream {
+	backends := []*upstream{}
+	for i, w := range weights {
+		b, err := newBackend(fmt.Sprintf("http://10.0.0.%d:80", i+1), w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+// picks returns the hosts of n picks, each finished before the next
+func picks(t *testing.T, p *pool, key string, n int) []string {
+	hosts := []string{}
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", key)
+		b, err := p.pick(r, nil)
+		if err != nil {
+			hosts = append(hosts, "")
+			continue
+		}
+		hosts = append(hosts, b.url.Host)
+		p.done(b, outcomeOK)
+	}
+	return hosts
+}
+
+// go test -run ^TestPoolStrategy$ .
+func TestPoolStrategy(t *testing.T) {
+	cases := []struct {
+		name     string
+		opt      poolOption
+		weights  []int
+		conns    []int64
+		ejected  []bool
+		n        int
+		expected []string
+	}{
+		{
+			name:     "round-robin smooth weighted",
+			weights:  []int{3, 1},
+			n:        8,
+			expected: []string{"10.0.0.1:80", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.1:80", "10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80"},
+		},
+		{
+			name:     "round-robin skips ejected",
+			weights:  []int{1, 1, 1},
+			ejected:  []bool{false, true, false},
+			n:        4,
+			expected: []string{"10.0.0.1:80", "10.0.0.3:80", "10.0.0.1:80", "10.0.0.3:80"},
+		},
+		{
+			name:     "round-robin all ejected",
+			weights:  []int{1},
+			ejected:  []bool{true},
+			n:        1,
+			expected: []string{""},
+		},
+		{
+			name:     "least-conn",
+			opt:      poolOption{Strategy: "least-conn"},
+			weights:  []int{1, 1, 1},
+			conns:    []int64{3, 1, 2},
+			n:        2,
+			expected: []string{"10.0.0.2:80", "10.0.0.2:80"},
+		},
+		{
+			name:     "least-conn by weight",
+			opt:      poolOption{Strategy: "least-conn"},
+			weights:  []int{1, 4},
+			conns:    []int64{1, 3},
+			n:        1,
+			expected: []string{"10.0.0.2:80"},
+		},
+		{
+			name:     "max conns",
+			opt:      poolOption{Strategy: "least-conn", MaxConns: 2},
+			weights:  []int{1, 1},
+			conns:    []int64{2, 2},
+			n:        1,
+			expected: []string{""},
+		},
+	}
+	for _, v := range cases {
+		backends := testBackends(t, v.weights...)
+		for i, c := range v.conns {
+			backends[i].conns.Store(c)
+		}
+		for i, e := range v.ejected {
+			if e {
+				backends[i].ejectedUntil.Store(time.Now().Add(time.Minute).UnixNano())
+			}
+		}
+		p, err := newPool(backends, v.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := picks(t, p, "", v.n); fmt.Sprint(got) != fmt.Sprint(v.expected) {
+			t.Errorf("%s expect: %v, got: %v", v.name, v.expected, got)
+		}
+	}
+}
+
+// go test -run ^TestPoolHashRing$ .
+func TestPoolHashRing(t *testing.T) {
+	backends := testBackends(t, 1, 1, 1, 1)
+	p, err := newPool(backends, poolOption{Strategy: "hash", HashKey: "header:X-User", MaxFails: 2, FailTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.ring) != len(backends)*virtualNodes {
+		t.Fatalf("ring expect: %d nodes, got: %d", len(backends)*virtualNodes, len(p.ring))
+	}
+
+	keys := []string{}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("user-%d", i))
+	}
+	before := map[string]string{}
+	counts := map[string]int{}
+	for _, k := range keys {
+		hosts := picks(t, p, k, 3)
+		if hosts[0] != hosts[1] || hosts[1] != hosts[2] {
+			t.Errorf("%s expect: the same backend, got: %v", k, hosts)
+		}
+		before[k] = hosts[0]
+		counts[hosts[0]]++
+	}
+	for _, b := range backends {
+		if counts[b.url.Host] == 0 {
+			t.Errorf("%s expect: some keys, got: none", b.url.Host)
+		}
+	}
+
+	// max fails in a row eject the backend of the first key, a canceled request doesn't break the row
+	ejected := backends[0]
+	for _, b := range backends {
+		if b.url.Host == before[keys[0]] {
+			ejected = b
+		}
+	}
+	cases := []struct {
+		outcome outcome
+		ejected bool
+	}{
+		{outcomeFailed, false},
+		{outcomeOK, false},
+		{outcomeFailed, false},
+		{outcomeCanceled, false},
+		{outcomeServerError, false},
+		{outcomeFailed, true},
+	}
+	for i, v := range cases {
+		ejected.conns.Add(1)
+		p.done(ejected, v.outcome)
+		if got := ejected.ejectedUntil.Load() > time.Now().UnixNano(); got != v.ejected {
+			t.Fatalf("%d expect: ejected %v, got: %v", i, v.ejected, got)
+		}
+	}
+
+	// only the keys of the ejected backend move
+	for _, k := range keys {
+		host := picks(t, p, k, 1)[0]
+		switch {
+		case before[k] == ejected.url.Host && host == ejected.url.Host:
+			t.Errorf("%s expect: moved off %s", k, ejected.url.Host)
+		case before[k] != ejected.url.Host && host != before[k]:
+			t.Errorf("%s expect: %s, got: %s", k, before[k], host)
+		}
+	}
+
+	ejected.ejectedUntil.Store(0)
+	for _, k := range keys {
+		if host := picks(t, p, k, 1)[0]; host != before[k] {
+			t.Errorf("%s after ejection expect: %s, got: %s", k, before[k], host)
+		}
+	}
+}
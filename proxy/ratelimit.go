@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type limitOption struct {
+	Rate    float64 // requests per second per key, 0 disables
+	Burst   int     // bucket size, the rate rounded up if 0
+	Key     string  // ip, header:<name> or route
+	MaxKeys int     // buckets kept at most, requests of new keys are limited while full
+}
+
+var limitOpt = limitOption{Key: "ip", MaxKeys: 100000}
+
+// bucket is a token bucket, full when created
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter rate limits requests per key with token buckets
+type limiter struct {
+	limitOption
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(opt limitOption) (*limiter, error) {
+	if opt.Rate < 0 {
+		return nil, fmt.Errorf("invalid rate limit %v", opt.Rate)
+	}
+	if opt.Burst <= 0 {
+		opt.Burst = int(math.Ceil(opt.Rate))
+	}
+	if opt.MaxKeys <= 0 {
+		return nil, fmt.Errorf("invalid rate limit max keys %d", opt.MaxKeys)
+	}
+	if kind, name, _ := strings.Cut(opt.Key, ":"); !(opt.Key == "ip" || opt.Key == "route" || kind == "header" && name != "") {
+		return nil, fmt.Errorf("invalid rate limit key %q, want ip, header:<name> or route", opt.Key)
+	}
+	return &limiter{
+		limitOption: opt,
+		buckets:     map[string]*bucket{},
+		swept:       time.Now(),
+	}, nil
+}
+
+// key returns the bucket key of r, the client ip if r has no header of the key.
+// For a header value it also returns the client ip key, which pays for the value's new bucket
+func (l *limiter) key(r *http.Request) (key, ipKey string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	kind, name, _ := strings.Cut(l.Key, ":")
+	switch kind {
+	case "header":
+		if v := r.Header.Get(name); v != "" {
+			return "header:" + v, "ip:" + host
+		}
+	case "route":
+		if rt := currentRouter.Load().match(r); rt != nil {
+			return "route:" + rt.Name, ""
+		}
+		return "route:", ""
+	}
+	return "ip:" + host, ""
+}
+
+// take takes a token of key, returning how long to wait for one if the bucket is empty.
+// A key without a bucket first takes a token of ipKey if set, so a client can't get
+// a full bucket for every made up header value
+func (l *limiter) take(key, ipKey string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now, time.Minute)
+
+	if _, ok := l.buckets[key]; !ok && ipKey != "" {
+		if wait := l.takeLocked(ipKey, now); wait > 0 {
+			return wait
+		}
+	}
+	return l.takeLocked(key, now)
+}
+
+func (l *limiter) takeLocked(key string, now time.Time) time.Duration {
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= l.MaxKeys {
+			l.sweep(now, time.Second)
+		}
+		if len(l.buckets) >= l.MaxKeys {
+			// full of active keys, new ones wait for them to refill
+			return time.Duration(float64(time.Second) / l.Rate)
+		}
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets refilled by now at most once every interval, they are the same as new ones
+func (l *limiter) sweep(now time.Time, interval time.Duration) {
+	if now.Sub(l.swept) < interval {
+		return
+	}
+	l.swept = now
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *limiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// rateLimit answers 429 with Retry-After to the requests over the limit, nil l passes all
+func rateLimit(l *limiter, next http.Handler) http.Handler {
+	if l == nil || l.Rate == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key, ipKey := l.key(r)
+		if wait := l.take(key, ipKey, time.Now()); wait > 0 {
+			rateLimited.Inc()
+			slog.Warn("proxy rate limited",
+				slog.String("remote", r.RemoteAddr),
+				slog.String("key", l.Key), // not the value, it may be an api key
+				slog.String("url", r.URL.String()),
+			)
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// go test -run ^TestLimiter$ .
+func TestLimiter(t *testing.T) {
+	l, err := newLimiter(limitOption{Rate: 1, Burst: 2, Key: "header:X-Api-Key", MaxKeys: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cases := []struct {
+		remote, apiKey string
+		after          time.Duration
+		limited        bool
+	}{
+		{"1.1.1.1:1", "a", 0, false}, // new value, pays an ip token
+		{"1.1.1.1:1", "a", 0, false},
+		{"1.1.1.1:1", "a", 0, true},
+		{"1.1.1.1:1", "b", 0, false}, // the second ip token
+		{"1.1.1.1:1", "c", 0, true},  // no ip token left for another new value
+		{"1.1.1.1:1", "", 0, true},   // absent header is limited by ip
+		{"2.2.2.2:1", "", 0, false},  // the fourth bucket
+		{"3.3.3.3:1", "", 0, true},   // full, a new key waits
+		{"1.1.1.1:1", "a", time.Second, false},
+		{"3.3.3.3:1", "", 2 * time.Second, false}, // refilled buckets are swept
+	}
+	for i, v := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = v.remote
+		if v.apiKey != "" {
+			r.Header.Set("X-Api-Key", v.apiKey)
+		}
+		key, ipKey := l.key(r)
+		if limited := l.take(key, ipKey, now.Add(v.after)) > 0; limited != v.limited {
+			t.Errorf("%d %s %q expect: limited %v, got: %v", i, v.remote, v.apiKey, v.limited, limited)
+		}
+	}
+	if n := l.size(); n > 4 {
+		t.Errorf("buckets expect: at most 4, got: %d", n)
+	}
+}
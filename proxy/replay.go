@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type replayOption struct {
+	Target        string // scheme and host the captured requests are sent to
+	Concurrency   int
+	Timeout       time.Duration
+	KeepHost      bool   // send the captured Host header instead of the target's
+	IgnoreHeaders string // comma separated response headers not compared
+	Filter        string // capture filter syntax, the exchanges to replay
+	MaxDiffs      int    // differences reported per exchange
+	Insecure      bool
+	Verbose       bool
+	Headers       http.Header       // set on every request, e.g. credentials for the redacted ones
+	Query         map[string]string // values of the query parameters redacted by the capture
+}
+
+var replayOpt = replayOption{
+	Concurrency:   1,
+	Timeout:       30 * time.Second,
+	IgnoreHeaders: "Date,Age,Expires,Last-Modified,Etag,Server,Via,Alt-Svc,X-Cache,Set-Cookie,Content-Length,Traceparent,Tracestate",
+	MaxDiffs:      10,
+	Headers:       http.Header{},
+	Query:         map[string]string{},
+}
+
+// replayResult is the outcome of replaying an exchange
+type replayResult struct {
+	exchange *exchange
+	skipped  string
+	err      error
+	diffs    []string
+}
+
+// runReplay is `proxy replay`, it re-sends a capture to a target and reports the responses
+// differing from the captured ones, the exit code is 1 if any does
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: proxy replay [flags] <capture file>
+
+Re-send the requests of a -capture file, har or ndjson, to a target and diff the responses.
+
+Example:
+  proxy replay -target https://staging.example.com capture.ndjson
+  proxy replay -target http://localhost:8080 -filter status=5xx -header 'Authorization: Bearer x' capture.har
+  proxy replay -target https://staging.example.com -query token=x capture.ndjson
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&replayOpt.Target, "target", replayOpt.Target, "url whose scheme and host replace the captured ones, required")
+	fs.IntVar(&replayOpt.Concurrency, "concurrency", replayOpt.Concurrency, "requests in flight")
+	fs.DurationVar(&replayOpt.Timeout, "timeout", replayOpt.Timeout, "timeout of each request")
+	fs.BoolVar(&replayOpt.KeepHost, "keep-host", replayOpt.KeepHost, "send the captured Host header instead of the target host")
+	fs.StringVar(&replayOpt.IgnoreHeaders, "ignore-headers", replayOpt.IgnoreHeaders, "comma separated response headers not compared")
+	fs.StringVar(&replayOpt.Filter, "filter", replayOpt.Filter, "replay only exchanges matching all keys, comma separated route=, method=, path=<prefix> or status=<404|5xx> of the captured response")
+	fs.IntVar(&replayOpt.MaxDiffs, "max-diffs", replayOpt.MaxDiffs, "differences reported per exchange")
+	fs.BoolVar(&replayOpt.Insecure, "insecure", replayOpt.Insecure, "skip verifying the target certificate")
+	fs.BoolVar(&replayOpt.Verbose, "v", replayOpt.Verbose, "report the matching exchanges too")
+	fs.Func("header", "`name: value` set on every request, e.g. for the redacted credentials, repeatable", func(s string) error {
+		k, v, ok := strings.Cut(s, ":")
+		if !ok {
+			return errors.New("want name: value")
+		}
+		replayOpt.Headers.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+		return nil
+	})
+	fs.Func("query", "`name=value` of a query parameter redacted by the capture, exchanges with one not set are skipped, repeatable", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || k == "" {
+			return errors.New("want name=value")
+		}
+		replayOpt.Query[strings.ToLower(k)] = v
+		return nil
+	})
+	fs.Parse(args)
+	if fs.NArg() != 1 || replayOpt.Target == "" {
+		fs.Usage()
+		return 2
+	}
+	target, err := url.Parse(replayOpt.Target)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		fmt.Fprintf(os.Stderr, "invalid target %q, want e.g. https://staging.example.com\n", replayOpt.Target)
+		return 2
+	}
+	filter, err := parseCaptureFilter(replayOpt.Filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	all, err := readCapture(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	exchanges := []*exchange{}
+	for _, e := range all {
+		r, err := http.NewRequest(e.Request.Method, e.Request.URL, nil)
+		if err == nil && filter.request(r, e.Route) && filter.status(e.Response.Status) {
+			exchanges = append(exchanges, e)
+		}
+	}
+
+	r := &replayer{
+		replayOption: replayOpt,
+		target:       target,
+		ignore:       map[string]bool{},
+		client: &http.Client{
+			Timeout: replayOpt.Timeout,
+			Transport: &http.Transport{
+				Proxy:              http.ProxyFromEnvironment,
+				TLSClientConfig:    &tls.Config{InsecureSkipVerify: replayOpt.Insecure},
+				DisableCompression: true, // compare the bytes as captured
+				ForceAttemptHTTP2:  true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, h := range strings.Split(replayOpt.IgnoreHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			r.ignore[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+	return r.run(exchanges)
+}
+
+type replayer struct {
+	replayOption
+	target *url.URL
+	ignore map[string]bool
+	client *http.Client
+}
+
+func (r *replayer) run(exchanges []*exchange) int {
+	results := make([]*replayResult, len(exchanges))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = r.replay(exchanges[i])
+			}
+		}()
+	}
+	for i := range exchanges {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	same, different, failed, skipped := 0, 0, 0, 0
+	for _, res := range results {
+		e := res.exchange
+		switch {
+		case res.skipped != "":
+			skipped++
+			fmt.Printf("SKIP %s %s: %s\n", e.Request.Method, e.Request.URL, res.skipped)
+		case res.err != nil:
+			failed++
+			fmt.Printf("ERROR %s %s: %s\n", e.Request.Method, e.Request.URL, res.err)
+		case len(res.diffs) > 0:
+			different++
+			fmt.Printf("DIFF %s %s (captured %s, trace %s)\n", e.Request.Method, e.Request.URL, e.Time.Format(time.RFC3339), e.TraceID)
+			for _, d := range res.diffs {
+				fmt.Printf("  %s\n", d)
+			}
+		default:
+			same++
+			if r.Verbose {
+				fmt.Printf("OK %s %s\n", e.Request.Method, e.Request.URL)
+			}
+		}
+	}
+	fmt.Printf("replayed %d: %d same, %d different, %d errors, %d skipped\n", len(results), same, different, failed, skipped)
+	if different > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (r *replayer) replay(e *exchange) *replayResult {
+	res := &replayResult{exchange: e}
+	if e.Request.Truncated {
+		res.skipped = "request body was truncated by -capture-max-body"
+		return res
+	}
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if name := r.restoreQuery(u); name != "" {
+		res.skipped = fmt.Sprintf("query parameter %s was redacted by the capture, set it with -query", name)
+		return res
+	}
+	host := u.Host
+	u.Scheme, u.Host = r.target.Scheme, r.target.Host
+	body, err := e.Request.bytes()
+	if err != nil {
+		res.err = fmt.Errorf("decode request body err: %w", err)
+		return res
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, e.Request.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	for k, vs := range e.Request.Header {
+		if len(vs) == 1 && vs[0] == redacted || k == "Content-Length" {
+			continue
+		}
+		req.Header[k] = vs
+	}
+	for k, vs := range r.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = vs
+	}
+	if r.KeepHost {
+		req.Host = host
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		res.err = fmt.Errorf("read response err: %w", err)
+		return res
+	}
+	res.diffs = r.diff(e, resp, got)
+	if len(res.diffs) > r.MaxDiffs {
+		res.diffs = append(res.diffs[:r.MaxDiffs], fmt.Sprintf("... %d more", len(res.diffs)-r.MaxDiffs))
+	}
+	return res
+}
+
+// restoreQuery sets the -query values of the redacted query parameters of u,
+// returning the name of the first one without a value
+func (r *replayer) restoreQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	for i, kv := range pairs {
+		k, v, _ := strings.Cut(kv, "=")
+		if v, err := url.QueryUnescape(v); err != nil || v != redacted {
+			continue
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		value, ok := r.Query[strings.ToLower(name)]
+		if !ok {
+			return name
+		}
+		pairs[i] = k + "=" + url.QueryEscape(value)
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+	return ""
+}
+
+// diff compares the captured response of e with resp and its body
+func (r *replayer) diff(e *exchange, resp *http.Response, got []byte) []string {
+	diffs := []string{}
+	if resp.StatusCode != e.Response.Status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", e.Response.Status, resp.StatusCode))
+	}
+
+	names := map[string]bool{}
+	for k := range e.Response.Header {
+		names[k] = true
+	}
+	for k := range resp.Header {
+		names[k] = true
+	}
+	sorted := []string{}
+	for k := range names {
+		if !r.ignore[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		want, have := strings.Join(e.Response.Header.Values(k), ", "), strings.Join(resp.Header.Values(k), ", ")
+		if want != have && want != redacted {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", k, want, have))
+		}
+	}
+
+	want, err := e.Response.bytes()
+	if err != nil {
+		return append(diffs, fmt.Sprintf("body: decode captured body err: %s", err))
+	}
+	if e.Response.Truncated && len(got) > len(want) {
+		// only the start was captured
+		got = got[:len(want)]
+	}
+	want = decodeBody(want, e.Response.Header)
+	got = decodeBody(got, resp.Header)
+	if bytes.Equal(want, got) {
+		return diffs
+	}
+	return append(diffs, bodyDiff(want, got, !e.Response.Truncated)...)
+}
+
+// decodeBody gunzips gzip bodies as far as they go, the others are returned as is
+func decodeBody(b []byte, h http.Header) []byte {
+	if !strings.EqualFold(h.Get("Content-Encoding"), "gzip") {
+		return b
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return b
+	}
+	out, _ := io.ReadAll(zr)
+	return out
+}
+
+// bodyDiff describes how got differs from want, by json path if both are whole json documents
+func bodyDiff(want, got []byte, whole bool) []string {
+	var wantJSON, gotJSON any
+	if whole && json.Unmarshal(want, &wantJSON) == nil && json.Unmarshal(got, &gotJSON) == nil {
+		diffs := []string{}
+		jsonDiff("$", wantJSON, gotJSON, &diffs)
+		if len(diffs) > 0 {
+			return diffs
+		}
+	}
+	wantLines, gotLines := bytes.Split(want, []byte("\n")), bytes.Split(got, []byte("\n"))
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g []byte
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if !bytes.Equal(w, g) {
+			if isText(w) && isText(g) {
+				return []string{fmt.Sprintf("body line %d: %q != %q", i+1, clip(w), clip(g))}
+			}
+			break
+		}
+	}
+	return []string{fmt.Sprintf("body: %d bytes sha256 %x != %d bytes sha256 %x",
+		len(want), sha256.Sum256(want), len(got), sha256.Sum256(got))}
+}
+
+func jsonDiff(path string, want, got any, diffs *[]string) {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := []string{}
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			jsonDiff(path+"."+k, w[k], g[k], diffs)
+		}
+		return
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(w) || i < len(g); i++ {
+			var wv, gv any = "<missing>", "<missing>"
+			if i < len(w) {
+				wv = w[i]
+			}
+			if i < len(g) {
+				gv = g[i]
+			}
+			jsonDiff(fmt.Sprintf("%s[%d]", path, i), wv, gv, diffs)
+		}
+		return
+	}
+	wb, _ := json.Marshal(want)
+	gb, _ := json.Marshal(got)
+	if !bytes.Equal(wb, gb) {
+		*diffs = append(*diffs, fmt.Sprintf("body %s: %s != %s", path, clip(wb), clip(gb)))
+	}
+}
+
+func isText(b []byte) bool {
+	return !bytes.ContainsRune(b, 0) && bytes.Equal(bytes.ToValidUTF8(b, nil), b)
+}
+
+func clip(b []byte) string {
+	if len(b) > 120 {
+		return string(b[:120]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -run ^TestReplayRestoreQuery$ .
+func TestReplayRestoreQuery(t *testing.T) {
+	r := &replayer{replayOption: replayOption{Query: map[string]string{"token": "t 1"}}}
+	cases := []struct {
+		url      string
+		expected string
+		missing  string
+	}{
+		{"http://a/x", "http://a/x", ""},
+		{"http://a/x?q=1", "http://a/x?q=1", ""},
+		{"http://a/x?Token=%5BREDACTED%5D&q=1", "http://a/x?Token=t+1&q=1", ""},
+		{"http://a/x?q=%5BREDACTED%5D&token=%5BREDACTED%5D", "", "q"},
+		{"http://a/x?api%5Fkey=%5BREDACTED%5D", "", "api_key"},
+		{"http://a/x?q=REDACTED", "http://a/x?q=REDACTED", ""},
+	}
+	for _, v := range cases {
+		u, _ := url.Parse(v.url)
+		missing := r.restoreQuery(u)
+		if missing != v.missing {
+			t.Errorf("%s expect: missing %q, got: %q", v.url, v.missing, missing)
+			continue
+		}
+		if missing == "" && u.String() != v.expected {
+			t.Errorf("%s expect: %s, got: %s", v.url, v.expected, u.String())
+		}
+	}
+}
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.Bytes()
+}
+
+// go test -run ^TestReplayDiff$ .
+func TestReplayDiff(t *testing.T) {
+	r := &replayer{ignore: map[string]bool{"Date": true}}
+	cases := []struct {
+		name      string
+		status    int
+		gotStatus int
+		header    http.Header
+		body      string
+		truncated bool
+		got       []byte
+		gotHeader http.Header
+		diffs     []string
+	}{
+		{"same", 200, 200, testHeader("X-A", "1"), "ok", false, []byte("ok"), testHeader("X-A", "1"), []string{}},
+		{"ignored header", 200, 200, testHeader("Date", "1"), "ok", false, []byte("ok"), testHeader("Date", "2"), []string{}},
+		{"redacted header", 200, 200, testHeader("Set-Cookie", redacted), "ok", false, []byte("ok"), testHeader("Set-Cookie", "a=b"), []string{}},
+		{"status and header", 200, 500, testHeader("X-A", "1"), "ok", false, []byte("ok"), testHeader("X-B", "2"),
+			[]string{"status: 200 != 500", `header X-A: "1" != ""`, `header X-B: "" != "2"`}},
+		{"json path", 200, 200, testHeader(), `{"a":1,"b":[1,2]}`, false, []byte(`{"a":1,"b":[1,3],"c":true}`), testHeader(),
+			[]string{"body $.b[1]: 2 != 3", "body $.c: null != true"}},
+		{"text line", 200, 200, testHeader(), "a\nb\nc", false, []byte("a\nx\nc"), testHeader(),
+			[]string{`body line 2: "b" != "x"`}},
+		{"truncated capture", 200, 200, testHeader(), "abc", true, []byte("abcdef"), testHeader(), []string{}},
+		{"gzip", 200, 200, testHeader("Content-Encoding", "gzip"), string(gzipped("same")), false, []byte("same"), testHeader(),
+			[]string{`header Content-Encoding: "gzip" != ""`}},
+	}
+	for _, v := range cases {
+		e := &exchange{Response: capturedResponse{Status: v.status, Header: v.header, capturedBody: capturedBody{Body: v.body, Truncated: v.truncated}}}
+		diffs := r.diff(e, &http.Response{StatusCode: v.gotStatus, Header: v.gotHeader}, v.got)
+		if strings.Join(diffs, "\n") != strings.Join(v.diffs, "\n") {
+			t.Errorf("%s expect: %q, got: %q", v.name, v.diffs, diffs)
+		}
+	}
+}
+
+// go test -run ^TestReadCapture$ .
+func TestReadCapture(t *testing.T) {
+	exchanges := []*exchange{
+		{Time: testNow, Route: "api", Request: capturedRequest{Method: "GET", URL: "http://a/x?q=1", Header: testHeader("Accept", "*/*")},
+			Response: capturedResponse{Status: 200, Header: testHeader("Content-Type", "text/plain"), capturedBody: capturedBody{Body: "ok", Size: 2}}},
+		{Time: testNow.Add(time.Second), Request: capturedRequest{Method: "POST", URL: "http://a/y", Header: testHeader("Content-Type", "application/json"), capturedBody: capturedBody{Body: "{}", Size: 2}},
+			Response: capturedResponse{Status: 500, Header: testHeader()}},
+	}
+	dir := t.TempDir()
+	write := func(format string) string {
+		file := filepath.Join(dir, "capture."+format)
+		c, err := newCapturer(captureOption{File: file, Format: format, Sample: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range exchanges {
+			c.queue <- e
+		}
+		c.Close()
+		return file
+	}
+	ndjson, har := write("ndjson"), write("har")
+	// a har of a proxy killed before closing the entries
+	killed := filepath.Join(dir, "killed.har")
+	data, _ := os.ReadFile(har)
+	os.WriteFile(killed, bytes.TrimSuffix(data, []byte("\n]}}\n")), 0o644)
+
+	for _, file := range []string{ndjson, har, killed} {
+		got, err := readCapture(file)
+		if err != nil {
+			t.Errorf("%s expect: exchanges, got: %v", filepath.Base(file), err)
+			continue
+		}
+		if len(got) != len(exchanges) {
+			t.Errorf("%s expect: %d exchanges, got: %d", filepath.Base(file), len(exchanges), len(got))
+			continue
+		}
+		for i, e := range exchanges {
+			g := got[i]
+			if !g.Time.Equal(e.Time) || g.Route != e.Route || g.Request.Method != e.Request.Method || g.Request.URL != e.Request.URL ||
+				g.Request.Header.Get("Content-Type") != e.Request.Header.Get("Content-Type") || g.Request.Body != e.Request.Body ||
+				g.Response.Status != e.Response.Status || g.Response.Body != e.Response.Body {
+				t.Errorf("%s %d expect: %+v, got: %+v", filepath.Base(file), i, e, g)
+			}
+		}
+	}
+
+	bad := filepath.Join(dir, "bad.ndjson")
+	os.WriteFile(bad, []byte("{}\n\nnot json\n"), 0o644)
+	if _, err := readCapture(bad); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("bad line expect: line 3 error, got: %v", err)
+	}
+}
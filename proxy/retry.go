@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// retryBodyMax is the largest request body kept to be sent again, larger ones are sent once
+const retryBodyMax = 1 << 20
+
+var errTryTimeout = fmt.Errorf("upstream try timeout: %w", context.DeadlineExceeded)
+
+// upstreamOption holds the defaults of the upstream policy of the routes, set by flags
+type upstreamOption struct {
+	Timeout        time.Duration // whole upstream exchange, retries included, 0 is unlimited
+	TryTimeout     time.Duration // each try until the response headers, 0 is unlimited
+	ConnectTimeout time.Duration // each dial, 0 keeps the transport's
+	Retries        int           // tries after the first one, 0 disables
+	RetryOn        string        // comma separated connect-failure, reset, timeout, 5xx or status codes
+	Backoff        time.Duration // base of the exponential backoff with full jitter
+	MaxBackoff     time.Duration
+	BudgetRatio    float64 // retries and hedges allowed per request over the last 10s
+	BudgetMin      float64 // retries and hedges per second allowed regardless of the ratio
+	Hedge          bool    // hedge GET and HEAD requests to another backend
+	HedgeDelay     time.Duration
+}
+
+var upstreamOpt = upstreamOption{
+	Retries:     2,
+	RetryOn:     "connect-failure,502,503,504",
+	Backoff:     25 * time.Millisecond,
+	MaxBackoff:  500 * time.Millisecond,
+	BudgetRatio: 0.2,
+	BudgetMin:   10,
+}
+
+// retryConfig is the retry of a route in the yaml routing table
+type retryConfig struct {
+	Attempts   *int          `yaml:"attempts"`
+	On         []string      `yaml:"on"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// retryPolicy is the resolved upstream policy of a route
+type retryPolicy struct {
+	attempts   int
+	on         map[string]bool // connect-failure, reset, timeout, 5xx and status codes
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	tryTimeout     time.Duration
+	connectTimeout time.Duration
+	hedge          bool
+	hedgeDelay     time.Duration // 0 is the p95 latency of the route
+}
+
+func newRetryPolicy(rc *routeConfig) (retryPolicy, error) {
+	p := retryPolicy{
+		attempts:       upstreamOpt.Retries,
+		on:             map[string]bool{},
+		backoff:        upstreamOpt.Backoff,
+		maxBackoff:     upstreamOpt.MaxBackoff,
+		tryTimeout:     upstreamOpt.TryTimeout,
+		connectTimeout: upstreamOpt.ConnectTimeout,
+		hedge:          upstreamOpt.Hedge,
+		hedgeDelay:     upstreamOpt.HedgeDelay,
+	}
+	on := strings.Split(upstreamOpt.RetryOn, ",")
+	if c := rc.Retry; c != nil {
+		if c.Attempts != nil {
+			p.attempts = *c.Attempts
+		}
+		if c.On != nil {
+			on = c.On
+		}
+		if c.Backoff > 0 {
+			p.backoff = c.Backoff
+		}
+		if c.MaxBackoff > 0 {
+			p.maxBackoff = c.MaxBackoff
+		}
+	}
+	for _, v := range on {
+		v = strings.ToLower(strings.TrimSpace(v))
+		switch v {
+		case "":
+			continue
+		case "connect-failure", "reset", "timeout", "5xx":
+		default:
+			if code, err := strconv.Atoi(v); err != nil || code < 100 || code > 599 {
+				return p, fmt.Errorf("invalid retry on %q, want connect-failure, reset, timeout, 5xx or a status code", v)
+			}
+		}
+		p.on[v] = true
+	}
+	if p.attempts < 0 {
+		return p, fmt.Errorf("invalid retry attempts %d", p.attempts)
+	}
+	if rc.TryTimeout > 0 {
+		p.tryTimeout = rc.TryTimeout
+	}
+	if rc.ConnectTimeout > 0 {
+		p.connectTimeout = rc.ConnectTimeout
+	}
+	if rc.Hedge != nil {
+		p.hedge = *rc.Hedge
+	}
+	if rc.HedgeDelay > 0 {
+		p.hedgeDelay = rc.HedgeDelay
+	}
+	return p, nil
+}
+
+// retryOn reports whether a try failing for reason is retried
+func (p *retryPolicy) retryOn(reason string) bool {
+	if p.on[reason] {
+		return true
+	}
+	code, err := strconv.Atoi(reason)
+	return err == nil && code >= 500 && p.on["5xx"]
+}
+
+// delay is the backoff before retry n, counted from 1
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := p.backoff << (n - 1)
+	if d <= 0 || d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryBudget caps the retries and hedges of a route to a ratio of its requests
+// over the last 10 seconds plus a minimum per second, so retries don't pile onto a struggling pool
+type retryBudget struct {
+	ratio float64
+	min   float64
+
+	mu    sync.Mutex
+	slots [10]budgetSlot // by second
+}
+
+type budgetSlot struct {
+	sec               int64
+	requests, retries float64
+}
+
+func newRetryBudget(ratio, min float64) *retryBudget {
+	return &retryBudget{ratio: ratio, min: min}
+}
+
+// slot returns the slot of now, the caller holds mu
+func (b *retryBudget) slot(now time.Time) *budgetSlot {
+	sec := now.Unix()
+	s := &b.slots[sec%int64(len(b.slots))]
+	if s.sec != sec {
+		s.sec, s.requests, s.retries = sec, 0, 0
+	}
+	return s
+}
+
+func (b *retryBudget) request(now time.Time) {
+	b.mu.Lock()
+	b.slot(now).requests++
+	b.mu.Unlock()
+}
+
+// allow takes a retry from the budget if there is one left
+func (b *retryBudget) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.slot(now)
+	requests, retries := 0.0, 0.0
+	for _, v := range b.slots {
+		if now.Unix()-v.sec < int64(len(b.slots)) {
+			requests += v.requests
+			retries += v.retries
+		}
+	}
+	if retries >= b.min*float64(len(b.slots))+b.ratio*requests {
+		return false
+	}
+	s.retries++
+	return true
+}
+
+// latencyTracker keeps the recent times to response headers of a route for its p95
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [256]time.Duration
+	n       int
+	p95     atomic.Int64
+}
+
+// minLatencySamples is how many tries a route needs before its p95 is used
+const minLatencySamples = 20
+
+func (l *latencyTracker) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples[l.n%len(l.samples)] = d
+	l.n++
+	if l.n == minLatencySamples || l.n > minLatencySamples && l.n%16 == 0 {
+		n := l.n
+		if n > len(l.samples) {
+			n = len(l.samples)
+		}
+		sorted := append([]time.Duration(nil), l.samples[:n]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		l.p95.Store(int64(sorted[n*95/100]))
+	}
+}
+
+// percentile95 is 0 until the route has enough samples
+func (l *latencyTracker) percentile95() time.Duration {
+	return time.Duration(l.p95.Load())
+}
+
+type connectTimeoutKey struct{}
+
+// connectTimeout applies the connect timeout of the route in ctx to dial
+func connectTimeout(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if d, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// idempotent reports whether r may be sent twice, like net/http the Idempotency-Key
+// headers make any method so
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, key := r.Header["Idempotency-Key"]
+	_, xkey := r.Header["X-Idempotency-Key"]
+	return key || xkey
+}
+
+// rewindable buffers the body of r so it can be sent again, false if it is too large
+func rewindable(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return true
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, retryBodyMax+1))
+	if err != nil || len(data) > retryBodyMax {
+		// send what was read and the rest once, a client error surfaces again from the rest
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return false
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true
+}
+
+// tryReason is why a try failed, its status code if it got a response
+func tryReason(resp *http.Response, err error) string {
+	if err == nil {
+		return strconv.Itoa(resp.StatusCode)
+	}
+	if errors.Is(err, errTryTimeout) {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connect-failure"
+	}
+	return "reset"
+}
+
+func tryOutcome(resp *http.Response, err error) outcome {
+	switch {
+	case err != nil:
+		return outcomeFailed
+	case resp.StatusCode >= 500:
+		return outcomeServerError
+	}
+	return outcomeOK
+}
+
+// discard drains a little of a response not sent to the client so its connection may be reused
+func discard(resp *http.Response) {
+	if resp != nil {
+		io.CopyN(io.Discard, resp.Body, 4<<10)
+		resp.Body.Close()
+	}
+}
+
+// cancelBody cancels the context of its try when the response is done with
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type tryResult struct {
+	backend *upstream
+	resp    *http.Response
+	err     error
+	hedged  bool
+}
+
+// retryTransport retries failed tries of idempotent requests on other backends of the pool
+// and hedges slow GETs, the backend of the final try is left in the proxyState
+type retryTransport struct {
+	http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st := stateOf(req.Context())
+	rt := st.route
+	pol := &rt.retry
+	rt.budget.request(time.Now())
+
+	retry := pol.attempts > 0 && idempotent(req)
+	hedge := pol.hedge && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+	if (retry || hedge) && !rewindable(req) {
+		retry, hedge = false, false
+	}
+
+	tried := map[*upstream]bool{st.backend: true}
+	for n := 1; ; n++ {
+		res := t.try(req, st, tried, hedge)
+		reason := tryReason(res.resp, res.err)
+		if !retry || n > pol.attempts || !pol.retryOn(reason) || req.Context().Err() != nil {
+			return res.resp, res.err
+		}
+		if !rt.budget.allow(time.Now()) {
+			retryBudgetExhausted.WithLabelValues(rt.Name).Inc()
+			return res.resp, res.err
+		}
+		// another backend if the pool has one, else the same again
+		b, err := rt.pool.pick(req, tried)
+		if err != nil {
+			if b, err = rt.pool.pick(req, nil); err != nil {
+				return res.resp, res.err
+			}
+		}
+		discard(res.resp)
+		if res.err != nil {
+			upstreamErrors.WithLabelValues(rt.Name, st.backend.url.String(), "server").Inc()
+		}
+		rt.pool.done(st.backend, tryOutcome(res.resp, res.err))
+		upstreamRetries.WithLabelValues(rt.Name, reason).Inc()
+		slog.Warn("proxy retry",
+			slog.String("route", rt.Name),
+			slog.String("backend", st.backend.url.String()),
+			slog.String("reason", reason),
+			slog.String("next", b.url.String()),
+			slog.Int("retry", n),
+		)
+		trace.SpanFromContext(req.Context()).AddEvent("retry", trace.WithAttributes(
+			attribute.String("proxy.upstream", st.backend.url.Host),
+			attribute.String("proxy.retry.reason", reason),
+		))
+		st.setBackend(req.Context(), b)
+		tried[b] = true
+
+		if d := pol.delay(n); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+		}
+	}
+}
+
+// try sends req to the backend of st, and to another one too if hedge and it is slower than
+// the hedge delay. The first good response wins, the other try is canceled
+func (t *retryTransport) try(req *http.Request, st *proxyState, tried map[*upstream]bool, hedge bool) *tryResult {
+	rt := st.route
+	results := make(chan *tryResult, 2)
+	cancels := map[*upstream]context.CancelFunc{}
+	cancels[st.backend] = t.start(req, st.backend, rt, false, results)
+	pending := 1
+	hedged := false
+
+	var hedgeTimer <-chan time.Time
+	if hedge {
+		delay := rt.retry.hedgeDelay
+		if delay == 0 {
+			delay = rt.latency.percentile95()
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			hedgeTimer = timer.C
+		}
+	}
+
+	for {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			if !rt.budget.allow(time.Now()) {
+				retryBudgetExhausted.WithLabelValues(rt.Name).Inc()
+				continue
+			}
+			b, err := rt.pool.pick(req, tried)
+			if err != nil {
+				continue
+			}
+			tried[b] = true
+			cancels[b] = t.start(req, b, rt, true, results)
+			pending++
+			hedged = true
+			trace.SpanFromContext(req.Context()).AddEvent("hedge", trace.WithAttributes(
+				attribute.String("proxy.upstream", b.url.Host),
+			))
+		case res := <-results:
+			pending--
+			delete(cancels, res.backend)
+			if res.err != nil || rt.retry.retryOn(tryReason(res.resp, res.err)) {
+				if pending > 0 {
+					// the other try may still make it
+					discard(res.resp)
+					rt.pool.done(res.backend, tryOutcome(res.resp, res.err))
+					continue
+				}
+			}
+			// res is the answer, cancel the slower try
+			for b, cancel := range cancels {
+				cancel()
+				go func(b *upstream) {
+					loser := <-results
+					discard(loser.resp)
+					rt.pool.done(b, outcomeCanceled)
+				}(b)
+			}
+			if hedged && res.hedged {
+				upstreamHedges.WithLabelValues(rt.Name, "won").Inc()
+			} else if hedged {
+				upstreamHedges.WithLabelValues(rt.Name, "lost").Inc()
+			}
+			if res.backend != st.backend {
+				st.setBackend(req.Context(), res.backend)
+			}
+			return res
+		}
+	}
+}
+
+// start sends a clone of req to b, the result goes to results. The returned cancel aborts the try
+func (t *retryTransport) start(req *http.Request, b *upstream, rt *route, hedged bool, results chan<- *tryResult) context.CancelFunc {
+	ctx, cancel := context.WithCancel(req.Context())
+	if rt.retry.connectTimeout > 0 {
+		ctx = context.WithValue(ctx, connectTimeoutKey{}, rt.retry.connectTimeout)
+	}
+	out := req.Clone(ctx)
+	out.URL.Scheme, out.URL.Host = b.url.Scheme, b.url.Host
+	if req.GetBody != nil {
+		out.Body, _ = req.GetBody()
+	}
+
+	go func() {
+		var timedOut atomic.Bool
+		var timer *time.Timer
+		if rt.retry.tryTimeout > 0 {
+			timer = time.AfterFunc(rt.retry.tryTimeout, func() {
+				timedOut.Store(true)
+				cancel()
+			})
+		}
+		start := time.Now()
+		resp, err := t.RoundTripper.RoundTrip(out)
+		if timer != nil && !timer.Stop() && err == nil {
+			// the timeout fired as the headers came, the body is gone with the context
+			discard(resp)
+			resp, err = nil, errTryTimeout
+		}
+		if err != nil && timedOut.Load() {
+			err = errTryTimeout
+		}
+		if err != nil {
+			cancel()
+		} else {
+			rt.latency.observe(time.Since(start))
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		}
+		results <- &tryResult{backend: b, resp: resp, err: err, hedged: hedged}
+	}()
+	return cancel
+}
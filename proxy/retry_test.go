@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// go test -run ^TestRetryOn$ .
+func TestRetryOn(t *testing.T) {
+	three := 3
+	cases := []struct {
+		name    string
+		retry   *retryConfig
+		reason  string
+		retried bool
+	}{
+		{"default connect failure", nil, "connect-failure", true},
+		{"default 502", nil, "502", true},
+		{"default 500", nil, "500", false},
+		{"default reset", nil, "reset", false},
+		{"default timeout", nil, "timeout", false},
+		{"default 200", nil, "200", false},
+		{"5xx", &retryConfig{On: []string{"5xx"}}, "500", true},
+		{"5xx 599", &retryConfig{On: []string{"5xx"}}, "599", true},
+		{"5xx not 429", &retryConfig{On: []string{"5xx"}}, "429", false},
+		{"5xx not connect failure", &retryConfig{On: []string{"5xx"}}, "connect-failure", false},
+		{"status code", &retryConfig{On: []string{" 429 "}}, "429", true},
+		{"case", &retryConfig{On: []string{"Reset", "TIMEOUT"}}, "timeout", true},
+		{"empty on", &retryConfig{Attempts: &three, On: []string{}}, "connect-failure", false},
+	}
+	for _, v := range cases {
+		p, err := newRetryPolicy(&routeConfig{Retry: v.retry})
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if retry := p.retryOn(v.reason); retry != v.retried {
+			t.Errorf("%s %s expect: %v, got: %v", v.name, v.reason, v.retried, retry)
+		}
+	}
+
+	negative := -1
+	for _, rc := range []*retryConfig{{On: []string{"600"}}, {On: []string{"sometimes"}}, {Attempts: &negative}} {
+		if _, err := newRetryPolicy(&routeConfig{Retry: rc}); err == nil {
+			t.Errorf("%+v expect: error, got: nil", rc)
+		}
+	}
+}
+
+// go test -run ^TestRetryDelay$ .
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		backoff, maxBackoff time.Duration
+		n                   int
+		max                 time.Duration
+	}{
+		{25 * time.Millisecond, 500 * time.Millisecond, 1, 25 * time.Millisecond},
+		{25 * time.Millisecond, 500 * time.Millisecond, 3, 100 * time.Millisecond},
+		{25 * time.Millisecond, 500 * time.Millisecond, 6, 500 * time.Millisecond},
+		{25 * time.Millisecond, 500 * time.Millisecond, 100, 500 * time.Millisecond}, // the shift overflows
+		{0, 500 * time.Millisecond, 1, 500 * time.Millisecond},
+		{0, 0, 2, 0},
+	}
+	for _, v := range cases {
+		p := &retryPolicy{backoff: v.backoff, maxBackoff: v.maxBackoff}
+		var longest time.Duration
+		for i := 0; i < 1000; i++ {
+			d := p.delay(v.n)
+			if d < 0 || d > v.max {
+				t.Fatalf("%v %v %d expect: [0, %v], got: %v", v.backoff, v.maxBackoff, v.n, v.max, d)
+			}
+			if d > longest {
+				longest = d
+			}
+		}
+		// full jitter spreads over the whole range
+		if longest < v.max/2 {
+			t.Errorf("%v %v %d expect: up to %v, got: at most %v", v.backoff, v.maxBackoff, v.n, v.max, longest)
+		}
+	}
+}
+
+// go test -run ^TestRetryBudget$ .
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		name     string
+		at       time.Duration // after now
+		requests int
+		allowed  int // of 100 retries asked
+	}{
+		{"min only", 0, 0, 10},                     // 1/s over 10s
+		{"spent", time.Second, 0, 0},               // same window
+		{"ratio", 2 * time.Second, 100, 20},        // 0.2 of the requests
+		{"window slides", 11 * time.Second, 0, 10}, // the first retries left the window
+		{"requests slide", 13 * time.Second, 0, 0}, // the requests left with their retries
+		{"slot reused", 21 * time.Second, 50, 20},  // 10 + 0.2*50, the slot of 11s starts over
+	}
+	b := newRetryBudget(0.2, 1)
+	for _, v := range cases {
+		at := now.Add(v.at)
+		for i := 0; i < v.requests; i++ {
+			b.request(at)
+		}
+		allowed := 0
+		for i := 0; i < 100; i++ {
+			if b.allow(at) {
+				allowed++
+			}
+		}
+		if allowed != v.allowed {
+			t.Errorf("%s expect: %d, got: %d", v.name, v.allowed, allowed)
+		}
+	}
+}
+
+// go test -run ^TestIdempotent$ .
+func TestIdempotent(t *testing.T) {
+	cases := []struct {
+		method, header string
+		idempotent     bool
+	}{
+		{"GET", "", true},
+		{"PUT", "", true},
+		{"DELETE", "", true},
+		{"POST", "", false},
+		{"PATCH", "", false},
+		{"POST", "Idempotency-Key", true},
+		{"PATCH", "X-Idempotency-Key", true},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, "/", nil)
+		if v.header != "" {
+			r.Header.Set(v.header, "k1")
+		}
+		if idempotent := idempotent(r); idempotent != v.idempotent {
+			t.Errorf("%s %s expect: %v, got: %v", v.method, v.header, v.idempotent, idempotent)
+		}
+	}
+}
+
+// go test -run ^TestRetryTransport$ .
+func TestRetryTransport(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+	status := func(codes ...int) func(n int, w http.ResponseWriter, r *http.Request) {
+		// the status of the nth try, the last one after that
+		return func(n int, w http.ResponseWriter, r *http.Request) {
+			if n > len(codes) {
+				n = len(codes)
+			}
+			w.WriteHeader(codes[n-1])
+			fmt.Fprint(w, codes[n-1])
+		}
+	}
+	slow := func(n int, w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, "slow")
+	}
+
+	cases := []struct {
+		name     string
+		route    string
+		backends []func(n int, w http.ResponseWriter, r *http.Request) // nil is a backend refusing connections
+		method   string
+		status   int
+		hits     []int32
+		fails    []int64
+	}{
+		{"retry on the next backend", "retry: {attempts: 2, on: [502], backoff: 1ms}",
+			[]func(int, http.ResponseWriter, *http.Request){status(502), status(200)}, "GET", 200, []int32{1, 1}, []int64{0, 0}},
+		{"retry the only backend", "retry: {attempts: 2, on: [502], backoff: 1ms}",
+			[]func(int, http.ResponseWriter, *http.Request){status(502, 200)}, "GET", 200, []int32{2}, []int64{0}},
+		{"post not retried", "retry: {attempts: 2, on: [502], backoff: 1ms}",
+			[]func(int, http.ResponseWriter, *http.Request){status(502, 200)}, "POST", 502, []int32{1}, []int64{0}},
+		{"attempts exhausted", "retry: {attempts: 2, on: [5xx], backoff: 1ms}",
+			[]func(int, http.ResponseWriter, *http.Request){status(503)}, "GET", 503, []int32{3}, []int64{0}},
+		{"connect failure", "retry: {backoff: 1ms}",
+			[]func(int, http.ResponseWriter, *http.Request){nil, status(200)}, "GET", 200, []int32{0, 1}, []int64{1, 0}},
+		{"hedge", "hedge: true\n    hedge_delay: 20ms\n    retry: {attempts: 0}",
+			[]func(int, http.ResponseWriter, *http.Request){slow, status(200)}, "GET", 200, []int32{1, 1}, []int64{0, 0}},
+	}
+	for _, v := range cases {
+		hits := make([]int32, len(v.backends))
+		pool := "pools:\n  p:\n    backends:\n"
+		for i, handler := range v.backends {
+			if handler == nil {
+				pool += "      - url: http://" + dead.Addr().String() + "\n"
+				continue
+			}
+			i, handler := i, handler
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler(int(atomic.AddInt32(&hits[i], 1)), w, r)
+			}))
+			defer upstream.Close()
+			pool += "      - url: " + upstream.URL + "\n"
+		}
+		rr, err := testRouter(t, pool+"routes:\n  - name: r\n    pool: p\n    "+v.route+"\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		currentRouter.Store(rr)
+		srv := httptest.NewServer(http.HandlerFunc(proxy))
+		defer srv.Close()
+
+		start := time.Now()
+		r, _ := http.NewRequest(v.method, srv.URL+"/", nil)
+		rsp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != v.status {
+			t.Errorf("%s expect: %d, got: %d", v.name, v.status, rsp.StatusCode)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s expect: answered by the fast backend, got: %v", v.name, d)
+		}
+
+		// the losing hedge is finished in the background
+		backends := rr.pools["p"].backends
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			inFlight := int64(0)
+			for _, b := range backends {
+				inFlight += b.conns.Load()
+			}
+			if inFlight == 0 {
+				break
+			}
+		}
+		for i, b := range backends {
+			if n := atomic.LoadInt32(&hits[i]); n != v.hits[i] || b.conns.Load() != 0 || b.fails.Load() != v.fails[i] {
+				t.Errorf("%s backend %d expect: %d hits 0 in flight %d fails, got: %d %d %d", v.name, i, v.hits[i], v.fails[i], n, b.conns.Load(), b.fails.Load())
+			}
+		}
+	}
+}
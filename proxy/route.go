@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPoolName is the pool of the -b backends, routes without a pool use it
+const defaultPoolName = "default"
+
+// routesConfig is the yaml routing table:
+//
+//	pools:
+//	  web:
+//	    backends:
+//	      - url: http://10.0.0.1:9000
+//	        weight: 2
+//	      - url: http://10.0.0.2:9000
+//	    strategy: least-conn
+//	    health_path: /healthz
+//	    circuit_fails: 5
+//	    max_conns: 100
+//	routes:
+//	  - name: api
+//	    host: api.example.com          # exact or *.example.com
+//	    path_prefix: /api/
+//	    path_regex: ^/api/v[0-9]+/
+//	    methods: [GET, POST]
+//	    headers: {X-Canary: "1"}       # exact value, * for any
+//	    pool: web
+//	    strip_prefix: /api
+//	    rewrite: {regex: ^/v1/(.*), replace: /$1}
+//	    request_headers: {add: {X-Env: prod}, remove: [Cookie]}
+//	    response_headers: {remove: [Server]}
+//	    timeout: 10s                   # whole upstream exchange, retries included
+//	    try_timeout: 2s                # each try until the response headers
+//	    connect_timeout: 500ms
+//	    retry: {attempts: 2, on: [connect-failure, reset, timeout, 502, 503, 504], backoff: 25ms, max_backoff: 500ms}
+//	    hedge: true                    # GETs go to a second backend too if slower than
+//	    hedge_delay: 200ms             # or the p95 of the route if 0
+//
+// routes are matched in order, the first match wins
+type routesConfig struct {
+	Pools  map[string]poolConfig `yaml:"pools"`
+	Routes []routeConfig         `yaml:"routes"`
+}
+
+type poolConfig struct {
+	Backends []struct {
+		URL    string `yaml:"url"`
+		Weight int    `yaml:"weight"`
+	} `yaml:"backends"`
+	Strategy       string        `yaml:"strategy"`
+	HashKey        string        `yaml:"hash_key"`
+	HealthPath     string        `yaml:"health_path"`
+	HealthInterval time.Duration `yaml:"health_interval"`
+	HealthTimeout  time.Duration `yaml:"health_timeout"`
+	MaxFails       *int          `yaml:"max_fails"`
+	FailTimeout    time.Duration `yaml:"fail_timeout"`
+	CircuitFails   *int          `yaml:"circuit_fails"`
+	CircuitCool    time.Duration `yaml:"circuit_cooldown"`
+	MaxConns       int64         `yaml:"max_conns"`
+}
+
+type headerRules struct {
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+}
+
+func (h *headerRules) apply(header http.Header) {
+	for _, k := range h.Remove {
+		header.Del(k)
+	}
+	for k, v := range h.Add {
+		header.Set(k, v)
+	}
+}
+
+type routeConfig struct {
+	Name        string            `yaml:"name"`
+	Host        string            `yaml:"host"`
+	PathPrefix  string            `yaml:"path_prefix"`
+	PathRegex   string            `yaml:"path_regex"`
+	Methods     []string          `yaml:"methods"`
+	Headers     map[string]string `yaml:"headers"`
+	Pool        string            `yaml:"pool"`
+	StripPrefix string            `yaml:"strip_prefix"`
+	Rewrite     *struct {
+		Regex   string `yaml:"regex"`
+		Replace string `yaml:"replace"`
+	} `yaml:"rewrite"`
+	RequestHeaders  headerRules   `yaml:"request_headers"`
+	ResponseHeaders headerRules   `yaml:"response_headers"`
+	Timeout         time.Duration `yaml:"timeout"`
+	Cache           *bool         `yaml:"cache"` // false keeps the route out of the -cache cache
+	Retry           *retryConfig  `yaml:"retry"`
+	TryTimeout      time.Duration `yaml:"try_timeout"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+	Hedge           *bool         `yaml:"hedge"`
+	HedgeDelay      time.Duration `yaml:"hedge_delay"` // 0 is the p95 latency of the route
+}
+
+type route struct {
+	routeConfig
+	pathRegex    *regexp.Regexp
+	rewriteRegex *regexp.Regexp
+	pool         *pool
+	retry        retryPolicy
+	budget       *retryBudget
+	latency      *latencyTracker
+}
+
+// match reports whether r is for this route
+func (rt *route) match(r *http.Request) bool {
+	if rt.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(rt.Host, "*"); ok {
+			if !strings.HasSuffix(host, suffix) {
+				return false
+			}
+		} else if host != rt.Host {
+			return false
+		}
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.pathRegex != nil && !rt.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.Methods) > 0 {
+		found := false
+		for _, m := range rt.Methods {
+			if m == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range rt.Headers {
+		values := r.Header.Values(k)
+		if len(values) == 0 || v != "*" && values[0] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// rewritePath applies strip_prefix and rewrite to the upstream path
+func (rt *route) rewritePath(p string) string {
+	if rt.StripPrefix != "" {
+		p = strings.TrimPrefix(p, rt.StripPrefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	if rt.rewriteRegex != nil {
+		p = rt.rewriteRegex.ReplaceAllString(p, rt.Rewrite.Replace)
+	}
+	return p
+}
+
+// router is one generation of the routing table, replaced as a whole on reload
+type router struct {
+	routes []*route
+	pools  map[string]*pool
+	cancel context.CancelFunc // stops the health checks of the pools
+}
+
+var currentRouter atomic.Pointer[router]
+
+func (rr *router) match(r *http.Request) *route {
+	for _, rt := range rr.routes {
+		if rt.match(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// loadRouter builds the routes of file, or a single catch all route to the -b pool without file
+func loadRouter(file string) (*router, error) {
+	cfg := &routesConfig{}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read routes err: %w", err)
+		}
+		if err := yaml.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("decode routes %s err: %w", file, err)
+		}
+	}
+	if len(cfg.Routes) == 0 {
+		cfg.Routes = []routeConfig{{Name: "default"}}
+	}
+
+	rr := &router{pools: map[string]*pool{}}
+	if _, ok := cfg.Pools[defaultPoolName]; !ok {
+		backends, err := parseBackends(backend)
+		if err != nil {
+			return nil, err
+		}
+		if rr.pools[defaultPoolName], err = newPool(backends, poolOpt); err != nil {
+			return nil, err
+		}
+	}
+	for name, pc := range cfg.Pools {
+		p, err := pc.pool()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		rr.pools[name] = p
+	}
+
+	for i, rc := range cfg.Routes {
+		if rc.Name == "" {
+			rc.Name = fmt.Sprintf("route-%d", i)
+		}
+		rt := &route{routeConfig: rc}
+		rt.Host = strings.ToLower(rt.Host)
+		if rc.Pool == "" {
+			rc.Pool = defaultPoolName
+		}
+		if rt.pool = rr.pools[rc.Pool]; rt.pool == nil {
+			return nil, fmt.Errorf("route %s: unknown pool %q", rc.Name, rc.Pool)
+		}
+		var err error
+		if rc.PathRegex != "" {
+			if rt.pathRegex, err = regexp.Compile(rc.PathRegex); err != nil {
+				return nil, fmt.Errorf("route %s: invalid path_regex: %w", rc.Name, err)
+			}
+		}
+		if rc.Rewrite != nil {
+			if rt.rewriteRegex, err = regexp.Compile(rc.Rewrite.Regex); err != nil {
+				return nil, fmt.Errorf("route %s: invalid rewrite regex: %w", rc.Name, err)
+			}
+		}
+		if rt.Timeout == 0 {
+			rt.Timeout = upstreamOpt.Timeout
+		}
+		if rt.retry, err = newRetryPolicy(&rc); err != nil {
+			return nil, fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+		rt.budget = newRetryBudget(upstreamOpt.BudgetRatio, upstreamOpt.BudgetMin)
+		rt.latency = &latencyTracker{}
+		for i, m := range rt.Methods {
+			rt.Methods[i] = strings.ToUpper(m)
+		}
+		rr.routes = append(rr.routes, rt)
+	}
+	return rr, nil
+}
+
+func (pc *poolConfig) pool() (*pool, error) {
+	if len(pc.Backends) == 0 {
+		return nil, errors.New("no backend")
+	}
+	backends := []*upstream{}
+	for _, v := range pc.Backends {
+		b, err := newBackend(v.URL, v.Weight)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	opt := poolOption{
+		Strategy:       pc.Strategy,
+		HashKey:        pc.HashKey,
+		HealthPath:     pc.HealthPath,
+		HealthInterval: pc.HealthInterval,
+		HealthTimeout:  pc.HealthTimeout,
+		MaxFails:       poolOpt.MaxFails,
+		FailTimeout:    pc.FailTimeout,
+		CircuitFails:   poolOpt.CircuitFails,
+		CircuitCool:    pc.CircuitCool,
+		MaxConns:       pc.MaxConns,
+	}
+	if opt.HashKey == "" {
+		opt.HashKey = "ip"
+	}
+	if pc.MaxFails != nil {
+		opt.MaxFails = *pc.MaxFails
+	}
+	if pc.CircuitFails != nil {
+		opt.CircuitFails = *pc.CircuitFails
+	}
+	return newPool(backends, opt)
+}
+
+// start runs the health checks of the pools until the router is replaced
+func (rr *router) start(client *http.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rr.cancel = cancel
+	for _, p := range rr.pools {
+		go p.healthCheck(ctx, client)
+	}
+}
+
+// reloadRoutes swaps in the routes of file, keeping the current ones on error
+func reloadRoutes(file string, client *http.Client) error {
+	rr, err := loadRouter(file)
+	if err != nil {
+		return err
+	}
+	rr.start(client)
+	if old := currentRouter.Swap(rr); old != nil {
+		old.cancel()
+	}
+	slog.Info("routes loaded",
+		slog.String("file", file),
+		slog.Int("routes", len(rr.routes)),
+		slog.Int("pools", len(rr.pools)),
+	)
+	return nil
+}
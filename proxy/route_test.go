@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRouter loads the routes of the yaml
+func testRouter(t *testing.T, routes string) (*router, error) {
+	file := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(file, []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return loadRouter(file)
+}
+
+// go test -run ^TestLoadRouter$ .
+func TestLoadRouter(t *testing.T) {
+	cases := []struct {
+		name   string
+		routes string
+		err    string
+		names  []string
+	}{
+		{"no routes", "", "", []string{"default"}},
+		{"default names", "routes:\n  - path_prefix: /a\n  - name: b\n  - {}\n", "", []string{"route-0", "b", "route-2"}},
+		{"pool", "pools:\n  web:\n    backends:\n      - url: http://10.0.0.1:80\nroutes:\n  - pool: web\n", "", []string{"route-0"}},
+		{"invalid yaml", "routes: [", "decode routes", nil},
+		{"unknown pool", "routes:\n  - name: a\n    pool: web\n", `route a: unknown pool "web"`, nil},
+		{"pool without backend", "pools:\n  web: {}\nroutes:\n  - pool: web\n", "pool web: no backend", nil},
+		{"invalid backend", "pools:\n  web:\n    backends:\n      - url: ://x\n", "pool web", nil},
+		{"invalid path regex", "routes:\n  - name: a\n    path_regex: '['\n", "route a: invalid path_regex", nil},
+		{"invalid rewrite", "routes:\n  - name: a\n    rewrite: {regex: '(', replace: /}\n", "route a: invalid rewrite regex", nil},
+	}
+	for _, v := range cases {
+		rr, err := testRouter(t, v.routes)
+		if v.err != "" {
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("%s expect: %q error, got: %v", v.name, v.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s expect: no error, got: %v", v.name, err)
+			continue
+		}
+		names := []string{}
+		for _, rt := range rr.routes {
+			names = append(names, rt.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(v.names) {
+			t.Errorf("%s expect: %v, got: %v", v.name, v.names, names)
+		}
+	}
+}
+
+// go test -run ^TestRouteMatch$ .
+func TestRouteMatch(t *testing.T) {
+	rr, err := testRouter(t, `routes:
+  - name: canary
+    headers: {X-Canary: "1"}
+  - name: api
+    host: API.example.com
+    path_prefix: /api/
+    methods: [get, post]
+  - name: versioned
+    host: "*.example.com"
+    path_regex: ^/v[0-9]+/
+  - name: any-debug
+    headers: {X-Debug: "*"}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method string
+		url    string
+		header []string
+		route  string
+	}{
+		{"GET", "http://api.example.com/api/users", nil, "api"},
+		{"POST", "http://api.example.com:8080/api/users", nil, "api"},
+		{"DELETE", "http://api.example.com/api/users", nil, ""},
+		{"GET", "http://api.example.com/apix", nil, ""},
+		{"GET", "http://api.example.com/api/users", []string{"X-Canary", "1"}, "canary"},
+		{"GET", "http://api.example.com/api/users", []string{"X-Canary", "2"}, "api"},
+		{"GET", "http://www.example.com/v2/users", nil, "versioned"},
+		{"GET", "http://www.example.com/users/v2/", nil, ""},
+		{"GET", "http://example.org/v2/users", nil, ""},
+		{"GET", "http://example.org/", []string{"X-Debug", ""}, "any-debug"},
+		{"GET", "http://example.org/", []string{"X-Debug", "on"}, "any-debug"},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, v.url, nil)
+		if v.header != nil {
+			r.Header.Set(v.header[0], v.header[1])
+		}
+		name := ""
+		if rt := rr.match(r); rt != nil {
+			name = rt.Name
+		}
+		if name != v.route {
+			t.Errorf("%s %s %v expect: %q, got: %q", v.method, v.url, v.header, v.route, name)
+		}
+	}
+}
+
+// go test -run ^TestRewritePath$ .
+func TestRewritePath(t *testing.T) {
+	rr, err := testRouter(t, `routes:
+  - name: strip
+    strip_prefix: /api
+  - name: rewrite
+    rewrite: {regex: ^/v1/(.*), replace: /$1}
+  - name: both
+    strip_prefix: /api/
+    rewrite: {regex: ^/old/, replace: /new/}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := map[string]*route{}
+	for _, rt := range rr.routes {
+		routes[rt.Name] = rt
+	}
+	cases := []struct {
+		route    string
+		path     string
+		expected string
+	}{
+		{"strip", "/api/users", "/users"},
+		{"strip", "/api", "/"},
+		{"strip", "/apiusers", "/users"},
+		{"strip", "/other", "/other"},
+		{"rewrite", "/v1/users/1", "/users/1"},
+		{"rewrite", "/v2/users", "/v2/users"},
+		{"both", "/api/old/a", "/new/a"},
+		{"both", "/api/a", "/a"},
+	}
+	for _, v := range cases {
+		if path := routes[v.route].rewritePath(v.path); path != v.expected {
+			t.Errorf("%s %s expect: %s, got: %s", v.route, v.path, v.expected, path)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsOption struct {
+	Addr     string // https listen address, empty disables tls
+	Cert     string // default certificate file
+	Key      string
+	SNICerts string // comma separated host=cert.pem:key.pem, host may be *.example.com
+	Redirect bool   // redirect plain http requests to https
+	HTTP3    bool   // serve http/3 on the udp port of Addr
+
+	ACMEDomains string // comma separated domains to get certificates for, empty disables acme
+	ACMEDir     string // acme directory url, let's encrypt if empty
+	ACMECA      string // ca file to trust for the acme directory, e.g. the pebble minica
+	ACMEEmail   string
+	ACMECache   string // directory keeping the account and certificates
+
+	UpstreamCert     string // client certificate for backends, mtls
+	UpstreamKey      string
+	UpstreamCA       string // ca file to verify backends with instead of the system pool
+	UpstreamInsecure bool   // skip verifying backend certificates
+}
+
+var tlsOpt = tlsOption{ACMECache: "acme-cache"}
+
+// certStore picks the certificate of a tls handshake by sni
+type certStore struct {
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate // keyed by the suffix after *.
+	fallback *tls.Certificate
+	acme     *autocert.Manager
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s err: %w", certFile, err)
+	}
+	return &cert, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca err: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate in ca file %s", file)
+	}
+	return pool, nil
+}
+
+func newCertStore(opt *tlsOption) (*certStore, error) {
+	s := &certStore{
+		exact:    map[string]*tls.Certificate{},
+		wildcard: map[string]*tls.Certificate{},
+	}
+	if opt.Cert != "" {
+		cert, err := loadCert(opt.Cert, opt.Key)
+		if err != nil {
+			return nil, err
+		}
+		s.fallback = cert
+	}
+	for _, item := range strings.Split(opt.SNICerts, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		host, files, _ := strings.Cut(item, "=")
+		certFile, keyFile, ok := strings.Cut(files, ":")
+		if host == "" || !ok {
+			return nil, fmt.Errorf("invalid sni certificate %q, want host=cert.pem:key.pem", item)
+		}
+		cert, err := loadCert(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		host = strings.ToLower(host)
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			s.wildcard[suffix] = cert
+		} else {
+			s.exact[host] = cert
+		}
+	}
+
+	if opt.ACMEDomains != "" {
+		domains := []string{}
+		for _, v := range strings.Split(opt.ACMEDomains, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				domains = append(domains, v)
+			}
+		}
+		client := &acme.Client{DirectoryURL: opt.ACMEDir}
+		if opt.ACMECA != "" {
+			pool, err := loadCertPool(opt.ACMECA)
+			if err != nil {
+				return nil, err
+			}
+			client.HTTPClient = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			}}
+		}
+		s.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(opt.ACMECache),
+			Email:      opt.ACMEEmail,
+			Client:     client,
+		}
+	}
+
+	if s.fallback == nil && len(s.exact) == 0 && len(s.wildcard) == 0 && s.acme == nil {
+		return nil, errors.New("tls requires a certificate, sni certificates or acme domains")
+	}
+	return s, nil
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if s.acme != nil {
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				// tls-alpn-01 challenge
+				return s.acme.GetCertificate(hello)
+			}
+		}
+	}
+	if cert := s.exact[name]; cert != nil {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert := s.wildcard[parent]; cert != nil {
+			return cert, nil
+		}
+	}
+	if s.acme != nil && name != "" {
+		if err := s.acme.HostPolicy(hello.Context(), name); err == nil {
+			return s.acme.GetCertificate(hello)
+		}
+	}
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", name)
+}
+
+func (s *certStore) tlsConfig() *tls.Config {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if s.acme != nil {
+		conf.NextProtos = append(conf.NextProtos, acme.ALPNProto)
+	}
+	return conf
+}
+
+// plainHandler is the handler of the plain http listener when tls is on,
+// it answers acme http-01 challenges and redirects to https if redirect
+func (s *certStore) plainHandler(next http.Handler, redirect bool) http.Handler {
+	if redirect {
+		next = http.HandlerFunc(redirectHTTPS)
+	}
+	if s.acme != nil {
+		return s.acme.HTTPHandler(next)
+	}
+	return next
+}
+
+func redirectHTTPS(rw http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if _, port, err := net.SplitHostPort(tlsOpt.Addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // ipv6
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// keep the method and body
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		return
+	}
+	http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// upstreamTLSConfig is the tls config of defaultTransport, nil keeps go's default
+func upstreamTLSConfig(opt *tlsOption) (*tls.Config, error) {
+	if opt.UpstreamCert == "" && opt.UpstreamCA == "" && !opt.UpstreamInsecure {
+		return nil, nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: opt.UpstreamInsecure}
+	if opt.UpstreamCert != "" {
+		cert, err := loadCert(opt.UpstreamCert, opt.UpstreamKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{*cert}
+	}
+	if opt.UpstreamCA != "" {
+		pool, err := loadCertPool(opt.UpstreamCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert writes a self signed certificate for cn to dir, returning the cert and key files
+func testCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, cn+".pem"), filepath.Join(dir, cn+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// go test -run ^TestGetCertificate$ .
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certs := map[string][2]string{}
+	for _, cn := range []string{"default", "a", "wild"} {
+		cert, key := testCert(t, dir, cn)
+		certs[cn] = [2]string{cert, key}
+	}
+	sni := "A.example.com=" + certs["a"][0] + ":" + certs["a"][1] + ", *.wild.com=" + certs["wild"][0] + ":" + certs["wild"][1]
+
+	if _, err := newCertStore(&tlsOption{}); err == nil {
+		t.Errorf("no certificate expect: error, got: nil")
+	}
+	if _, err := newCertStore(&tlsOption{SNICerts: "a.example.com=" + certs["a"][0]}); err == nil || !strings.Contains(err.Error(), "invalid sni certificate") {
+		t.Errorf("no key expect: invalid sni certificate, got: %v", err)
+	}
+	withFallback, err := newCertStore(&tlsOption{Cert: certs["default"][0], Key: certs["default"][1], SNICerts: sni})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniOnly, err := newCertStore(&tlsOption{SNICerts: sni})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		store    *certStore
+		name     string
+		expected string // common name, empty for an error
+	}{
+		{withFallback, "a.example.com", "a"},
+		{withFallback, "A.Example.COM.", "a"},
+		{withFallback, "x.wild.com", "wild"},
+		{withFallback, "y.x.wild.com", "default"},
+		{withFallback, "wild.com", "default"},
+		{withFallback, "", "default"},
+		{sniOnly, "x.wild.com", "wild"},
+		{sniOnly, "b.example.com", ""},
+	}
+	for _, v := range cases {
+		cert, err := v.store.getCertificate(&tls.ClientHelloInfo{ServerName: v.name})
+		got := ""
+		if err == nil {
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+			got = leaf.Subject.CommonName
+		}
+		if got != v.expected {
+			t.Errorf("%q expect: %q, got: %q %v", v.name, v.expected, got, err)
+		}
+	}
+}
+
+// go test -run ^TestRedirectHTTPS$ .
+func TestRedirectHTTPS(t *testing.T) {
+	addr := tlsOpt.Addr
+	defer func() { tlsOpt.Addr = addr }()
+	cases := []struct {
+		addr     string
+		method   string
+		url      string
+		status   int
+		location string
+	}{
+		{":443", "GET", "http://example.com/a?b=1", http.StatusMovedPermanently, "https://example.com/a?b=1"},
+		{":443", "HEAD", "http://example.com:8080/a", http.StatusMovedPermanently, "https://example.com/a"},
+		{":8443", "GET", "http://example.com/a", http.StatusMovedPermanently, "https://example.com:8443/a"},
+		{"0.0.0.0:8443", "GET", "http://example.com:80/", http.StatusMovedPermanently, "https://example.com:8443/"},
+		{":443", "POST", "http://example.com/a", http.StatusPermanentRedirect, "https://example.com/a"},
+		{":443", "GET", "http://[::1]:80/a", http.StatusMovedPermanently, "https://[::1]/a"},
+		{":443", "GET", "http://[::1]/a", http.StatusMovedPermanently, "https://[::1]/a"},
+		{":8443", "GET", "http://[::1]/a", http.StatusMovedPermanently, "https://[::1]:8443/a"},
+	}
+	for _, v := range cases {
+		tlsOpt.Addr = v.addr
+		rw := httptest.NewRecorder()
+		redirectHTTPS(rw, httptest.NewRequest(v.method, v.url, nil))
+		if rw.Code != v.status || rw.Header().Get("Location") != v.location {
+			t.Errorf("%s %s %s expect: %d %s, got: %d %s", v.addr, v.method, v.url, v.status, v.location, rw.Code, rw.Header().Get("Location"))
+		}
+	}
+}
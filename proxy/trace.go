@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"golang.org/x/exp/slog"
+)
+
+// traceOption follows the OTEL_* environment variables of the opentelemetry sdk spec,
+// the flags are named after them so envflag reads the variables too
+type traceOption struct {
+	Exporter     string // otlp, jaeger, console or none
+	Protocol     string // otlp protocol: grpc or http/protobuf
+	Endpoint     string // otlp collector, e.g. http://collector:4317, empty for the exporter default
+	Sampler      string // always_on, always_off, traceidratio or parentbased_*
+	SamplerArg   string // sampling ratio of the traceidratio samplers
+	ResourceAttr string // comma separated key=value resource attributes
+}
+
+var traceOpt = traceOption{
+	Exporter:   "otlp",
+	Protocol:   "grpc",
+	Sampler:    "parentbased_traceidratio",
+	SamplerArg: "1",
+}
+
+// legacyTraceExporter keeps sending spans to jaeger when -tp is set without -otel-traces-exporter,
+// as before otlp became the default exporter
+func legacyTraceExporter(opt *traceOption) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["tp"] || set["otel-traces-exporter"] {
+		return
+	}
+	opt.Exporter = "jaeger"
+	slog.Warn("the jaeger exporter is deprecated, -tp alone will stop selecting it, set -otel-traces-exporter",
+		slog.String("tp", provider),
+	)
+}
+
+// newExporter returns nil for exporter none
+func newExporter(ctx context.Context, opt *traceOption) (tracesdk.SpanExporter, error) {
+	switch opt.Exporter {
+	case "otlp":
+	case "jaeger":
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(provider)))
+	case "console":
+		return stdouttrace.New()
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", opt.Exporter)
+	}
+
+	var u *url.URL
+	if opt.Endpoint != "" {
+		var err error
+		if u, err = url.Parse(opt.Endpoint); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid otlp endpoint %q, want http(s)://host:port", opt.Endpoint)
+		}
+	}
+	switch opt.Protocol {
+	case "grpc":
+		opts := []otlptracegrpc.Option{}
+		if u != nil {
+			opts = append(opts, otlptracegrpc.WithEndpoint(u.Host))
+			if u.Scheme == "http" {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http/protobuf":
+		opts := []otlptracehttp.Option{}
+		if u != nil {
+			// the endpoint is the base url of all signals
+			opts = append(opts,
+				otlptracehttp.WithEndpoint(u.Host),
+				otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/")+"/v1/traces"),
+			)
+			if u.Scheme == "http" {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unknown otlp protocol %q, want grpc or http/protobuf", opt.Protocol)
+}
+
+func newSampler(opt *traceOption) (tracesdk.Sampler, error) {
+	ratio := 1.0
+	if opt.SamplerArg != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(opt.SamplerArg, 64); err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid sampler ratio %q, want 0 to 1", opt.SamplerArg)
+		}
+	}
+	switch opt.Sampler {
+	case "always_on":
+		return tracesdk.AlwaysSample(), nil
+	case "always_off":
+		return tracesdk.NeverSample(), nil
+	case "traceidratio":
+		return tracesdk.TraceIDRatioBased(ratio), nil
+	case "parentbased_always_on":
+		return tracesdk.ParentBased(tracesdk.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return tracesdk.ParentBased(tracesdk.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return tracesdk.ParentBased(tracesdk.TraceIDRatioBased(ratio)), nil
+	}
+	return nil, fmt.Errorf("unknown sampler %q", opt.Sampler)
+}
+
+// parseResourceAttr parses OTEL_RESOURCE_ATTRIBUTES, key1=value1,key2=value2 with url encoded values
+func parseResourceAttr(s string) ([]attribute.KeyValue, error) {
+	attrs := []attribute.KeyValue{}
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid resource attribute %q, want key=value", item)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource attribute %q: %w", item, err)
+		}
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return attrs, nil
+}
+
+// tracerProvider returns a provider without exporter for exporter none, the spans still
+// carry the trace context to the backends
+func tracerProvider(ctx context.Context, opt *traceOption) (*tracesdk.TracerProvider, error) {
+	sampler, err := newSampler(opt)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := parseResourceAttr(opt.ResourceAttr)
+	if err != nil {
+		return nil, err
+	}
+	// the service name flag wins over a service.name resource attribute
+	attrs = append(attrs, semconv.ServiceNameKey.String(serviceName))
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithAttributes(attrs...),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("trace resource err: %w", err)
+	}
+
+	exporter, err := newExporter(ctx, opt)
+	if err != nil {
+		return nil, fmt.Errorf("trace exporter err: %w", err)
+	}
+	opts := []tracesdk.TracerProviderOption{
+		tracesdk.WithSampler(sampler),
+		tracesdk.WithResource(res),
+	}
+	if exporter != nil {
+		opts = append(opts, tracesdk.WithBatcher(exporter))
+	}
+	return tracesdk.NewTracerProvider(opts...), nil
+}
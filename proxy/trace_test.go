@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// go test -run ^TestNewSampler$ .
+func TestNewSampler(t *testing.T) {
+	cases := []struct {
+		sampler string
+		arg     string
+		desc    string
+		err     string
+	}{
+		{"always_on", "", "AlwaysOnSampler", ""},
+		{"always_off", "", "AlwaysOffSampler", ""},
+		{"traceidratio", "0.25", "TraceIDRatioBased{0.25}", ""},
+		{"traceidratio", "", "AlwaysOnSampler", ""}, // a ratio of 1 samples everything
+		{"parentbased_always_on", "", "ParentBased{root:AlwaysOnSampler", ""},
+		{"parentbased_always_off", "", "ParentBased{root:AlwaysOffSampler", ""},
+		{"parentbased_traceidratio", "0.5", "ParentBased{root:TraceIDRatioBased{0.5}", ""},
+		{"traceidratio", "1.5", "", "invalid sampler ratio"},
+		{"traceidratio", "x", "", "invalid sampler ratio"},
+		{"jaeger_remote", "", "", "unknown sampler"},
+	}
+	for _, v := range cases {
+		s, err := newSampler(&traceOption{Sampler: v.sampler, SamplerArg: v.arg})
+		if v.err != "" {
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("%s %s expect: %q error, got: %v", v.sampler, v.arg, v.err, err)
+			}
+			continue
+		}
+		if err != nil || !strings.HasPrefix(s.Description(), v.desc) {
+			t.Errorf("%s %s expect: %s, got: %v %v", v.sampler, v.arg, v.desc, s, err)
+		}
+	}
+}
+
+// go test -run ^TestParseResourceAttr$ .
+func TestParseResourceAttr(t *testing.T) {
+	cases := []struct {
+		attr     string
+		expected []attribute.KeyValue
+		err      bool
+	}{
+		{"", []attribute.KeyValue{}, false},
+		{"env=prod", []attribute.KeyValue{attribute.String("env", "prod")}, false},
+		{" env = prod , region=us%2Deast%201,", []attribute.KeyValue{attribute.String("env", "prod"), attribute.String("region", "us-east 1")}, false},
+		{"a=b=c", []attribute.KeyValue{attribute.String("a", "b=c")}, false},
+		{"a=", []attribute.KeyValue{attribute.String("a", "")}, false},
+		{"novalue", nil, true},
+		{"=x", nil, true},
+		{"a=%zz", nil, true},
+	}
+	for _, v := range cases {
+		attrs, err := parseResourceAttr(v.attr)
+		if (err != nil) != v.err || fmt.Sprint(attrs) != fmt.Sprint(v.expected) {
+			t.Errorf("%q expect: %v %v, got: %v %v", v.attr, v.expected, v.err, attrs, err)
+		}
+	}
+}
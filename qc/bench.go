@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+type benchStream struct {
+	Streams    int     `json:"streams"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Mbps       float64 `json:"throughput_mbps"`
+}
+
+type benchResult struct {
+	Protocol           string        `json:"protocol"`
+	Error              string        `json:"error,omitempty"`
+	HandshakeMS        float64       `json:"handshake_ms"`
+	TTFBMS             float64       `json:"ttfb_ms"`
+	ResumedHandshakeMS float64       `json:"resumed_handshake_ms"`
+	ResumedTTFBMS      float64       `json:"resumed_ttfb_ms"`
+	Resumed            bool          `json:"resumed"`
+	Used0RTT           bool          `json:"used_0rtt"`
+	Download           []benchStream `json:"download"`
+	Upload             *benchStream  `json:"upload,omitempty"`
+}
+
+type benchReport struct {
+	Time    time.Time     `json:"time"`
+	Remote  string        `json:"remote"`
+	Size    int64         `json:"size"`
+	Results []benchResult `json:"results"`
+}
+
+type benchOption struct {
+	path    string
+	size    int64
+	streams []int
+	upload  bool
+	tcp     bool
+}
+
+// handshakeRecorder records the handshakes of the connections dialed by a transport
+type handshakeRecorder struct {
+	sync.Mutex
+	durations []time.Duration
+	resumed   bool
+	used0RTT  bool
+}
+
+func (h *handshakeRecorder) add(d time.Duration, resumed, used0RTT bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.durations = append(h.durations, d)
+	h.resumed = h.resumed || resumed
+	h.used0RTT = h.used0RTT || used0RTT
+}
+
+func (h *handshakeRecorder) first() (d time.Duration, resumed, used0RTT bool) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.durations) > 0 {
+		d = h.durations[0]
+	}
+	return d, h.resumed, h.used0RTT
+}
+
+// benchTransport is a RoundTripper for one protocol under test
+type benchTransport interface {
+	http.RoundTripper
+	Close() error
+}
+
+type tcpTransport struct {
+	*http.Transport
+}
+
+func (t *tcpTransport) Close() error {
+	t.CloseIdleConnections()
+	return nil
+}
+
+func (q *QuicClient) h3Transport(peerConn net.PacketConn, cache tls.ClientSessionCache, rec *handshakeRecorder) benchTransport {
+	tlsConf := q.roundTripper.TLSClientConfig.Clone()
+	tlsConf.ClientSessionCache = cache
+	dial := q.dialer(peerConn)
+	return &http3.RoundTripper{
+		TLSClientConfig: tlsConf,
+		QuicConfig:      q.roundTripper.QuicConfig.Clone(),
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			start := time.Now()
+			ec, err := dial(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				select {
+				case <-ec.HandshakeComplete().Done():
+					state := ec.ConnectionState().TLS
+					rec.add(time.Since(start), state.DidResume, state.Used0RTT)
+				case <-ec.Context().Done():
+				}
+			}()
+			return ec, nil
+		},
+	}
+}
+
+func (q *QuicClient) tcpTransport(cache tls.ClientSessionCache, rec *handshakeRecorder) benchTransport {
+	tlsConf := q.roundTripper.TLSClientConfig.Clone()
+	tlsConf.ClientSessionCache = cache
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+	dialer := &net.Dialer{Timeout: time.Duration(q.dialTimeout) * time.Second}
+	return &tcpTransport{&http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			host, _, _ := net.SplitHostPort(addr)
+			conf := tlsConf.Clone()
+			conf.ServerName = host
+			tlsConn := tls.Client(conn, conf)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			rec.add(time.Since(start), tlsConn.ConnectionState().DidResume, false)
+			return tlsConn, nil
+		},
+	}}
+}
+
+// benchGet downloads size bytes, returns time to first byte and total duration
+func benchGet(ctx context.Context, rt http.RoundTripper, method, addr string, size int64) (ttfb, total time.Duration, n int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s?size=%d", addr, size), nil)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	rsp, err := rt.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("get %s status %s", addr, rsp.Status)
+		return
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		var m int
+		m, err = rsp.Body.Read(buf)
+		if n == 0 && m > 0 {
+			ttfb = time.Since(start)
+		}
+		n += int64(m)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+	}
+	total = time.Since(start)
+	return
+}
+
+func benchDownload(ctx context.Context, rt http.RoundTripper, addr string, size int64, streams int) (*benchStream, error) {
+	wg := sync.WaitGroup{}
+	errs := make(chan error, streams)
+	result := &benchStream{Streams: streams}
+	mu := sync.Mutex{}
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, n, err := benchGet(ctx, rt, http.MethodGet, addr, size/int64(streams))
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			result.Bytes += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	result.setDuration(time.Since(start))
+	return result, nil
+}
+
+func benchUpload(ctx context.Context, rt http.RoundTripper, addr string, size int64) (*benchStream, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, addr, io.LimitReader(zeroReader{}, size))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+
+	start := time.Now()
+	rsp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("put %s status %s", addr, rsp.Status)
+	}
+
+	result := &benchStream{Streams: 1, Bytes: size}
+	result.setDuration(time.Since(start))
+	return result, nil
+}
+
+func (b *benchStream) setDuration(d time.Duration) {
+	b.DurationMS = ms(d)
+	if d > 0 {
+		b.Mbps = float64(b.Bytes) * 8 / d.Seconds() / 1e6
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// benchProtocol runs all measurements with transports created by newTransport
+func benchProtocol(ctx context.Context, protocol, addr string, opt *benchOption, newTransport func(tls.ClientSessionCache, *handshakeRecorder) benchTransport) (result benchResult) {
+	result.Protocol = protocol
+	result.Download = []benchStream{}
+	cache := tls.NewLRUClientSessionCache(8)
+
+	rec := &handshakeRecorder{}
+	rt := newTransport(cache, rec)
+	ttfb, _, _, err := benchGet(ctx, rt, http.MethodGet, addr, 1)
+	if err != nil {
+		rt.Close()
+		result.Error = err.Error()
+		return
+	}
+	result.TTFBMS = ms(ttfb)
+
+	for _, streams := range opt.streams {
+		s, err := benchDownload(ctx, rt, addr, opt.size, streams)
+		if err != nil {
+			rt.Close()
+			result.Error = err.Error()
+			return
+		}
+		result.Download = append(result.Download, *s)
+		logger.Info("download",
+			zap.String("protocol", protocol),
+			zap.Int("streams", s.Streams),
+			zap.Float64("mbps", s.Mbps),
+		)
+	}
+
+	if opt.upload {
+		result.Upload, err = benchUpload(ctx, rt, addr, opt.size)
+		if err != nil {
+			rt.Close()
+			result.Error = err.Error()
+			return
+		}
+	}
+	rt.Close()
+	handshake, _, _ := rec.first()
+	result.HandshakeMS = ms(handshake)
+
+	// a new transport resumes the session(and tries 0-RTT over QUIC) with the cached ticket
+	method := http.MethodGet
+	if protocol == "h3" {
+		method = http3.MethodGet0RTT
+	}
+	rec = &handshakeRecorder{}
+	rt = newTransport(cache, rec)
+	defer rt.Close()
+	ttfb, _, _, err = benchGet(ctx, rt, method, addr, 1)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.ResumedTTFBMS = ms(ttfb)
+	handshake, result.Resumed, result.Used0RTT = rec.first()
+	result.ResumedHandshakeMS = ms(handshake)
+	return
+}
+
+func (q *QuicClient) bench(ctx context.Context, opt *benchOption) error {
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return fmt.Errorf("prepare network error %w", err)
+	}
+	defer peerConn.Close()
+
+	if !strings.HasPrefix(opt.path, "/") {
+		opt.path = "/" + opt.path
+	}
+	addr := "https://" + q.remoteAddress + opt.path
+	report := &benchReport{
+		Time:   time.Now().UTC(),
+		Remote: q.remoteAddress,
+		Size:   opt.size,
+	}
+
+	report.Results = append(report.Results, benchProtocol(ctx, "h3", addr, opt, func(cache tls.ClientSessionCache, rec *handshakeRecorder) benchTransport {
+		return q.h3Transport(peerConn, cache, rec)
+	}))
+	if opt.tcp {
+		report.Results = append(report.Results, benchProtocol(ctx, "tcp", addr, opt, q.tcpTransport))
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(report)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	mrand "math/rand"
@@ -63,6 +64,9 @@ type QuicClient struct {
 	pingPeerNum        uint32
 	peerID             string
 	keyLogFile         string
+	qlogDir            string
+	certFile           string
+	keyFile            string
 	remoteAddress      string
 	serverAddress1     string
 	serverAddress2     string
@@ -70,6 +74,7 @@ type QuicClient struct {
 	serverAddr2        *net.UDPAddr
 	networkType        string
 	roundTripper       *http3.RoundTripper
+	transfer           transferOption
 }
 
 func (u *QuicClient) readData(conn net.PacketConn) (dat data, raddr net.Addr, e error) {
@@ -190,8 +195,8 @@ func (u *QuicClient) connPrepare() (net.PacketConn, error) {
 		zap.Object("resp", &rcvData2),
 	)
 
-	peerAddressMessage := make(chan string)
-	punchedMessage := make(chan bool)
+	peerAddressMessage := make(chan string, 1)
+	punchedMessage := make(chan bool, 1)
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
@@ -201,6 +206,10 @@ func (u *QuicClient) connPrepare() (net.PacketConn, error) {
 		for {
 			rcvData, raddr, err := u.readData(conn)
 			if err != nil {
+				// conn closed, or handed over to quic after punched
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+					return
+				}
 				logger.Warn("read error",
 					zap.Error(err),
 				)
@@ -317,31 +326,29 @@ pingPeerLoop:
 		conn.Close()
 		return nil, fmt.Errorf("PUNCH failed")
 	}
+
+	// stop the signaling reader, the conn belongs to quic from now on
+	conn.SetReadDeadline(time.Now())
+	wg.Wait()
+	conn.SetReadDeadline(time.Time{})
+
 	u.remoteAddress = peerAddress
 	return conn, nil
 }
 
-func (q *QuicClient) get(ctx context.Context, urlPath string, filename string) error {
-	peerConn, err := q.connPrepare()
-	if err != nil {
-		return fmt.Errorf("prepare network error %w", err)
-	}
-	q.roundTripper.Dial = func(ctx context.Context, serverAddr string, tlsConf *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+// dialer returns a http3.RoundTripper Dial func which dials the remote address over peerConn
+func (q *QuicClient) dialer(peerConn net.PacketConn) func(ctx context.Context, serverAddr string, tlsConf *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+	return func(ctx context.Context, serverAddr string, tlsConf *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
 		udpRemoteAddr, err := net.ResolveUDPAddr("udp", q.remoteAddress)
 		if err != nil {
 			return nil, err
 		}
 
-		qc, err := quic.DialContext(ctx, peerConn, udpRemoteAddr, q.remoteAddress, tlsConf, config)
+		ec, err := quic.DialEarlyContext(ctx, peerConn, udpRemoteAddr, q.remoteAddress, tlsConf, config)
 		if err != nil {
 			return nil, err
 		}
 
-		ec, ok := qc.(quic.EarlyConnection)
-		if !ok {
-			return nil, fmt.Errorf("dail error")
-		}
-
 		logger.Info("conn ready",
 			zap.String("server", serverAddr),
 			zap.Bool("nat", q.nat),
@@ -351,6 +358,20 @@ func (q *QuicClient) get(ctx context.Context, urlPath string, filename string) e
 
 		return ec, nil
 	}
+}
+
+func (q *QuicClient) get(ctx context.Context, urlPath string, filename string) error {
+	if err := q.transfer.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := q.transfer.context(ctx)
+	defer cancel()
+
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return fmt.Errorf("prepare network error %w", err)
+	}
+	q.roundTripper.Dial = q.dialer(peerConn)
 	defer q.roundTripper.Close()
 
 	if !strings.HasPrefix(urlPath, "/") {
@@ -358,31 +379,51 @@ func (q *QuicClient) get(ctx context.Context, urlPath string, filename string) e
 	}
 	addr := "https://" + q.remoteAddress + urlPath
 
-	if len(q.keyLogFile) > 0 {
-		f, err := os.Create(q.keyLogFile)
-		if err != nil {
-			logger.Warn("create key log file error",
-				zap.String("filename", q.keyLogFile),
-				zap.Error(err),
-			)
-		} else {
-			defer f.Close()
-			q.roundTripper.TLSClientConfig.KeyLogWriter = f
-		}
-	}
 	logger.Debug("get",
 		zap.String("addr", addr),
 		zap.String("path", urlPath),
-		zap.String("key file", q.keyLogFile),
 	)
 
-	hclient := http.Client{
+	w := os.Stdout
+	if filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	hclient := &http.Client{
 		Transport: q.roundTripper,
 	}
-	rsp, err := hclient.Get(addr)
+	limiter := newTokenBucket(q.transfer.rate)
+	var written int64
+	return retry(ctx, q.transfer.retry, func(int) error {
+		n, err := q.getOnce(ctx, hclient, addr, written, w, limiter)
+		written += n
+		return err
+	})
+}
+
+// getOnce writes addr to w, resuming at offset with a range request
+// after a failed attempt, returns the bytes written
+func (q *QuicClient) getOnce(ctx context.Context, hclient *http.Client, addr string, offset int64, w io.Writer, limiter *tokenBucket) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
 	if err != nil {
-		return fmt.Errorf("get error %w", err)
+		return 0, err
 	}
+	if offset > 0 {
+		// offsets of the identity encoding equal the decoded offsets
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	} else {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rsp, err := hclient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("get error %w", err)
+	}
+	defer rsp.Body.Close()
 
 	logger.Debug("get response",
 		zap.String("addr", addr),
@@ -390,26 +431,54 @@ func (q *QuicClient) get(ctx context.Context, urlPath string, filename string) e
 		zap.String("url", rsp.Request.URL.String()),
 		zap.Int("status", rsp.StatusCode),
 		zap.Int64("content-length", rsp.ContentLength),
+		zap.String("content-encoding", rsp.Header.Get("Content-Encoding")),
 	)
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return 0, fmt.Errorf("get %s %w", rsp.Request.URL.Path, newAPIError(rsp))
+	}
 
-	w := os.Stdout
-	if filename != "" {
-		f, err := os.Create(filename)
+	total, start := rsp.ContentLength, int64(0)
+	if rsp.StatusCode == http.StatusPartialContent {
+		start = offset
+		if total >= 0 {
+			total += offset
+		}
+	}
+	bar := newProgress(q.transfer.progress, rsp.Request.URL.Path, total, start)
+	wire := &countingReader{r: bar.Reader(limiter.Reader(ctx, rsp.Body))}
+	var body io.Reader = wire
+	if encoding := rsp.Header.Get("Content-Encoding"); encoding != "" {
+		dec, err := newDecoder(encoding, wire)
 		if err != nil {
-			return err
+			bar.Finish(err)
+			return 0, err
+		}
+		defer dec.Close()
+		body = dec
+	}
+	if offset > 0 && rsp.StatusCode != http.StatusPartialContent {
+		// the server ignored the range, skip what has been written already
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			bar.Finish(err)
+			return 0, err
 		}
-		defer f.Close()
-		w = f
 	}
 
-	io.Copy(w, rsp.Body)
-
-	return nil
-}
-
-func (q *QuicClient) put(ctx context.Context, addr string) error {
+	n, err := io.Copy(w, body)
+	bar.Finish(err)
+	if err != nil {
+		return n, err
+	}
 
-	return nil
+	logger.Info("get done",
+		zap.String("path", rsp.Request.URL.Path),
+		zap.Int("status", rsp.StatusCode),
+		zap.String("encoding", rsp.Header.Get("Content-Encoding")),
+		zap.Int64("size", offset+n),
+		zap.Int64("wire", wire.n),
+		zap.Float64("ratio", transferRatio(n, wire.n)),
+	)
+	return n, nil
 }
 
 func (q *QuicClient) post(ctx context.Context, addr string) error {
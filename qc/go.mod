@@ -4,13 +4,17 @@ go 1.20
 
 require (
 	github.com/denisbrodbeck/machineid v1.0.1
+	github.com/klauspost/compress v1.16.7
 	github.com/libp2p/go-reuseport v0.2.0
 	github.com/quic-go/quic-go v0.33.0
+	github.com/quic-go/webtransport-go v0.5.2
 	github.com/spf13/cobra v1.7.0
 	go.uber.org/zap v1.24.0
+	quicutil v0.0.0-00010101000000-000000000000
 )
 
 require (
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
@@ -30,3 +34,5 @@ require (
 	golang.org/x/text v0.5.0 // indirect
 	golang.org/x/tools v0.2.0 // indirect
 )
+
+replace quicutil => ../internal/quicutil
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const lsPrefix = "/api/ls"
+
+type lsOption struct {
+	hash string // comma separated hashes the server computes per file
+	json bool   // print the server response
+}
+
+type fileInfo struct {
+	Name  string            `json:"name"`
+	Path  string            `json:"path,omitempty"`
+	Size  int64             `json:"size"`
+	Mode  string            `json:"mode"`
+	MTime time.Time         `json:"mtime"`
+	IsDir bool              `json:"dir,omitempty"`
+	Hash  map[string]string `json:"hash,omitempty"`
+}
+
+type listing struct {
+	Path    string      `json:"path"`
+	Entries []*fileInfo `json:"entries"`
+}
+
+// ls lists urlPath on the server like ls -l
+func (q *QuicClient) ls(ctx context.Context, urlPath string, opt *lsOption) error {
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return fmt.Errorf("prepare network error %w", err)
+	}
+	q.roundTripper.Dial = q.dialer(peerConn)
+	defer q.roundTripper.Close()
+
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+	query := url.Values{"path": {urlPath}}
+	if opt.hash != "" {
+		query.Set("hash", opt.hash)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+q.remoteAddress+lsPrefix+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	body, err := doAPI(&http.Client{Transport: q.roundTripper}, req)
+	if err != nil {
+		return err
+	}
+	if opt.json {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	l := &listing{}
+	if err := json.Unmarshal(body, l); err != nil {
+		return fmt.Errorf("decode listing err: %w", err)
+	}
+	algs := []string{}
+	if opt.hash != "" {
+		algs = strings.Split(opt.hash, ",")
+		sort.Strings(algs)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for _, v := range l.Entries {
+		name := v.Name
+		if v.IsDir && name != "/" {
+			name += "/"
+		}
+		fmt.Fprintf(tw, "%s\t %d\t %s\t", v.Mode, v.Size, v.MTime.Local().Format("2006-01-02 15:04:05"))
+		for _, alg := range algs {
+			sum := v.Hash[alg]
+			if sum == "" {
+				sum = "-"
+			}
+			fmt.Fprintf(tw, " %s\t", sum)
+		}
+		fmt.Fprintf(tw, " %s\n", name)
+	}
+	return tw.Flush()
+}
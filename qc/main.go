@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/denisbrodbeck/machineid"
 	"github.com/quic-go/quic-go"
@@ -16,6 +17,8 @@ import (
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"quicutil"
 )
 
 var (
@@ -55,12 +58,37 @@ func main() {
 				panic(fmt.Sprintf("x509 cert error %s", err))
 			}
 
+			tlsConf := &tls.Config{
+				RootCAs:            pool,
+				InsecureSkipVerify: !qc.secure,
+			}
+			if qc.certFile != "" || qc.keyFile != "" {
+				cert, err := tls.LoadX509KeyPair(qc.certFile, qc.keyFile)
+				if err != nil {
+					return fmt.Errorf("load client cert %s err: %w", qc.certFile, err)
+				}
+				tlsConf.Certificates = []tls.Certificate{cert}
+			}
+
+			keyLog, err := quicutil.OpenKeyLog(qc.keyLogFile)
+			if err != nil {
+				return err
+			}
+			if keyLog != nil {
+				tlsConf.KeyLogWriter = keyLog
+			}
+
+			quicConf := &quic.Config{}
+			if qc.qlogDir != "" {
+				quicConf.Tracer, err = quicutil.QlogTracer(qc.qlogDir)
+				if err != nil {
+					return err
+				}
+			}
+
 			qc.roundTripper = &http3.RoundTripper{
-				TLSClientConfig: &tls.Config{
-					RootCAs:            pool,
-					InsecureSkipVerify: !qc.secure,
-				},
-				QuicConfig: &quic.Config{},
+				TLSClientConfig: tlsConf,
+				QuicConfig:      quicConf,
 			}
 			return err
 		},
@@ -75,6 +103,10 @@ func main() {
 
 	rootCmd.PersistentFlags().StringVar(&qc.serverAddress1, "s1", serverAddress1, "server address1")
 	rootCmd.PersistentFlags().StringVar(&qc.serverAddress2, "s2", serverAddress2, "server address2")
+	rootCmd.PersistentFlags().StringVar(&qc.certFile, "cert", "", "client certificate file")
+	rootCmd.PersistentFlags().StringVar(&qc.keyFile, "key", "", "client private key file")
+	rootCmd.PersistentFlags().StringVar(&qc.keyLogFile, "keylog", "", "append TLS keys to file for Wireshark, default $SSLKEYLOGFILE")
+	rootCmd.PersistentFlags().StringVar(&qc.qlogDir, "qlog-dir", "", "write a qlog trace per connection into dir")
 
 	qcGetCmd := &cobra.Command{
 		Use:   "get",
@@ -84,6 +116,10 @@ func main() {
 qc get https://127.0.0.1:6121
 * get a file to localfile
 qc get https://192.168.1.6:6121/file localfile
+* at most 1MiB/s, give up after 10 minutes, retry 5 times resuming where it failed
+qc get --s1 192.168.1.6:20019 /api/file/big.iso big.iso --limit-rate 1M --max-time 10m --retry 5
+* json progress lines on stderr
+qc get --s1 192.168.1.6:20019 /api/file/big.iso big.iso --progress json
 `,
 		Args: cobra.RangeArgs(1, 2),
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
@@ -96,22 +132,36 @@ qc get https://192.168.1.6:6121/file localfile
 			return qc.get(ctx, args[0], filename)
 		},
 	}
+	addTransferFlags(qcGetCmd, &qc.transfer)
 	rootCmd.AddCommand(qcGetCmd)
 
+	putOpt := putOption{
+		dedup:       true,
+		concurrency: 4,
+		compress:    "zstd",
+	}
 	qcPutCmd := &cobra.Command{
-		Use:   "put",
+		Use:   "put <path> <localfile>",
 		Short: "put file",
 		Long: `put file:
-* put a file to localfile
-qc put https://192.168.1.6:6121/file localfile
+* upload localfile as /dir/file, only sending the chunks a qs --cas-dir server doesn't have
+qc put --s1 192.168.1.6:20019 /dir/file localfile
+* upload the whole file
+qc put --s1 192.168.1.6:20019 /dir/file localfile --dedup=false
+* upload without compression
+qc put --s1 192.168.1.6:20019 /dir/file localfile --compress none
 `,
-		Args: cobra.MinimumNArgs(2),
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 			defer stop()
-			return qc.put(ctx, args[0])
+			return qc.put(ctx, args[0], args[1], &putOpt)
 		},
 	}
+	qcPutCmd.Flags().BoolVar(&putOpt.dedup, "dedup", putOpt.dedup, "negotiate chunks with the server and only send missing ones")
+	qcPutCmd.Flags().IntVar(&putOpt.concurrency, "concurrency", putOpt.concurrency, "chunks uploaded in parallel")
+	qcPutCmd.Flags().StringVar(&putOpt.compress, "compress", putOpt.compress, "upload Content-Encoding: zstd, gzip or none")
+	addTransferFlags(qcPutCmd, &qc.transfer)
 	rootCmd.AddCommand(qcPutCmd)
 
 	qcPostCmd := &cobra.Command{
@@ -146,12 +196,155 @@ qc del https://192.168.1.6:6121/file localfile
 	}
 	rootCmd.AddCommand(qcDeleteCmd)
 
+	lsOpt := lsOption{}
+	qcLsCmd := &cobra.Command{
+		Use:   "ls [path]",
+		Short: "list files",
+		Long: `list files:
+* list the root dir of the server
+qc ls --s1 192.168.1.6:20019
+* list a dir with the sha256 of every file
+qc ls --s1 192.168.1.6:20019 /dir --hash sha256
+* print the json listing for scripts
+qc ls --s1 192.168.1.6:20019 /dir --json
+`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			urlPath := "/"
+			if len(args) == 1 {
+				urlPath = args[0]
+			}
+			return qc.ls(ctx, urlPath, &lsOpt)
+		},
+	}
+	qcLsCmd.Flags().StringVar(&lsOpt.hash, "hash", "", "also show file hashes, comma separated list of sha256,sha1,md5")
+	qcLsCmd.Flags().BoolVar(&lsOpt.json, "json", false, "print the json listing")
+	rootCmd.AddCommand(qcLsCmd)
+
+	benchOpt := benchOption{
+		path:    "/api/bench",
+		size:    64 << 20,
+		streams: []int{1, 4, 16},
+		upload:  true,
+		tcp:     true,
+	}
+	qcBenchCmd := &cobra.Command{
+		Use:   "bench [path]",
+		Short: "benchmark quic",
+		Long: `benchmark quic against qs /api/bench(qs start --bench), print json report:
+* download 64MiB with 1, 4 and 16 streams, upload 64MiB, compare with tcp+tls
+qc bench --s1 192.168.1.6:20019
+* only quic, 1GiB
+qc bench --s1 192.168.1.6:20019 --size 1073741824 --tcp=false
+`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			if len(args) == 1 {
+				benchOpt.path = args[0]
+			}
+			return qc.bench(ctx, &benchOpt)
+		},
+	}
+	qcBenchCmd.Flags().Int64Var(&benchOpt.size, "size", benchOpt.size, "bytes to transfer in each test")
+	qcBenchCmd.Flags().IntSliceVar(&benchOpt.streams, "streams", benchOpt.streams, "concurrent streams to test, the size is split across the streams")
+	qcBenchCmd.Flags().BoolVar(&benchOpt.upload, "upload", benchOpt.upload, "benchmark upload")
+	qcBenchCmd.Flags().BoolVar(&benchOpt.tcp, "tcp", benchOpt.tcp, "compare with tcp+tls to the same server address")
+	rootCmd.AddCommand(qcBenchCmd)
+
+	pipeOpt := pipeOption{
+		watchInterval: 2 * time.Second,
+	}
+	qcPipeCmd := &cobra.Command{
+		Use:   "pipe",
+		Short: "pipe stdin/stdout over quic",
+		Long: `pipe stdin/stdout over a quic stream:
+* listen on local port 6121 and accept one peer
+qc pipe --listen -p 6121 > file
+* send a file to the listener
+qc pipe --s1 192.168.1.6:6121 < file
+`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			return qc.pipe(ctx, &pipeOpt)
+		},
+	}
+	qcPipeCmd.Flags().BoolVar(&pipeOpt.listen, "listen", false, "listen on --port and accept one peer")
+	qcPipeCmd.Flags().DurationVar(&pipeOpt.watchInterval, "watch-interval", pipeOpt.watchInterval, "local address change check interval, 0 to disable")
+	rootCmd.AddCommand(qcPipeCmd)
+
+	qcChatCmd := &cobra.Command{
+		Use:   "chat",
+		Short: "chat over quic datagrams",
+		Long: `chat over quic, every stdin line is sent as an unreliable datagram(RFC 9221):
+* listen on local port 6121 and accept one peer
+qc chat --listen -p 6121
+* chat with the listener
+qc chat --s1 192.168.1.6:6121
+`,
+		Args: cobra.ExactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			pipeOpt.chat = true
+			return qc.pipe(ctx, &pipeOpt)
+		},
+	}
+	qcChatCmd.Flags().BoolVar(&pipeOpt.listen, "listen", false, "listen on --port and accept one peer")
+	qcChatCmd.Flags().DurationVar(&pipeOpt.watchInterval, "watch-interval", pipeOpt.watchInterval, "local address change check interval, 0 to disable")
+	rootCmd.AddCommand(qcChatCmd)
+
+	wtOpt := wtOption{
+		path: "/api/wt",
+		recv: true,
+	}
+	qcWTCmd := &cobra.Command{
+		Use:   "wt [channel]",
+		Short: "join a qs webtransport channel",
+		Long: `join a qs WebTransport channel, stdin is relayed to the other sessions of the channel
+and everything they send is written to stdout:
+* follow the logs of a device
+qc wt --s1 192.168.1.6:20019 /logs/dev1 < /dev/null
+* stream the logs of a device and exit
+tail -f app.log | qc wt --s1 192.168.1.6:20019 /logs/dev1 --recv=false
+* chat with datagrams, echo our own lines back to measure the server round trip
+qc wt --s1 192.168.1.6:20019 /chat --datagram --echo
+`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			channel := "/"
+			if len(args) == 1 {
+				channel = args[0]
+			}
+			return qc.wt(ctx, channel, &wtOpt)
+		},
+	}
+	qcWTCmd.Flags().StringVar(&wtOpt.path, "path", wtOpt.path, "webtransport endpoint path")
+	qcWTCmd.Flags().BoolVar(&wtOpt.datagram, "datagram", false, "send every stdin line as a datagram")
+	qcWTCmd.Flags().BoolVar(&wtOpt.echo, "echo", false, "ask the server to send our data back too")
+	qcWTCmd.Flags().BoolVar(&wtOpt.recv, "recv", wtOpt.recv, "keep receiving after stdin is closed, until interrupted")
+	rootCmd.AddCommand(qcWTCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+func addTransferFlags(cmd *cobra.Command, t *transferOption) {
+	cmd.Flags().StringVar(&t.progress, "progress", "auto", "progress output: auto(bar on a terminal), bar, json(lines on stderr) or none")
+	cmd.Flags().StringVar(&t.limitRate, "limit-rate", "", "max transfer rate in bytes per second, e.g. 512K, 10M")
+	cmd.Flags().DurationVar(&t.maxTime, "max-time", 0, "max time of the whole transfer including retries, 0 means unlimited")
+	cmd.Flags().IntVar(&t.retry, "retry", 0, "retry a failed transfer n times with exponential backoff")
+}
+
 // init logger
 func initLogger(debug bool) *zap.AtomicLevel {
 	zcfg := zap.NewProductionConfig()
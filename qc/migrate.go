@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// serverConnIDLen is the connection ID length used by the pipe listener,
+// peerTracker needs it to parse short header packets
+const serverConnIDLen = 8
+
+const (
+	// migratePackets is how many packets for a connection a new address must
+	// deliver, with none arriving from the current address in between, before
+	// the connection follows it
+	migratePackets = 3
+	// peerExpiry drops the state of peers which stopped sending
+	peerExpiry = time.Minute
+	// maxTrackedPeers and maxPeerConnIDs bound the state kept for unknown senders
+	maxTrackedPeers = 1024
+	maxPeerConnIDs  = 16
+)
+
+// trackedPeer is the path state of one connection
+type trackedPeer struct {
+	origin    net.Addr // address the connection started with, the one quic-go knows
+	latest    net.Addr // address packets are sent to
+	lastSeen  time.Time
+	candidate net.Addr // address the peer may have migrated to
+	received  int      // packets received from candidate
+	connIDs   int
+}
+
+// peerTracker lets a quic server follow a migrating client.
+//
+// quic-go routes incoming packets by connection ID but keeps sending to the
+// address the connection started with. peerTracker reports the original
+// address to quic-go and sends to the address the peer migrated to.
+//
+// The tracker sees packets before quic-go authenticates them, so a single
+// packet carrying a known connection ID proves nothing: the connection only
+// moves to an address which delivered migratePackets packets while the
+// current address stayed silent. A spoofer racing an active peer never gets
+// there, and a peer redirected while idle moves back once it sends again.
+type peerTracker struct {
+	net.PacketConn
+	sync.Mutex
+	peers   map[string]*trackedPeer // original address -> peer
+	addrs   map[string]*trackedPeer // original and latest address -> peer
+	connIDs map[string]*trackedPeer // connection ID -> peer
+	swept   time.Time
+}
+
+func newPeerTracker(conn net.PacketConn) *peerTracker {
+	return &peerTracker{
+		PacketConn: conn,
+		peers:      map[string]*trackedPeer{},
+		addrs:      map[string]*trackedPeer{},
+		connIDs:    map[string]*trackedPeer{},
+		swept:      time.Now(),
+	}
+}
+
+// destConnID returns the destination connection ID of a quic packet
+func destConnID(p []byte) []byte {
+	if len(p) == 0 {
+		return nil
+	}
+	if p[0]&0x80 == 0 { // short header
+		if len(p) < 1+serverConnIDLen {
+			return nil
+		}
+		return p[1 : 1+serverConnIDLen]
+	}
+	// long header: flags(1) version(4) dcid len(1) dcid
+	if len(p) < 6 || len(p) < 6+int(p[5]) {
+		return nil
+	}
+	return p[6 : 6+int(p[5])]
+}
+
+// expire drops peers which sent nothing for peerExpiry, at most every peerExpiry/4
+func (t *peerTracker) expire(now time.Time) {
+	if now.Sub(t.swept) < peerExpiry/4 {
+		return
+	}
+	t.swept = now
+	for key, peer := range t.peers {
+		if now.Sub(peer.lastSeen) < peerExpiry {
+			continue
+		}
+		delete(t.peers, key)
+		delete(t.addrs, key)
+		delete(t.addrs, peer.latest.String())
+	}
+	for connID, peer := range t.connIDs {
+		if t.peers[peer.origin.String()] != peer {
+			delete(t.connIDs, connID)
+		}
+	}
+}
+
+func (t *peerTracker) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := t.PacketConn.ReadFrom(p)
+	if err != nil {
+		return n, addr, err
+	}
+	now := time.Now()
+	connID := string(destConnID(p[:n]))
+
+	t.Lock()
+	defer t.Unlock()
+	t.expire(now)
+	peer := t.connIDs[connID]
+	if peer == nil {
+		peer = t.addrs[addr.String()]
+	}
+	if peer == nil {
+		// only a long header packet may start a connection
+		if n == 0 || p[0]&0x80 == 0 || len(t.peers) >= maxTrackedPeers {
+			return n, addr, nil
+		}
+		peer = &trackedPeer{origin: addr, latest: addr}
+		t.peers[addr.String()] = peer
+		t.addrs[addr.String()] = peer
+	}
+
+	if addr.String() == peer.latest.String() {
+		peer.lastSeen = now
+		peer.candidate = nil
+		peer.received = 0
+		if connID != "" && t.connIDs[connID] == nil && peer.connIDs < maxPeerConnIDs {
+			t.connIDs[connID] = peer
+			peer.connIDs++
+		}
+		return n, peer.origin, nil
+	}
+
+	if peer.candidate == nil || peer.candidate.String() != addr.String() {
+		peer.candidate = addr
+		peer.received = 0
+	}
+	if peer.received++; peer.received < migratePackets {
+		return n, peer.origin, nil
+	}
+	logger.Info("peer migrated",
+		zap.String("origin", peer.origin.String()),
+		zap.String("from", peer.latest.String()),
+		zap.String("to", addr.String()),
+	)
+	if prev := peer.latest.String(); prev != peer.origin.String() {
+		delete(t.addrs, prev)
+	}
+	peer.latest = addr
+	peer.lastSeen = now
+	peer.candidate = nil
+	peer.received = 0
+	t.addrs[addr.String()] = peer
+	return n, peer.origin, nil
+}
+
+func (t *peerTracker) WriteTo(p []byte, addr net.Addr) (int, error) {
+	t.Lock()
+	if peer, ok := t.peers[addr.String()]; ok {
+		addr = peer.latest
+	}
+	t.Unlock()
+	return t.PacketConn.WriteTo(p, addr)
+}
+
+// routeLocalIP returns the local ip the system would use to reach raddr
+func routeLocalIP(raddr string) (net.IP, error) {
+	conn, err := net.Dial("udp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// watchLocalAddr pokes the peer when the local address changes(e.g. wifi to lte),
+// the unbound socket then sends from the new address and the peer re-learns it
+func watchLocalAddr(ctx context.Context, conn quic.Connection, raddr string, interval time.Duration) {
+	localIP, _ := routeLocalIP(raddr)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ip, err := routeLocalIP(raddr)
+		if err != nil {
+			logger.Debug("route local ip error",
+				zap.String("raddr", raddr),
+				zap.Error(err),
+			)
+			continue
+		}
+		if ip.Equal(localIP) {
+			continue
+		}
+
+		logger.Info("local address changed",
+			zap.Stringer("from", localIP),
+			zap.Stringer("to", ip),
+		)
+		localIP = ip
+		// an empty datagram is ignored by the peer but carries the new address
+		if err := conn.SendMessage([]byte{}); err != nil {
+			logger.Warn("send probe error",
+				zap.Error(err),
+			)
+		}
+	}
+}
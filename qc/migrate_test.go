@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakePacketConn returns the queued packets from ReadFrom and records WriteTo addresses
+type fakePacketConn struct {
+	net.PacketConn
+	packets []fakePacket
+	written []string
+}
+
+type fakePacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	v := c.packets[0]
+	c.packets = c.packets[1:]
+	return copy(p, v.data), v.addr, nil
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, addr.String())
+	return len(p), nil
+}
+
+func udpAddr(s string) net.Addr {
+	addr, _ := net.ResolveUDPAddr("udp", s)
+	return addr
+}
+
+func shortPacket(connID string) []byte {
+	return append([]byte{0x40}, connID...)
+}
+
+// go test -run ^TestPeerTracker$ .
+func TestPeerTracker(t *testing.T) {
+	logger = zap.NewNop()
+	const connID = "abcdefgh"
+	longPacket := append([]byte{0xc0, 0, 0, 0, 1, 8}, connID...)
+	origin, moved, spoofed := udpAddr("10.0.0.1:1000"), udpAddr("10.0.0.2:2000"), udpAddr("10.0.0.9:9000")
+
+	cases := []struct {
+		name    string
+		packets []fakePacket
+		dest    string
+	}{
+		{"origin", []fakePacket{{longPacket, origin}, {shortPacket(connID), origin}}, origin.String()},
+		{"one spoofed packet", []fakePacket{
+			{longPacket, origin},
+			{shortPacket(connID), spoofed},
+		}, origin.String()},
+		{"spoofer racing the peer", []fakePacket{
+			{longPacket, origin},
+			{shortPacket(connID), spoofed},
+			{shortPacket(connID), spoofed},
+			{shortPacket(connID), origin},
+			{shortPacket(connID), spoofed},
+		}, origin.String()},
+		{"migrated", []fakePacket{
+			{longPacket, origin},
+			{shortPacket(connID), moved},
+			{shortPacket(connID), moved},
+			{shortPacket(connID), moved},
+		}, moved.String()},
+		{"back from a redirect", []fakePacket{
+			{longPacket, origin},
+			{shortPacket(connID), spoofed},
+			{shortPacket(connID), spoofed},
+			{shortPacket(connID), spoofed},
+			{shortPacket(connID), origin},
+			{shortPacket(connID), origin},
+			{shortPacket(connID), origin},
+		}, origin.String()},
+		{"unknown short header", []fakePacket{{shortPacket("zzzzzzzz"), spoofed}}, spoofed.String()},
+	}
+	for _, v := range cases {
+		conn := &fakePacketConn{packets: v.packets}
+		tracker := newPeerTracker(conn)
+		buf := make([]byte, 1500)
+		var from net.Addr
+		for range v.packets {
+			_, addr, err := tracker.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from = addr
+		}
+		if _, ok := tracker.peers[spoofed.String()]; ok {
+			t.Errorf("%s spoofed address tracked as a peer", v.name)
+		}
+		tracker.WriteTo([]byte{}, from)
+		if got := conn.written[0]; got != v.dest {
+			t.Errorf("%s expect: %s, got: %s", v.name, v.dest, got)
+		}
+	}
+}
+
+// go test -run ^TestPeerTrackerExpire$ .
+func TestPeerTrackerExpire(t *testing.T) {
+	tracker := newPeerTracker(&fakePacketConn{})
+	peer := &trackedPeer{origin: udpAddr("10.0.0.1:1000"), latest: udpAddr("10.0.0.2:2000"), lastSeen: time.Now()}
+	stale := &trackedPeer{origin: udpAddr("10.0.0.3:3000"), latest: udpAddr("10.0.0.3:3000"), lastSeen: time.Now().Add(-2 * peerExpiry)}
+	for _, v := range []*trackedPeer{peer, stale} {
+		tracker.peers[v.origin.String()] = v
+		tracker.addrs[v.origin.String()] = v
+		tracker.addrs[v.latest.String()] = v
+		tracker.connIDs[v.origin.String()] = v
+	}
+
+	tracker.expire(time.Now())
+	if len(tracker.peers) != 2 {
+		t.Errorf("before sweep interval expect: 2 peers, got: %d", len(tracker.peers))
+	}
+	tracker.expire(time.Now().Add(peerExpiry / 2))
+	if len(tracker.peers) != 1 || len(tracker.addrs) != 2 || len(tracker.connIDs) != 1 {
+		t.Errorf("expect: 1 peer 2 addrs 1 conn id, got: %d %d %d", len(tracker.peers), len(tracker.addrs), len(tracker.connIDs))
+	}
+	if tracker.peers[peer.origin.String()] != peer {
+		t.Errorf("expect: active peer kept")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+const (
+	pipeALPN     = "qc-pipe"
+	pipePreamble = "QCP1" // written first on the stream so the listener can accept it
+)
+
+type pipeOption struct {
+	listen        bool
+	chat          bool
+	watchInterval time.Duration
+}
+
+// selfSignedCert generates a throwaway certificate for the pipe listener
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "qc"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (q *QuicClient) pipeQuicConfig() *quic.Config {
+	conf := q.roundTripper.QuicConfig.Clone()
+	conf.EnableDatagrams = true
+	conf.KeepAlivePeriod = 5 * time.Second
+	return conf
+}
+
+// pipeListen accepts one connection and its stream on --port
+func (q *QuicClient) pipeListen(ctx context.Context) (quic.Connection, quic.Stream, error) {
+	if q.nat {
+		// punching needs a peer server registered with the rendezvous servers, the listener isn't one
+		return nil, nil, errors.New("pipe --listen doesn't support --nat, the listener must be reachable")
+	}
+	tlsConf := q.roundTripper.TLSClientConfig.Clone()
+	if len(tlsConf.Certificates) == 0 {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate cert err: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	tlsConf.NextProtos = []string{pipeALPN}
+
+	conn, err := net.ListenUDP(q.networkType, &net.UDPAddr{Port: q.port})
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen port %d err: %w", q.port, err)
+	}
+	conf := q.pipeQuicConfig()
+	conf.ConnectionIDLength = serverConnIDLen
+	ln, err := quic.Listen(newPeerTracker(conn), tlsConf, conf)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	logger.Info("pipe listen",
+		zap.String("laddr", conn.LocalAddr().String()),
+	)
+
+	qconn, err := ln.Accept(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("accept err: %w", err)
+	}
+	logger.Info("pipe accepted",
+		zap.String("raddr", qconn.RemoteAddr().String()),
+	)
+
+	str, err := qconn.AcceptStream(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("accept stream err: %w", err)
+	}
+	preamble := make([]byte, len(pipePreamble))
+	if _, err := io.ReadFull(str, preamble); err != nil || string(preamble) != pipePreamble {
+		qconn.CloseWithError(1, "invalid preamble")
+		return nil, nil, fmt.Errorf("invalid preamble %q: %v", preamble, err)
+	}
+	return qconn, str, nil
+}
+
+// pipeDial connects to the remote address over the connPrepare(punched) conn
+func (q *QuicClient) pipeDial(ctx context.Context) (quic.Connection, quic.Stream, error) {
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return nil, nil, fmt.Errorf("prepare network error %w", err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", q.remoteAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConf := q.roundTripper.TLSClientConfig.Clone()
+	tlsConf.NextProtos = []string{pipeALPN}
+	qconn, err := quic.DialContext(ctx, peerConn, raddr, q.remoteAddress, tlsConf, q.pipeQuicConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial %s err: %w", q.remoteAddress, err)
+	}
+	logger.Info("pipe connected",
+		zap.String("raddr", q.remoteAddress),
+		zap.String("laddr", qconn.LocalAddr().String()),
+		zap.Bool("datagram", qconn.ConnectionState().SupportsDatagrams),
+	)
+
+	str, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open stream err: %w", err)
+	}
+	if _, err := io.WriteString(str, pipePreamble); err != nil {
+		return nil, nil, fmt.Errorf("write preamble err: %w", err)
+	}
+	return qconn, str, nil
+}
+
+// pipe carries stdin/stdout over a quic stream, in chat mode every stdin
+// line is sent as an unreliable datagram(falling back to the stream if too large)
+func (q *QuicClient) pipe(ctx context.Context, opt *pipeOption) error {
+	var qconn quic.Connection
+	var str quic.Stream
+	var err error
+	if opt.listen {
+		qconn, str, err = q.pipeListen(ctx)
+	} else {
+		qconn, str, err = q.pipeDial(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer qconn.CloseWithError(0, "bye")
+
+	if !opt.listen && opt.watchInterval > 0 {
+		go watchLocalAddr(qconn.Context(), qconn, q.remoteAddress, opt.watchInterval)
+	}
+
+	go func() { // datagrams to stdout
+		for {
+			msg, err := qconn.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			if len(msg) == 0 { // probe
+				continue
+			}
+			os.Stdout.Write(msg)
+		}
+	}()
+
+	sent := make(chan struct{})
+	go func() { // stdin to peer
+		defer close(sent)
+		var err error
+		if opt.chat {
+			err = sendLines(qconn.SendMessage, str, os.Stdin)
+		} else {
+			_, err = io.Copy(str, os.Stdin)
+		}
+		if err != nil {
+			logger.Warn("send error",
+				zap.Error(err),
+			)
+		}
+		str.Close()
+	}()
+
+	// the peer opens an empty uni stream once it has read everything we sent
+	peerDone := make(chan struct{})
+	go func() {
+		if _, err := qconn.AcceptUniStream(qconn.Context()); err == nil {
+			close(peerDone)
+		}
+	}()
+
+	// stream to stdout, returns when the peer closes its side
+	if _, err = io.Copy(os.Stdout, str); err != nil {
+		var appErr *quic.ApplicationError
+		if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+			return nil
+		}
+		return err
+	}
+	if done, err := qconn.OpenUniStream(); err == nil {
+		done.Close()
+	}
+
+	// close the connection only after both directions are done, a peer
+	// closing first has already read everything we sent
+	for _, ch := range []chan struct{}{sent, peerDone} {
+		select {
+		case <-ch:
+		case <-qconn.Context().Done():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// sendLines sends every line of r with send, falling back to w if send fails
+func sendLines(send func([]byte) error, w io.Writer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := append(scanner.Bytes(), '\n')
+		if err := send(line); err == nil {
+			continue
+		} else {
+			logger.Debug("send datagram error, fallback to stream",
+				zap.Int("len", len(line)),
+				zap.Error(err),
+			)
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"quicutil"
+)
+
+const (
+	fileAPIPrefix = "/api/file"
+	casPrefix     = "/api/cas"
+)
+
+var errCASDisabled = errors.New("server has no cas store")
+
+type putOption struct {
+	dedup       bool
+	concurrency int
+	compress    string // Content-Encoding of uploads, none to disable
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	off  int64
+}
+
+// apiError is the {"error":...} body of a failed qs api request
+type apiError struct {
+	Status  int      `json:"-"`
+	Message string   `json:"error"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Message)
+}
+
+// doAPI sends req and returns the body of a 2xx response, an *apiError otherwise
+func doAPI(client *http.Client, req *http.Request) ([]byte, error) {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s %w", req.Method, req.URL.Path, parseAPIError(rsp.StatusCode, body))
+	}
+	return body, nil
+}
+
+func parseAPIError(status int, body []byte) *apiError {
+	e := &apiError{Status: status}
+	if json.Unmarshal(body, e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// newAPIError reads the error of a failed response
+func newAPIError(rsp *http.Response) *apiError {
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, 4<<10))
+	return parseAPIError(rsp.StatusCode, body)
+}
+
+func newJSONRequest(ctx context.Context, method, addr string, v interface{}) (*http.Request, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, addr, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// put uploads filename as urlPath, with dedup only the chunks the server doesn't have are sent
+func (q *QuicClient) put(ctx context.Context, urlPath, filename string, opt *putOption) error {
+	if err := q.transfer.validate(); err != nil {
+		return err
+	}
+	ctx, cancel := q.transfer.context(ctx)
+	defer cancel()
+
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return fmt.Errorf("prepare network error %w", err)
+	}
+	q.roundTripper.Dial = q.dialer(peerConn)
+	defer q.roundTripper.Close()
+
+	if !strings.HasPrefix(urlPath, "/") {
+		urlPath = "/" + urlPath
+	}
+	switch opt.compress {
+	case "zstd", "gzip", "none":
+	default:
+		return fmt.Errorf("unsupported compress %q", opt.compress)
+	}
+	if opt.dedup && opt.concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d", opt.concurrency)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	client := &http.Client{Transport: q.roundTripper}
+	base := "https://" + q.remoteAddress
+	limiter := newTokenBucket(q.transfer.rate)
+	dedup := opt.dedup
+	var info []byte
+	// a retried dedup upload only sends the chunks which didn't make it
+	err = retry(ctx, q.transfer.retry, func(int) (err error) {
+		if dedup {
+			info, err = q.putDedup(ctx, client, base, urlPath, f, opt, limiter)
+			if !errors.Is(err, errCASDisabled) {
+				return err
+			}
+			logger.Info("server has no cas store, fallback to plain upload")
+			dedup = false
+		}
+		info, err = q.putFile(ctx, client, base+fileAPIPrefix+urlPath, f, opt.compress, limiter)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(info)
+	return err
+}
+
+// putFile uploads the whole file, compressed on the fly unless compress is none
+func (q *QuicClient) putFile(ctx context.Context, client *http.Client, addr string, f *os.File, compress string, limiter *tokenBucket) (info []byte, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	bar := newProgress(q.transfer.progress, addr, fi.Size(), 0)
+	defer func() { bar.Finish(err) }()
+	src := bar.Reader(f)
+	wire := &countingReader{r: src}
+	if compress != "none" {
+		pr, pw := io.Pipe()
+		go func() {
+			enc, err := newEncoder(compress, pw)
+			if err == nil {
+				_, err = io.Copy(enc, src)
+				if closeErr := enc.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		wire.r = pr
+	}
+	wire.r = limiter.Reader(ctx, wire.r)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, addr, wire)
+	if err != nil {
+		return nil, err
+	}
+	if compress != "none" {
+		req.Header.Set("Content-Encoding", compress)
+		req.ContentLength = -1
+	} else {
+		req.ContentLength = fi.Size()
+	}
+	info, err = doAPI(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("put done",
+		zap.String("url", addr),
+		zap.String("encoding", compress),
+		zap.Int64("size", fi.Size()),
+		zap.Int64("wire", wire.n),
+		zap.Float64("ratio", transferRatio(fi.Size(), wire.n)),
+	)
+	return info, nil
+}
+
+func chunkFile(f *os.File) (chunks []chunkRef, size int64, err error) {
+	chunks = []chunkRef{}
+	ch := quicutil.NewChunker(f)
+	for {
+		data, err := ch.Next()
+		if err == io.EOF {
+			return chunks, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		sum := sha256.Sum256(data)
+		chunks = append(chunks, chunkRef{
+			Hash: hex.EncodeToString(sum[:]),
+			Size: int64(len(data)),
+			off:  size,
+		})
+		size += int64(len(data))
+	}
+}
+
+// putDedup asks the server which chunks of f it misses, uploads them and then the manifest
+func (q *QuicClient) putDedup(ctx context.Context, client *http.Client, base, urlPath string, f *os.File, opt *putOption, limiter *tokenBucket) (info []byte, err error) {
+	// a retry chunks the file again
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	chunks, size, err := chunkFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s err: %w", f.Name(), err)
+	}
+	query := "?path=" + url.QueryEscape(urlPath)
+
+	sums := []string{}
+	unique := map[string]chunkRef{}
+	for _, v := range chunks {
+		if _, ok := unique[v.Hash]; !ok {
+			unique[v.Hash] = v
+			sums = append(sums, v.Hash)
+		}
+	}
+	req, err := newJSONRequest(ctx, http.MethodPost, base+casPrefix+"/have"+query, map[string][]string{"chunks": sums})
+	if err != nil {
+		return nil, err
+	}
+	body, err := doAPI(client, req)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return nil, errCASDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	have := struct {
+		Missing []string `json:"missing"`
+	}{}
+	if err := json.Unmarshal(body, &have); err != nil {
+		return nil, fmt.Errorf("invalid have response: %w", err)
+	}
+
+	var missing int64
+	for _, sum := range have.Missing {
+		missing += unique[sum].Size
+	}
+	bar := newProgress(q.transfer.progress, urlPath, missing, 0)
+	defer func() { bar.Finish(err) }()
+
+	var sent, wire int64
+	mu := sync.Mutex{}
+	errs := make(chan error, len(have.Missing))
+	todo := make(chan chunkRef)
+	wg := sync.WaitGroup{}
+	for i := 0; i < opt.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range todo {
+				n, err := putChunk(ctx, client, base+casPrefix+"/chunk/"+ref.Hash+query, f, ref, opt.compress, limiter)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				bar.Add(ref.Size)
+				mu.Lock()
+				sent += ref.Size
+				wire += n
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, sum := range have.Missing {
+		ref, ok := unique[sum]
+		if !ok {
+			continue
+		}
+		todo <- ref
+	}
+	close(todo)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+
+	req, err = newJSONRequest(ctx, http.MethodPut, base+casPrefix+"/manifest"+query, map[string][]chunkRef{"chunks": chunks})
+	if err != nil {
+		return nil, err
+	}
+	info, err = doAPI(client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("put dedup",
+		zap.String("path", urlPath),
+		zap.Int64("size", size),
+		zap.Int("chunks", len(chunks)),
+		zap.Int("missing", len(have.Missing)),
+		zap.Int64("sent", sent),
+		zap.Int64("wire", wire),
+		zap.Float64("ratio", transferRatio(size, wire)),
+	)
+	return info, nil
+}
+
+// putChunk uploads one chunk of f, compressed if that makes it smaller, returns the bytes sent
+func putChunk(ctx context.Context, client *http.Client, addr string, f *os.File, ref chunkRef, compress string, limiter *tokenBucket) (int64, error) {
+	data := make([]byte, ref.Size)
+	if _, err := f.ReadAt(data, ref.off); err != nil {
+		return 0, err
+	}
+	encoding := ""
+	if compress != "none" {
+		encoded, err := encodeBytes(compress, data)
+		if err != nil {
+			return 0, err
+		}
+		if len(encoded) < len(data) {
+			data, encoding = encoded, compress
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, addr, limiter.Reader(ctx, bytes.NewReader(data)))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = int64(len(data))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if _, err := doAPI(client, req); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
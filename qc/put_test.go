@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// casServer fakes the qs cas api, the first manifest request fails with fail
+type casServer struct {
+	mu        sync.Mutex
+	chunks    map[string]int64
+	manifests int
+	fail      int
+	size      int64
+}
+
+func (s *casServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.URL.Path == casPrefix+"/have":
+		req := struct {
+			Chunks []string `json:"chunks"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&req)
+		missing := []string{}
+		for _, sum := range req.Chunks {
+			if _, ok := s.chunks[sum]; !ok {
+				missing = append(missing, sum)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"missing": missing})
+	case strings.HasPrefix(r.URL.Path, casPrefix+"/chunk/"):
+		n, _ := io.Copy(io.Discard, r.Body)
+		s.chunks[strings.TrimPrefix(r.URL.Path, casPrefix+"/chunk/")] = n
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == casPrefix+"/manifest":
+		if s.manifests++; s.manifests == 1 && s.fail != 0 {
+			http.Error(w, `{"error":"unavailable"}`, s.fail)
+			return
+		}
+		m := struct {
+			Chunks []chunkRef `json:"chunks"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&m)
+		s.size = 0
+		for _, v := range m.Chunks {
+			s.size += v.Size
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"size":%d}`, s.size)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// go test -run ^TestPutDedupRetry$ .
+func TestPutDedupRetry(t *testing.T) {
+	logger = zap.NewNop()
+	filename := filepath.Join(t.TempDir(), "f")
+	data := make([]byte, 3<<20)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		fail      int
+		manifests int
+	}{
+		{"ok", 0, 1},
+		{"retry", http.StatusServiceUnavailable, 2},
+	}
+	for _, v := range cases {
+		s := &casServer{chunks: map[string]int64{}, fail: v.fail}
+		srv := httptest.NewServer(s)
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := &QuicClient{transfer: transferOption{progress: "none"}}
+		opt := &putOption{dedup: true, concurrency: 2, compress: "none"}
+		ctx := context.Background()
+		err = retry(ctx, 1, func(int) error {
+			_, err := q.putDedup(ctx, srv.Client(), srv.URL, "/f", f, opt, nil)
+			return err
+		})
+		f.Close()
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s expect: no error, got: %v", v.name, err)
+			continue
+		}
+		if s.manifests != v.manifests || s.size != int64(len(data)) {
+			t.Errorf("%s expect: %d manifests of %d bytes, got: %d of %d bytes", v.name, v.manifests, len(data), s.manifests, s.size)
+		}
+	}
+}
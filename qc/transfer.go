@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	mrand "math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxBackoff = 30 * time.Second
+
+// transferOption are the get/put options shared by all transfers
+type transferOption struct {
+	progress  string // auto, bar, json or none
+	limitRate string // bytes per second, with K/M/G suffix
+	maxTime   time.Duration
+	retry     int
+	rate      int64
+}
+
+func (t *transferOption) validate() (err error) {
+	switch t.progress {
+	case "auto":
+		t.progress = "none"
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			t.progress = "bar"
+		}
+	case "bar", "json", "none":
+	default:
+		return fmt.Errorf("invalid progress %q", t.progress)
+	}
+	if t.limitRate != "" {
+		if t.rate, err = parseRate(t.limitRate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// context limits ctx to --max-time
+func (t *transferOption) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.maxTime > 0 {
+		return context.WithTimeout(ctx, t.maxTime)
+	}
+	return context.WithCancel(ctx)
+}
+
+// parseRate parses bytes per second like 512K, 10M or 1G(1024 based)
+func parseRate(s string) (int64, error) {
+	unit := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * float64(unit)), nil
+}
+
+// tokenBucket limits a transfer to rate bytes per second with bursts of up to burst bytes
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil(no limit) for rate 0
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 10 // 100ms
+	if burst < 16<<10 {
+		burst = 16 << 10
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take consumes n tokens, waiting while the bucket is in debt
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader throttles reads from r, b may be nil
+func (b *tokenBucket) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, b: b}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *tokenBucket
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > int(l.b.burst) {
+		p = p[:int(l.b.burst)]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.b.take(l.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// progress reports a transfer as a bar on a terminal or as json lines on stderr
+type progress struct {
+	mode  string
+	label string
+	total int64 // -1 if unknown
+	start int64 // bytes transferred by earlier attempts
+	n     atomic.Int64
+	begin time.Time
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Label   string    `json:"label"`
+	Bytes   int64     `json:"bytes"`
+	Total   int64     `json:"total"`
+	Percent float64   `json:"percent,omitempty"`
+	Rate    float64   `json:"rate_bps"`
+	ETA     float64   `json:"eta_s,omitempty"`
+	Done    bool      `json:"done,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newProgress(mode, label string, total, start int64) *progress {
+	p := &progress{
+		mode:  mode,
+		label: path.Base(label),
+		total: total,
+		start: start,
+		begin: time.Now(),
+		stop:  make(chan struct{}),
+	}
+	p.n.Store(start)
+	if mode == "none" {
+		return p
+	}
+
+	interval := 200 * time.Millisecond
+	if mode == "json" {
+		interval = time.Second
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print(nil, false)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *progress) Add(n int64) {
+	p.n.Add(n)
+}
+
+// Reader counts the bytes read from r
+func (p *progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+// Finish prints the final state
+func (p *progress) Finish(err error) {
+	if p.mode == "none" {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.print(err, true)
+}
+
+func (p *progress) print(err error, done bool) {
+	n := p.n.Load()
+	e := progressEvent{
+		Time:  time.Now().UTC(),
+		Label: p.label,
+		Bytes: n,
+		Total: p.total,
+		Done:  done && err == nil,
+	}
+	if elapsed := time.Since(p.begin).Seconds(); elapsed > 0 {
+		e.Rate = float64(n-p.start) / elapsed
+	}
+	if p.total > 0 {
+		e.Percent = float64(n) * 100 / float64(p.total)
+		if e.Rate > 0 && n < p.total {
+			e.ETA = float64(p.total-n) / e.Rate
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if p.mode == "json" {
+		json.NewEncoder(os.Stderr).Encode(&e)
+		return
+	}
+	line := fmt.Sprintf("%s %s %s/s", p.label, formatBytes(float64(n)), formatBytes(e.Rate))
+	if p.total > 0 {
+		const width = 30
+		filled := int(e.Percent / 100 * width)
+		if filled > width {
+			filled = width
+		}
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+		line = fmt.Sprintf("%s [%s] %5.1f%% %s/%s %s/s ETA %s", p.label, bar, e.Percent,
+			formatBytes(float64(n)), formatBytes(float64(p.total)), formatBytes(e.Rate),
+			(time.Duration(e.ETA) * time.Second).String())
+	}
+	fmt.Fprint(os.Stderr, "\r"+line+"\033[K")
+	if done {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// retryable reports whether a failed transfer may succeed when tried again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status >= 500 || apiErr.Status == 429 || apiErr.Status == 408
+	}
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr)
+}
+
+// retry calls fn until it succeeds, fails permanently or retries are used up,
+// sleeping with exponential backoff and jitter in between
+func retry(ctx context.Context, retries int, fn func(attempt int) error) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= retries || !retryable(ctx, err) {
+			return err
+		}
+
+		delay := backoff/2 + time.Duration(mrand.Int63n(int64(backoff)))
+		logger.Warn("transfer error, retry",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
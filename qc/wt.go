@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.uber.org/zap"
+
+	"quicutil"
+)
+
+type wtOption struct {
+	path     string
+	datagram bool
+	echo     bool
+	recv     bool
+}
+
+// syncWriter serializes the writes of concurrent streams and datagrams
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.w.Write(p)
+}
+
+// copyLines copies r to w a line(or a full buffer) at a time,
+// so that lines of concurrent streams don't mix
+func copyLines(w io.Writer, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		switch {
+		case err == nil || err == bufio.ErrBufferFull:
+		case err == io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// wt joins a qs WebTransport channel, sends stdin on a bidi stream(or every
+// line as a datagram) and writes the streams and datagrams of the channel to stdout
+func (q *QuicClient) wt(ctx context.Context, channel string, opt *wtOption) error {
+	peerConn, err := q.connPrepare()
+	if err != nil {
+		return fmt.Errorf("prepare network error %w", err)
+	}
+	defer peerConn.Close()
+	q.roundTripper.Dial = q.dialer(peerConn)
+	d := &webtransport.Dialer{RoundTripper: q.roundTripper}
+	defer d.Close()
+
+	query := url.Values{}
+	query.Set("path", channel)
+	if opt.echo {
+		query.Set("echo", "1")
+	}
+	u := url.URL{Scheme: "https", Host: q.remoteAddress, Path: opt.path, RawQuery: query.Encode()}
+	rsp, sess, err := d.Dial(ctx, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("dial %s err: %w", u.String(), err)
+	}
+	defer sess.CloseWithError(0, "bye")
+
+	conn, ok := rsp.Body.(http3.Hijacker).StreamCreator().(quicutil.DatagramConn)
+	if !ok {
+		return errors.New("connection doesn't support datagrams")
+	}
+	datagrams := quicutil.DatagramMuxOf(conn).Session(rsp.Body.(http3.HTTPStreamer).HTTPStream().StreamID())
+	defer datagrams.Close()
+
+	logger.Info("wt session",
+		zap.String("url", u.String()),
+		zap.String("local", sess.LocalAddr().String()),
+		zap.Bool("datagram", sess.ConnectionState().SupportsDatagrams),
+	)
+
+	out := &syncWriter{w: os.Stdout}
+	go func() {
+		for {
+			msg, err := datagrams.Receive(sess.Context())
+			if err != nil {
+				return
+			}
+			out.Write(msg)
+		}
+	}()
+	go func() {
+		for {
+			str, err := sess.AcceptUniStream(sess.Context())
+			if err != nil {
+				return
+			}
+			go copyLines(out, str)
+		}
+	}()
+
+	str, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("open stream err: %w", err)
+	}
+	echoed := make(chan error, 1)
+	go func() {
+		echoed <- copyLines(out, str)
+	}()
+
+	if opt.datagram {
+		err = sendLines(datagrams.Send, str, os.Stdin)
+	} else {
+		_, err = io.Copy(str, os.Stdin)
+	}
+	str.Close()
+	if err != nil {
+		return fmt.Errorf("send err: %w", err)
+	}
+
+	// the server closes its side after relaying everything we sent
+	select {
+	case err = <-echoed:
+	case <-sess.Context().Done():
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+	if !opt.recv {
+		return err
+	}
+	select {
+	case <-sess.Context().Done():
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// anyClient matches every client that presented a certificate signed by the client CA
+const anyClient = "*"
+
+type permission struct {
+	Path string `json:"path"`
+	Perm string `json:"perm"` // "r", "w" or "rw"
+}
+
+// policy maps client identities (certificate CommonName) to per-path permissions
+//
+//	{
+//	  "clients": {
+//	    "alice": [{"path": "/", "perm": "rw"}],
+//	    "*": [{"path": "/pub", "perm": "r"}]
+//	  }
+//	}
+type policy struct {
+	Clients map[string][]permission `json:"clients"`
+}
+
+func loadPolicy(filename string) (*policy, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read policy %s err: %w", filename, err)
+	}
+
+	p := &policy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("decode policy %s err: %w", filename, err)
+	}
+
+	for id, perms := range p.Clients {
+		for i, v := range perms {
+			if !strings.HasPrefix(v.Path, "/") {
+				return nil, fmt.Errorf("client %s invalid path %q", id, v.Path)
+			}
+			if strings.Trim(v.Perm, "rw") != "" || v.Perm == "" {
+				return nil, fmt.Errorf("client %s invalid perm %q", id, v.Perm)
+			}
+			perms[i].Path = path.Clean(v.Path)
+		}
+	}
+
+	return p, nil
+}
+
+// match returns the permission of the longest path prefix granted to identity
+func (p *policy) match(identity, urlPath string) (perm string, ok bool) {
+	urlPath = path.Clean("/" + urlPath)
+	longest := -1
+	for _, id := range []string{identity, anyClient} {
+		for _, v := range p.Clients[id] {
+			if !pathHasPrefix(urlPath, v.Path) || len(v.Path) <= longest {
+				continue
+			}
+			longest = len(v.Path)
+			perm, ok = v.Perm, true
+		}
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+func pathHasPrefix(urlPath, prefix string) bool {
+	if prefix == "/" || urlPath == prefix {
+		return true
+	}
+	return strings.HasPrefix(urlPath, prefix+"/")
+}
+
+func (p *policy) allow(identity string, r *http.Request) bool {
+	perm, ok := p.match(identity, requestFilePath(r))
+	if !ok {
+		return false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return strings.Contains(perm, "r")
+	default:
+		return strings.Contains(perm, "w")
+	}
+}
+
+// clientIdentity returns the CommonName of the verified client certificate
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// accessControl rejects requests not granted by p, a nil policy allows every verified client
+func accessControl(p *policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := clientIdentity(r)
+		if identity == "" || (p != nil && !p.allow(identity, r)) {
+			logger.Warn("access denied",
+				zap.String("raddr", r.RemoteAddr),
+				zap.String("client", identity),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+			)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca %s err: %w", filename, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificate found in client ca %s", filename)
+	}
+	return pool, nil
+}
+
+// tlsConfig loads the server certificate and optionally requires client certificates signed by clientCA
+func tlsConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load cert %s err: %w", certFile, err)
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCA != "" {
+		conf.ClientCAs, err = loadClientCAs(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func testPolicy() *policy {
+	return &policy{Clients: map[string][]permission{
+		"alice": {
+			{Path: "/", Perm: "r"},
+			{Path: "/home/alice", Perm: "rw"},
+			{Path: "/home/alice/ro", Perm: "r"},
+		},
+		"bob": {
+			{Path: "/home/bob", Perm: "rw"},
+		},
+		anyClient: {
+			{Path: "/pub", Perm: "r"},
+			{Path: "/pub/drop", Perm: "w"},
+		},
+	}}
+}
+
+// go test -run ^TestPolicyMatch$ .
+func TestPolicyMatch(t *testing.T) {
+	p := testPolicy()
+	cases := []struct {
+		identity, path string
+		perm           string
+		ok             bool
+	}{
+		{"alice", "/etc/passwd", "r", true},
+		{"alice", "/home/alice/a.txt", "rw", true},
+		{"alice", "/home/alice", "rw", true},
+		{"alice", "/home/alice/ro/x", "r", true},
+		{"alice", "/home/alicex/y", "r", true}, // not below /home/alice, falls back to /
+		{"alice", "/home/alice/../bob/x", "r", true},
+		{"bob", "/home/bob/x", "rw", true},
+		{"bob", "/home/bobby", "", false},
+		{"bob", "/pub/a", "r", true}, // only the * grants
+		{"bob", "/pub/drop/a", "w", true},
+		{"bob", "/", "", false},
+		{"carol", "/pub", "r", true},
+		{"carol", "pub/x", "r", true},
+		{"carol", "/public", "", false},
+		{"alice", "/pub/drop/a", "r", true}, // her own / wins over the * grants
+	}
+	for _, v := range cases {
+		perm, ok := p.match(v.identity, v.path)
+		if perm != v.perm || ok != v.ok {
+			t.Errorf("%s %s expect: %q %v, got: %q %v", v.identity, v.path, v.perm, v.ok, perm, ok)
+		}
+	}
+}
+
+// go test -run ^TestPolicyAllow$ .
+func TestPolicyAllow(t *testing.T) {
+	p := testPolicy()
+	cases := []struct {
+		identity, method, target string
+		allow                    bool
+	}{
+		{"alice", "GET", "/api/file/home/bob/x", true},
+		{"alice", "PUT", "/api/file/home/bob/x", false},
+		{"alice", "PUT", "/api/file/home/alice/x", true},
+		{"alice", "DELETE", "/api/file/home/alice/ro/x", false},
+		{"bob", "GET", "/api/ls?path=/home/bob", true},
+		{"bob", "GET", "/api/ls?path=/home", false},
+		{"carol", "PUT", "/api/file/pub/drop/x", true},
+		{"carol", "GET", "/api/file/pub/drop/x", false},
+		{"carol", "HEAD", "/api/file/pub/x", true},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, v.target, nil)
+		if allow := p.allow(v.identity, r); allow != v.allow {
+			t.Errorf("%s %s %s expect: %v, got: %v", v.identity, v.method, v.target, v.allow, allow)
+		}
+	}
+}
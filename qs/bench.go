@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const benchPrefix = "/api/bench"
+
+// benchData is random so that transfers can't be compressed on the way
+var benchData = func() []byte {
+	b := make([]byte, 64<<10)
+	mrand.New(mrand.NewSource(time.Now().UnixNano())).Read(b)
+	return b
+}()
+
+type benchStat struct {
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// benchHandler generates(GET ?size=N) or consumes(PUT/POST body) N bytes without touching disk,
+// N is capped by maxSize so that the endpoint can't be used to drain the uplink
+type benchHandler struct {
+	maxSize int64
+}
+
+func (b *benchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid size %q", r.URL.Query().Get("size")))
+			return
+		}
+		if size > b.maxSize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("size %d exceeds %d", size, b.maxSize))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		for size > 0 {
+			data := benchData
+			if size < int64(len(data)) {
+				data = data[:size]
+			}
+			n, err := w.Write(data)
+			if err != nil {
+				return
+			}
+			size -= int64(n)
+		}
+	case http.MethodPut, http.MethodPost:
+		start := time.Now()
+		n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, b.maxSize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d", b.maxSize))
+				return
+			}
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &benchStat{
+			Bytes:      n,
+			DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"quicutil"
+)
+
+// casPrefix serves the dedup upload api of the content addressed store:
+//
+//	POST /api/cas/have?path=<file>           {"chunks":[sha256...]} -> {"missing":[sha256...]}
+//	PUT  /api/cas/chunk/<sha256>?path=<file> chunk bytes
+//	PUT  /api/cas/manifest?path=<file>       {"chunks":[{"hash":sha256,"size":n}...]} -> fileInfo
+//
+// path is only used for access control of have and chunk requests.
+// A client only gets credit for chunks it uploaded itself or which are referred to by
+// a manifest it owns, every other chunk is reported missing and has to be sent once,
+// so have can't be used to probe for content and manifest can't claim files of others
+const casPrefix = "/api/cas"
+
+var (
+	errMissingChunks = errors.New("missing chunks")
+	errChunkHash     = errors.New("chunk hash mismatch")
+)
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// manifest maps a file path to its chunks
+type manifest struct {
+	Size   int64             `json:"size"`
+	MTime  time.Time         `json:"mtime"`
+	Owner  string            `json:"owner,omitempty"`
+	Hash   map[string]string `json:"hash,omitempty"`
+	Chunks []chunkRef        `json:"chunks"`
+}
+
+func (m *manifest) fileInfo(urlPath string) *fileInfo {
+	return &fileInfo{
+		Name:  path.Base(urlPath),
+		Path:  urlPath,
+		Size:  m.Size,
+		Mode:  fs.FileMode(0644).String(),
+		MTime: m.MTime,
+		Hash:  m.Hash,
+	}
+}
+
+// casStore keeps chunks by sha256 below dir/chunks and the manifests of
+// uploaded files below dir/manifests, a chunk is removed once no manifest refers to it.
+// Chunks sent with no manifest following them are removed grace after they were sent
+type casStore struct {
+	dir   string
+	grace time.Duration
+
+	mu      sync.Mutex
+	refs    map[string]int                 // manifest references of a chunk
+	owners  map[string]map[string]struct{} // identities which sent a chunk or own a manifest referring to it
+	pending map[string]time.Time           // chunks sent and not referred to by a manifest yet
+	swept   time.Time
+}
+
+func newCASStore(dir string, grace time.Duration) (*casStore, error) {
+	for _, v := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, v), 0755); err != nil {
+			return nil, err
+		}
+	}
+	c := &casStore{
+		dir:     dir,
+		grace:   grace,
+		refs:    map[string]int{},
+		owners:  map[string]map[string]struct{}{},
+		pending: map[string]time.Time{},
+		swept:   time.Now(),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load counts the chunk references of all manifests and removes the chunks of
+// interrupted uploads and overwritten files no manifest refers to
+func (c *casStore) load() error {
+	manifests := filepath.Join(c.dir, "manifests")
+	err := filepath.WalkDir(manifests, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(filename, ".json") || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(manifests, strings.TrimSuffix(filename, ".json"))
+		if err != nil {
+			return err
+		}
+		m, err := c.loadManifest(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		c.retain(m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed, freed int64
+	err = filepath.WalkDir(filepath.Join(c.dir, "chunks"), func(filename string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || c.refs[d.Name()] > 0 {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("cas store",
+		zap.String("dir", c.dir),
+		zap.Int("chunks", len(c.refs)),
+		zap.Int64("removed", removed),
+		zap.Int64("freed", freed),
+	)
+	return nil
+}
+
+func validChunkHash(sum string) bool {
+	if len(sum) != 2*sha256.Size || strings.ToLower(sum) != sum {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+func (c *casStore) chunkPath(sum string) string {
+	return filepath.Join(c.dir, "chunks", sum[:2], sum)
+}
+
+func (c *casStore) manifestPath(urlPath string) string {
+	return filepath.Join(c.dir, "manifests", filepath.FromSlash(path.Clean("/"+urlPath))) + ".json"
+}
+
+// missing returns the chunks of sums not in the store or not owned by identity
+func (c *casStore) missing(identity string, sums []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.missingLocked(identity, sums)
+}
+
+func (c *casStore) missingLocked(identity string, sums []string) []string {
+	missing := []string{}
+	for _, sum := range sums {
+		if _, ok := c.owners[sum][identity]; !ok {
+			missing = append(missing, sum)
+			continue
+		}
+		if _, err := os.Stat(c.chunkPath(sum)); err != nil {
+			missing = append(missing, sum)
+		}
+	}
+	return missing
+}
+
+func (c *casStore) ownLocked(sum, identity string) {
+	owners, ok := c.owners[sum]
+	if !ok {
+		owners = map[string]struct{}{}
+		c.owners[sum] = owners
+	}
+	owners[identity] = struct{}{}
+}
+
+// retain adds the chunk references of m
+func (c *casStore) retain(m *manifest) {
+	for _, v := range m.Chunks {
+		c.refs[v.Hash]++
+		c.ownLocked(v.Hash, m.Owner)
+		delete(c.pending, v.Hash)
+	}
+}
+
+// release drops the chunk references of m and removes the chunks no manifest refers to
+// any more, unless they were just sent again for an upload in progress, returns the bytes freed
+func (c *casStore) release(m *manifest) (freed int64) {
+	for _, v := range m.Chunks {
+		if c.refs[v.Hash]--; c.refs[v.Hash] > 0 {
+			continue
+		}
+		delete(c.refs, v.Hash)
+		if _, ok := c.pending[v.Hash]; ok {
+			continue
+		}
+		freed += c.removeChunkLocked(v.Hash)
+	}
+	return freed
+}
+
+// removeChunkLocked removes the unreferenced chunk sum, returns its size
+func (c *casStore) removeChunkLocked(sum string) int64 {
+	delete(c.owners, sum)
+	delete(c.pending, sum)
+	filename := c.chunkPath(sum)
+	fi, err := os.Stat(filename)
+	if err == nil {
+		err = os.Remove(filename)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn("remove chunk error",
+				zap.String("hash", sum),
+				zap.Error(err),
+			)
+		}
+		return 0
+	}
+	return fi.Size()
+}
+
+// sweep removes the chunks sent more than grace ago which no manifest refers to,
+// it runs at most every grace/4 and returns the bytes freed
+func (c *casStore) sweep(now time.Time) (freed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.swept) < c.grace/4 {
+		return 0
+	}
+	c.swept = now
+
+	removed := 0
+	for sum, sent := range c.pending {
+		if now.Sub(sent) < c.grace {
+			continue
+		}
+		delete(c.pending, sum)
+		if c.refs[sum] == 0 {
+			freed += c.removeChunkLocked(sum)
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.Info("sweep unreferenced chunks",
+			zap.Int("removed", removed),
+			zap.Int64("freed", freed),
+		)
+	}
+	return freed
+}
+
+// have reports if chunk sum exists, and if so credits it to identity
+func (c *casStore) have(identity, sum string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(c.chunkPath(sum)); err != nil {
+		return false
+	}
+	c.ownLocked(sum, identity)
+	c.pending[sum] = time.Now()
+	return true
+}
+
+// add moves the chunk written to tmp into the store and credits it to identity,
+// returns false if a concurrent upload stored the chunk first
+func (c *casStore) add(identity, sum, tmp string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	filename := c.chunkPath(sum)
+	stored := false
+	if _, err := os.Stat(filename); err != nil {
+		if err := os.Rename(tmp, filename); err != nil {
+			os.Remove(tmp)
+			return false, err
+		}
+		stored = true
+	} else {
+		os.Remove(tmp)
+	}
+	c.ownLocked(sum, identity)
+	c.pending[sum] = time.Now()
+	return stored, nil
+}
+
+// discard removes the chunks of sums a failed upload of identity stored which nobody
+// else sent and no manifest refers to, returns the bytes freed
+func (c *casStore) discard(identity string, sums []string) (freed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sum := range sums {
+		owners := c.owners[sum]
+		if _, ok := owners[identity]; !ok || len(owners) != 1 || c.refs[sum] > 0 {
+			continue
+		}
+		freed += c.removeChunkLocked(sum)
+	}
+	return freed
+}
+
+func (c *casStore) loadManifest(urlPath string) (*manifest, error) {
+	b, err := os.ReadFile(c.manifestPath(urlPath))
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", urlPath, err)
+	}
+	return m, nil
+}
+
+// writeFile atomically replaces filename with data
+func writeFile(filename string, data []byte, w func(io.Writer) io.Writer) error {
+	tmp, err := writeTemp(filename, data, w)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes data to a temporary file next to filename, returns its name
+func writeTemp(filename string, data []byte, w func(io.Writer) io.Writer) (string, error) {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = w(tmp).Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// commit saves m as the manifest of urlPath if its owner owns all its chunks and releases
+// the manifest it replaces, returns the bytes freed
+func (c *casStore) commit(urlPath string, m *manifest) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sums := make([]string, len(m.Chunks))
+	for i, v := range m.Chunks {
+		sums[i] = v.Hash
+	}
+	if missing := c.missingLocked(m.Owner, sums); len(missing) > 0 {
+		return 0, fmt.Errorf("%w: %d", errMissingChunks, len(missing))
+	}
+	old, err := c.loadManifest(urlPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFile(c.manifestPath(urlPath), b, func(w io.Writer) io.Writer { return w }); err != nil {
+		return 0, err
+	}
+	c.retain(m)
+	if old == nil {
+		return 0, nil
+	}
+	return c.release(old), nil
+}
+
+// remove deletes the manifest of urlPath, returns the bytes freed
+func (c *casStore) remove(urlPath string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, err := c.loadManifest(urlPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if err := os.Remove(c.manifestPath(urlPath)); err != nil {
+		return 0, err
+	}
+	if m == nil {
+		return 0, nil
+	}
+	return c.release(m), nil
+}
+
+// casReader reads the chunks of a manifest as one file
+type casReader struct {
+	store  *casStore
+	chunks []chunkRef
+	starts []int64 // offset of every chunk
+	size   int64
+	off    int64
+	idx    int
+	f      *os.File // chunk idx
+}
+
+func (c *casStore) reader(m *manifest) *casReader {
+	r := &casReader{
+		store:  c,
+		chunks: m.Chunks,
+		starts: make([]int64, len(m.Chunks)),
+		size:   m.Size,
+	}
+	var off int64
+	for i, v := range m.Chunks {
+		r.starts[i] = off
+		off += v.Size
+	}
+	return r
+}
+
+func (r *casReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	idx := sort.Search(len(r.starts), func(i int) bool { return r.starts[i] > r.off }) - 1
+	if r.f == nil || idx != r.idx {
+		if r.f != nil {
+			r.f.Close()
+		}
+		f, err := os.Open(r.store.chunkPath(r.chunks[idx].Hash))
+		if err != nil {
+			r.f = nil
+			return 0, err
+		}
+		r.f, r.idx = f, idx
+	}
+
+	chunkOff := r.off - r.starts[idx]
+	if rest := r.chunks[idx].Size - chunkOff; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := r.f.ReadAt(p, chunkOff)
+	r.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *casReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *casReader) Close() error {
+	if r.f != nil {
+		return r.f.Close()
+	}
+	return nil
+}
+
+// serveManifest serves urlPath from the store, returns false if it has no manifest
+func (a *fileAPI) serveManifest(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	m, err := a.cas.loadManifest(urlPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return true
+	}
+
+	if sum, ok := m.Hash["sha256"]; ok {
+		w.Header().Set("Etag", `"`+sum+`"`)
+	}
+	rd := a.cas.reader(m)
+	defer rd.Close()
+	http.ServeContent(w, r, path.Base(urlPath), m.MTime, rd)
+	return true
+}
+
+// putChunk stores data as chunk sum owned by identity, returns false if the chunk already exists
+func (a *fileAPI) putChunk(identity, sum string, data []byte) (bool, error) {
+	if actual := sha256.Sum256(data); hex.EncodeToString(actual[:]) != sum {
+		return false, errChunkHash
+	}
+	a.used.Add(-a.cas.sweep(time.Now()))
+	if a.cas.have(identity, sum) {
+		return false, nil
+	}
+
+	// written outside the store lock so that concurrent chunk uploads don't wait for each other
+	qw := &quotaWriter{api: a}
+	tmp, err := writeTemp(a.cas.chunkPath(sum), data, func(w io.Writer) io.Writer {
+		qw.w = w
+		return qw
+	})
+	if err != nil {
+		a.used.Add(-qw.n)
+		return false, err
+	}
+	stored, err := a.cas.add(identity, sum, tmp)
+	if !stored {
+		a.used.Add(-qw.n)
+	}
+	return stored, err
+}
+
+// storeCAS chunks src into the store and saves the manifest of urlPath owned by identity,
+// the chunks it stored are removed again if it fails
+func (a *fileAPI) storeCAS(identity, urlPath string, src io.Reader) (info *fileInfo, err error) {
+	var added []string
+	defer func() {
+		if err != nil {
+			a.used.Add(-a.cas.discard(identity, added))
+		}
+	}()
+
+	hashers := a.newHashers()
+	if a.maxSize > 0 {
+		src = io.LimitReader(src, a.maxSize+1)
+	}
+
+	m := &manifest{Owner: identity}
+	var stored int64
+	ch := quicutil.NewChunker(src)
+	for {
+		data, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Size += int64(len(data))
+		if a.maxSize > 0 && m.Size > a.maxSize {
+			return nil, errTooLarge
+		}
+		for _, h := range hashers {
+			h.Write(data)
+		}
+
+		sum := sha256.Sum256(data)
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		ok, err := a.putChunk(identity, ref.Hash, data)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			stored += ref.Size
+			added = append(added, ref.Hash)
+		}
+		m.Chunks = append(m.Chunks, ref)
+	}
+	return a.saveManifest(urlPath, m, hashers, stored)
+}
+
+func (a *fileAPI) saveManifest(urlPath string, m *manifest, hashers map[string]hash.Hash, stored int64) (*fileInfo, error) {
+	m.MTime = time.Now().UTC()
+	m.Hash = make(map[string]string, len(hashers))
+	for name, h := range hashers {
+		m.Hash[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	freed, err := a.cas.commit(urlPath, m)
+	if err != nil {
+		return nil, err
+	}
+	a.used.Add(-freed)
+
+	logger.Info("upload success",
+		zap.String("path", urlPath),
+		zap.Int64("size", m.Size),
+		zap.Int("chunks", len(m.Chunks)),
+		zap.Int64("stored", stored),
+		zap.Int64("freed", freed),
+		zap.Any("hash", m.Hash),
+	)
+	return m.fileInfo(urlPath), nil
+}
+
+func (a *fileAPI) serveCAS(w http.ResponseWriter, r *http.Request) {
+	if a.cas == nil {
+		writeError(w, http.StatusNotFound, errors.New("cas store disabled"))
+		return
+	}
+	if err := decodeBody(r); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+
+	switch {
+	case r.URL.Path == casPrefix+"/have" && r.Method == http.MethodPost:
+		a.casHave(w, r)
+	case strings.HasPrefix(r.URL.Path, casPrefix+"/chunk/") && r.Method == http.MethodPut:
+		a.casChunk(w, r, strings.TrimPrefix(r.URL.Path, casPrefix+"/chunk/"))
+	case r.URL.Path == casPrefix+"/manifest" && r.Method == http.MethodPut:
+		a.casManifest(w, r, requestFilePath(r))
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s not found", r.Method, r.URL.Path))
+	}
+}
+
+func (a *fileAPI) casHave(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Chunks []string `json:"chunks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, sum := range req.Chunks {
+		if !validChunkHash(sum) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chunk hash %q", sum))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"missing": a.cas.missing(clientIdentity(r), req.Chunks)})
+}
+
+func (a *fileAPI) casChunk(w http.ResponseWriter, r *http.Request, sum string) {
+	if !validChunkHash(sum) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chunk hash %q", sum))
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, quicutil.CDCMaxSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(data) > quicutil.CDCMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("chunk larger than %d", quicutil.CDCMaxSize))
+		return
+	}
+
+	stored, err := a.putChunk(clientIdentity(r), sum, data)
+	if errors.Is(err, errChunkHash) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		a.uploadError(w, r, requestFilePath(r), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"hash": sum, "size": len(data), "stored": stored})
+}
+
+func (a *fileAPI) casManifest(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if urlPath == "/" {
+		writeError(w, http.StatusBadRequest, errors.New("missing file name"))
+		return
+	}
+	m := &manifest{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	m.Owner = clientIdentity(r)
+
+	sums := make([]string, len(m.Chunks))
+	m.Size = 0
+	for i, v := range m.Chunks {
+		if !validChunkHash(v.Hash) || v.Size <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chunk %+v", v))
+			return
+		}
+		sums[i] = v.Hash
+		m.Size += v.Size
+	}
+	if a.maxSize > 0 && m.Size > a.maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+		return
+	}
+	if missing := a.cas.missing(m.Owner, sums); len(missing) > 0 {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": errMissingChunks.Error(), "missing": missing})
+		return
+	}
+	for _, v := range m.Chunks {
+		fi, err := os.Stat(a.cas.chunkPath(v.Hash))
+		if err != nil || fi.Size() != v.Size {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("chunk %s size mismatch", v.Hash))
+			return
+		}
+	}
+
+	hashers := a.newHashers()
+	if len(hashers) > 0 {
+		rd := a.cas.reader(m)
+		_, err := io.Copy(io.MultiWriter(hashWriters(hashers)...), rd)
+		rd.Close()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	info, err := a.saveManifest(urlPath, m, hashers, 0)
+	if errors.Is(err, errMissingChunks) {
+		// a chunk was removed with the last manifest referring to it while hashing
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"error": errMissingChunks.Error(), "missing": a.cas.missing(m.Owner, sums)})
+		return
+	}
+	if err != nil {
+		a.uploadError(w, r, urlPath, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"quicutil"
+)
+
+func testData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func casRequest(identity, method, target string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.TLS = &tls.ConnectionState{
+		HandshakeComplete: true,
+		PeerCertificates:  []*x509.Certificate{{Subject: pkix.Name{CommonName: identity}}},
+	}
+	return r
+}
+
+func testChunks(t *testing.T, data []byte) (refs []chunkRef, chunks [][]byte) {
+	ch := quicutil.NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			return refs, chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(chunk)
+		refs = append(refs, chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))})
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func chunkFiles(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.Walk(filepath.Join(dir, "chunks"), func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// go test -run ^TestCASDedup$ .
+func TestCASDedup(t *testing.T) {
+	logger = zap.NewNop()
+	casDir := t.TempDir()
+	a, err := newFileAPI(t.TempDir(), casDir, time.Hour, []string{"sha256"}, 0, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(r.URL.Path, casPrefix+"/") {
+			a.serveCAS(w, r)
+		} else {
+			a.ServeHTTP(w, r)
+		}
+		return w
+	}
+	missing := func(identity string, refs []chunkRef) int {
+		sums := []string{}
+		for _, v := range refs {
+			sums = append(sums, v.Hash)
+		}
+		b, _ := json.Marshal(map[string][]string{"chunks": sums})
+		w := serve(casRequest(identity, http.MethodPost, casPrefix+"/have?path=/x", b))
+		rsp := struct {
+			Missing []string `json:"missing"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatalf("have %d %s", w.Code, w.Body.String())
+		}
+		return len(rsp.Missing)
+	}
+	putManifest := func(identity, urlPath string, refs []chunkRef) int {
+		b, _ := json.Marshal(map[string][]chunkRef{"chunks": refs})
+		return serve(casRequest(identity, http.MethodPut, casPrefix+"/manifest?path="+urlPath, b)).Code
+	}
+
+	data := testData(1, 6<<20)
+	refs, chunks := testChunks(t, data)
+	if w := serve(casRequest("alice", http.MethodPut, fileAPIPrefix+"/a", data)); w.Code != http.StatusCreated {
+		t.Fatalf("put a expect: %d, got: %d %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	used := a.used.Load()
+	if used != int64(len(data)) {
+		t.Errorf("used expect: %d, got: %d", len(data), used)
+	}
+
+	// the chunks exist, but bob never sent them
+	if n := missing("alice", refs); n != 0 {
+		t.Errorf("alice missing expect: 0, got: %d", n)
+	}
+	if n := missing("bob", refs); n != len(refs) {
+		t.Errorf("bob missing expect: %d, got: %d", len(refs), n)
+	}
+	if code := putManifest("bob", "/b", refs); code != http.StatusConflict {
+		t.Errorf("bob manifest expect: %d, got: %d", http.StatusConflict, code)
+	}
+
+	for i, v := range refs {
+		if w := serve(casRequest("bob", http.MethodPut, casPrefix+"/chunk/"+v.Hash+"?path=/b", chunks[i])); w.Code != http.StatusCreated {
+			t.Fatalf("bob chunk expect: %d, got: %d %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	if code := putManifest("bob", "/b", refs); code != http.StatusCreated {
+		t.Fatalf("bob manifest expect: %d, got: %d", http.StatusCreated, code)
+	}
+	if used := a.used.Load(); used != int64(len(data)) {
+		t.Errorf("used after dedup expect: %d, got: %d", len(data), used)
+	}
+	w := serve(casRequest("bob", http.MethodGet, fileAPIPrefix+"/b", nil))
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("get b expect: %d bytes, got: %d %d bytes", len(data), w.Code, w.Body.Len())
+	}
+
+	// chunks are removed with the last manifest referring to them
+	cases := []struct {
+		identity, method, path string
+		body                   []byte
+		chunks                 int
+		used                   int64
+	}{
+		{"alice", http.MethodDelete, "/a", nil, len(refs), int64(len(data))},
+		{"bob", http.MethodPut, "/b", data[:1000], 1, 1000},
+		{"bob", http.MethodDelete, "/b", nil, 0, 0},
+	}
+	for _, v := range cases {
+		w := serve(casRequest(v.identity, v.method, fileAPIPrefix+v.path, v.body))
+		if w.Code/100 != 2 {
+			t.Fatalf("%s %s expect: 2xx, got: %d %s", v.method, v.path, w.Code, w.Body.String())
+		}
+		if n := chunkFiles(t, casDir); n != v.chunks {
+			t.Errorf("%s %s chunks expect: %d, got: %d", v.method, v.path, v.chunks, n)
+		}
+		if used := a.used.Load(); used != v.used {
+			t.Errorf("%s %s used expect: %d, got: %d", v.method, v.path, v.used, used)
+		}
+	}
+}
+
+// go test -run ^TestCASLoad$ .
+func TestCASLoad(t *testing.T) {
+	logger = zap.NewNop()
+	casDir := t.TempDir()
+	a, err := newFileAPI(t.TempDir(), casDir, time.Hour, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(1, 3<<20)
+	if _, err := a.store("alice", "/a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	refs, chunks := testChunks(t, testData(2, 1000))
+	if _, err := a.putChunk("alice", refs[0].Hash, chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	before := chunkFiles(t, casDir)
+
+	// the chunk of the interrupted upload is removed, the owner is restored from the manifest
+	c, err := newCASStore(casDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := chunkFiles(t, casDir); n != before-1 {
+		t.Errorf("chunks expect: %d, got: %d", before-1, n)
+	}
+	dataRefs, _ := testChunks(t, data)
+	for _, v := range dataRefs {
+		if c.refs[v.Hash] != 1 {
+			t.Errorf("refs of %s expect: 1, got: %d", v.Hash, c.refs[v.Hash])
+		}
+		if _, ok := c.owners[v.Hash]["alice"]; !ok {
+			t.Errorf("owner of %s expect: alice", v.Hash)
+		}
+	}
+}
+
+// go test -run ^TestCASSweep$ .
+func TestCASSweep(t *testing.T) {
+	logger = zap.NewNop()
+	casDir := t.TempDir()
+	a, err := newFileAPI(t.TempDir(), casDir, time.Hour, nil, 0, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, chunks := testChunks(t, testData(1, 3<<20))
+	for i := range refs[1:] {
+		if _, err := a.putChunk("alice", refs[i+1].Hash, chunks[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.cas.commit("/a", &manifest{Owner: "alice", Chunks: refs[1:2]}); err != nil {
+		t.Fatal(err)
+	}
+	before := a.used.Load()
+
+	// only the chunks sent more than grace ago which no manifest refers to are removed
+	cases := []struct {
+		name   string
+		now    time.Time
+		chunks int
+	}{
+		{"within grace", time.Now().Add(30 * time.Minute), len(refs) - 1},
+		{"after grace", time.Now().Add(2 * time.Hour), 1},
+	}
+	for _, v := range cases {
+		a.used.Add(-a.cas.sweep(v.now))
+		if n := chunkFiles(t, casDir); n != v.chunks {
+			t.Errorf("%s chunks expect: %d, got: %d", v.name, v.chunks, n)
+		}
+	}
+	if used := a.used.Load(); used != refs[1].Size {
+		t.Errorf("used expect: %d, got: %d (before %d)", refs[1].Size, used, before)
+	}
+}
+
+// go test -run ^TestCASStoreRollback$ .
+func TestCASStoreRollback(t *testing.T) {
+	logger = zap.NewNop()
+	casDir := t.TempDir()
+	a, err := newFileAPI(t.TempDir(), casDir, time.Hour, nil, 3<<20-1, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(1, 3<<20)
+	refs, chunks := testChunks(t, data)
+	if _, err := a.putChunk("bob", refs[0].Hash, chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload fails at its last chunk, the chunks it stored are removed, bob's chunk is kept
+	if _, err := a.store("alice", "/a", bytes.NewReader(data)); err != errTooLarge {
+		t.Fatalf("expect: %v, got: %v", errTooLarge, err)
+	}
+	if n := chunkFiles(t, casDir); n != 1 {
+		t.Errorf("chunks expect: 1, got: %d", n)
+	}
+	if used := a.used.Load(); used != refs[0].Size {
+		t.Errorf("used expect: %d, got: %d", refs[0].Size, used)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// minCompressSize skips compressing responses too small to benefit
+const minCompressSize = 1024
+
+// encodings in server preference order, with the extension of pre-compressed siblings
+var encodings = []struct {
+	name string
+	ext  string
+}{
+	{"zstd", ".zst"},
+	{"gzip", ".gz"},
+}
+
+var (
+	zstdEncoders = sync.Pool{New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+)
+
+// acceptedEncodings returns the encodings of an Accept-Encoding header we support, in our preference order
+func acceptedEncodings(header string) []string {
+	accepted := map[string]bool{}
+	for _, v := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+
+	names := []string{}
+	for _, v := range encodings {
+		if ok, set := accepted[v.name]; ok || (!set && accepted["*"]) {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(64<<20))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decodeBody replaces the body of a request with Content-Encoding by the decoded body
+func decodeBody(r *http.Request) error {
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	body, err := newDecoder(encoding, r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return nil
+}
+
+// compressHandler negotiates Content-Encoding, serving file.zst/file.gz siblings
+// below root when present and compressing compressible responses on the fly
+func compressHandler(root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// webtransport needs the http3 ResponseWriter, ranges of a compressed stream make no sense
+		if r.Method == http.MethodConnect || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		names := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+		if len(names) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && servePrecompressed(w, r, root, names) {
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, method: r.Method, encoding: names[0]}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// servePrecompressed serves the first sibling of the requested file matching names
+func servePrecompressed(w http.ResponseWriter, r *http.Request, root string, names []string) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, fileAPIPrefix+"/") {
+		return false
+	}
+	urlPath := requestFilePath(r)
+	filename := filepath.Join(root, filepath.FromSlash(urlPath))
+	if fi, err := os.Stat(filename); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	for _, v := range encodings {
+		if !contains(names, v.name) {
+			continue
+		}
+		f, err := os.Open(filename + v.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(urlPath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", v.name)
+		w.Header().Add("Vary", "Accept-Encoding")
+		logger.Debug("serve precompressed",
+			zap.String("path", urlPath),
+			zap.String("encoding", v.name),
+		)
+		http.ServeContent(w, r, path.Base(urlPath), fi.ModTime(), f)
+		return true
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the body if the response turns out to be compressible
+type compressWriter struct {
+	http.ResponseWriter
+	method   string
+	encoding string
+	decided  bool
+	enc      io.WriteCloser
+	flush    func() error
+}
+
+func (c *compressWriter) decide(status int) {
+	c.decided = true
+	h := c.Header()
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < minCompressSize {
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+	if c.method == http.MethodHead {
+		return
+	}
+
+	switch c.encoding {
+	case "zstd":
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(c.ResponseWriter)
+		c.enc, c.flush = enc, enc.Flush
+	case "gzip":
+		enc := gzipWriters.Get().(*gzip.Writer)
+		enc.Reset(c.ResponseWriter)
+		c.enc, c.flush = enc, enc.Flush
+	}
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.decide(status)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.decided {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if c.flush != nil {
+		c.flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Close() error {
+	if c.enc == nil {
+		return nil
+	}
+	err := c.enc.Close()
+	switch enc := c.enc.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdEncoders.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(nil)
+		gzipWriters.Put(enc)
+	}
+	c.enc = nil
+	return err
+}
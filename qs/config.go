@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// loadConfig sets the flags of cmd from a json object keyed by flag name,
+// flags given on the command line take precedence
+func loadConfig(cmd *cobra.Command, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read config err: %w", err)
+	}
+	values := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("decode config %s err: %w", filename, err)
+	}
+
+	for name, v := range values {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("unknown config option %q", name)
+		}
+		if flag.Changed {
+			continue
+		}
+		value := fmt.Sprint(v)
+		if list, ok := v.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		}
+		if err := cmd.Flags().Set(name, value); err != nil {
+			return fmt.Errorf("config option %s err: %w", name, err)
+		}
+	}
+	return nil
+}
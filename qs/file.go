@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const fileAPIPrefix = "/api/file"
+
+var (
+	errQuotaExceeded = errors.New("quota exceeded")
+	errTooLarge      = errors.New("request body too large")
+)
+
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+type fileInfo struct {
+	Name  string            `json:"name"`
+	Path  string            `json:"path,omitempty"`
+	Size  int64             `json:"size"`
+	Mode  string            `json:"mode"`
+	MTime time.Time         `json:"mtime"`
+	IsDir bool              `json:"dir,omitempty"`
+	Hash  map[string]string `json:"hash,omitempty"`
+}
+
+func newFileInfo(urlPath string, fi fs.FileInfo) *fileInfo {
+	return &fileInfo{
+		Name:  fi.Name(),
+		Path:  urlPath,
+		Size:  fi.Size(),
+		Mode:  fi.Mode().String(),
+		MTime: fi.ModTime().UTC(),
+		IsDir: fi.IsDir(),
+	}
+}
+
+// fileAPI serves GET/HEAD/PUT/POST/DELETE on /api/file/<path> below root
+type fileAPI struct {
+	root    string
+	hashes  []string
+	maxSize int64 // max bytes of one upload, 0 means unlimited
+	quota   int64 // max bytes of all files below root, 0 means unlimited
+	used    atomic.Int64
+	files   http.Handler
+	cas     *casStore // store uploads as deduplicated chunks if set
+}
+
+func newFileAPI(root, casDir string, casGrace time.Duration, hashes []string, maxSize, quota int64) (*fileAPI, error) {
+	for _, v := range hashes {
+		if _, ok := hashFuncs[v]; !ok {
+			return nil, fmt.Errorf("unsupported hash %s", v)
+		}
+	}
+
+	a := &fileAPI{
+		root:    root,
+		hashes:  hashes,
+		maxSize: maxSize,
+		quota:   quota,
+		files:   http.StripPrefix(fileAPIPrefix, http.FileServer(http.Dir(root))),
+	}
+	if casDir != "" {
+		var err error
+		if a.cas, err = newCASStore(casDir, casGrace); err != nil {
+			return nil, fmt.Errorf("open cas store %s err: %w", casDir, err)
+		}
+	}
+
+	if quota > 0 {
+		used, err := dirSize(root)
+		if err != nil {
+			return nil, fmt.Errorf("calculate %s usage err: %w", root, err)
+		}
+		if a.cas != nil {
+			chunks, err := dirSize(filepath.Join(casDir, "chunks"))
+			if err != nil {
+				return nil, fmt.Errorf("calculate %s usage err: %w", casDir, err)
+			}
+			used += chunks
+		}
+		a.used.Store(used)
+		logger.Info("quota",
+			zap.String("root", root),
+			zap.Int64("quota", quota),
+			zap.Int64("used", used),
+		)
+	}
+	return a, nil
+}
+
+func dirSize(root string) (size int64, err error) {
+	err = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// requestFilePath returns the slash separated file path a request refers to
+func requestFilePath(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, fileAPIPrefix+"/") || r.URL.Path == fileAPIPrefix {
+		return path.Clean("/" + strings.TrimPrefix(r.URL.Path, fileAPIPrefix))
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return path.Clean("/" + r.URL.Query().Get("path"))
+	}
+	return path.Clean("/" + r.URL.Path)
+}
+
+// localPath maps a slash separated url path to a file below root
+func (a *fileAPI) localPath(urlPath string) string {
+	return filepath.Join(a.root, filepath.FromSlash(path.Clean("/"+urlPath)))
+}
+
+func (a *fileAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := requestFilePath(r)
+	if err := decodeBody(r); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if a.cas != nil && a.serveManifest(w, r, urlPath) {
+			return
+		}
+		a.files.ServeHTTP(w, r)
+	case http.MethodPut:
+		a.put(w, r, urlPath)
+	case http.MethodPost:
+		a.post(w, r, urlPath)
+	case http.MethodDelete:
+		a.delete(w, r, urlPath)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// put stores the request body as urlPath
+func (a *fileAPI) put(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if urlPath == "/" || strings.HasSuffix(r.URL.Path, "/") {
+		writeError(w, http.StatusBadRequest, errors.New("missing file name"))
+		return
+	}
+	if a.maxSize > 0 && r.ContentLength > a.maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+		return
+	}
+
+	info, err := a.store(clientIdentity(r), urlPath, r.Body)
+	if err != nil {
+		a.uploadError(w, r, urlPath, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// post stores every file part of a multipart/form-data body below directory urlPath
+func (a *fileAPI) post(w http.ResponseWriter, r *http.Request, urlPath string) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	infos := []*fileInfo{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		info, err := a.store(clientIdentity(r), path.Join(urlPath, path.Base("/"+filepath.ToSlash(name))), part)
+		part.Close()
+		if err != nil {
+			a.uploadError(w, r, urlPath, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusCreated, infos)
+}
+
+func (a *fileAPI) uploadError(w http.ResponseWriter, r *http.Request, urlPath string, err error) {
+	logger.Warn("upload error",
+		zap.String("raddr", r.RemoteAddr),
+		zap.String("path", urlPath),
+		zap.Error(err),
+	)
+
+	switch {
+	case errors.Is(err, errTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+	case errors.Is(err, errQuotaExceeded):
+		writeError(w, http.StatusInsufficientStorage, err)
+	case errors.Is(err, fs.ErrPermission):
+		writeError(w, http.StatusForbidden, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// store streams src to a temp file next to urlPath, hashing on the fly, and renames it into place,
+// identity owns the chunks of the upload with a cas store
+func (a *fileAPI) store(identity, urlPath string, src io.Reader) (*fileInfo, error) {
+	if a.cas != nil {
+		return a.storeCAS(identity, urlPath, src)
+	}
+
+	filename := a.localPath(urlPath)
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hashers := a.newHashers()
+	writers := append([]io.Writer{&quotaWriter{w: tmp, api: a}}, hashWriters(hashers)...)
+
+	if a.maxSize > 0 {
+		src = io.LimitReader(src, a.maxSize+1)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), src)
+	if err == nil && a.maxSize > 0 && n > a.maxSize {
+		err = errTooLarge
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+
+	var oldSize int64
+	if fi, statErr := os.Stat(filename); statErr == nil && fi.Mode().IsRegular() {
+		oldSize = fi.Size()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		a.used.Add(-n)
+		return nil, err
+	}
+	a.used.Add(-oldSize)
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	info := newFileInfo(urlPath, fi)
+	info.Hash = make(map[string]string, len(hashers))
+	for name, h := range hashers {
+		info.Hash[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	logger.Info("upload success",
+		zap.String("path", urlPath),
+		zap.Int64("size", n),
+		zap.Any("hash", info.Hash),
+	)
+	return info, nil
+}
+
+func (a *fileAPI) newHashers() map[string]hash.Hash {
+	hashers := make(map[string]hash.Hash, len(a.hashes))
+	for _, name := range a.hashes {
+		hashers[name] = hashFuncs[name]()
+	}
+	return hashers
+}
+
+func hashWriters(hashers map[string]hash.Hash) []io.Writer {
+	writers := make([]io.Writer, 0, len(hashers))
+	for _, h := range hashers {
+		writers = append(writers, h)
+	}
+	return writers
+}
+
+func (a *fileAPI) delete(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if a.cas != nil {
+		freed, err := a.cas.remove(urlPath)
+		if err == nil {
+			a.used.Add(-freed)
+			logger.Info("delete success",
+				zap.String("raddr", r.RemoteAddr),
+				zap.String("path", urlPath),
+				zap.Int64("freed", freed),
+			)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	filename := a.localPath(urlPath)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if fi.IsDir() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s is a directory", urlPath))
+		return
+	}
+	if err := os.Remove(filename); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	a.used.Add(-fi.Size())
+
+	logger.Info("delete success",
+		zap.String("raddr", r.RemoteAddr),
+		zap.String("path", urlPath),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// quotaWriter accounts written bytes against the fileAPI quota
+type quotaWriter struct {
+	w   io.Writer
+	api *fileAPI
+	n   int64 // bytes written
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	if used := q.api.used.Add(int64(len(p))); q.api.quota > 0 && used > q.api.quota {
+		q.api.used.Add(-int64(len(p)))
+		return 0, errQuotaExceeded
+	}
+	n, err := q.w.Write(p)
+	if n < len(p) {
+		q.api.used.Add(int64(n - len(p)))
+	}
+	q.n += int64(n)
+	return n, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("write json error",
+			zap.Error(err),
+		)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
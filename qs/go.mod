@@ -3,19 +3,22 @@ module qs
 go 1.20
 
 require (
+	github.com/klauspost/compress v1.16.7
 	github.com/quic-go/quic-go v0.33.0
+	github.com/quic-go/webtransport-go v0.5.2
 	github.com/spf13/cobra v1.7.0
 	go.uber.org/zap v1.24.0
+	quicutil v0.0.0-00010101000000-000000000000
 )
 
 require (
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
 	github.com/golang/mock v1.6.0 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/onsi/ginkgo/v2 v2.2.0 // indirect
 	github.com/quic-go/qpack v0.4.0 // indirect
-	github.com/quic-go/qtls-go1-18 v0.2.0 // indirect
 	github.com/quic-go/qtls-go1-19 v0.2.1 // indirect
 	github.com/quic-go/qtls-go1-20 v0.1.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
@@ -29,3 +32,5 @@ require (
 	golang.org/x/text v0.5.0 // indirect
 	golang.org/x/tools v0.2.0 // indirect
 )
+
+replace quicutil => ../internal/quicutil
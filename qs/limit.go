@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/webtransport-go"
+	"go.uber.org/zap"
+)
+
+// h3ExcessiveLoad is H3_EXCESSIVE_LOAD(RFC 9114), not exported by http3
+const h3ExcessiveLoad = quic.ApplicationErrorCode(0x107)
+
+// rejectTimeout bounds how long a tcp connection over the per ip limit is kept to answer 503
+const rejectTimeout = 5 * time.Second
+
+// parseRate parses bytes per second like 512K, 10M or 1G(1024 based), "" means unlimited
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * float64(unit)), nil
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// connLimiter counts the connections of every client ip, over quic and tcp
+type connLimiter struct {
+	max int // 0 means unlimited
+	sync.Mutex
+	conns map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{
+		max:   max,
+		conns: map[string]int{},
+	}
+}
+
+func (l *connLimiter) acquire(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.max > 0 && l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// tokenBucket allows rate bytes per second with bursts of up to burst bytes
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 20 // 50ms
+	if burst < 16<<10 {
+		burst = 16 << 10
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take consumes n tokens and returns how long to wait for the bucket to get out of debt
+func (b *tokenBucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// shapeChunk is the most bytes written at once by a shaped connection
+const shapeChunk = 16 << 10
+
+// shaper delays outgoing stream data to the per connection and global rates,
+// every connection gets its own bucket which goes away with it
+type shaper struct {
+	connRate int64        // 0 means unlimited
+	global   *tokenBucket // nil means unlimited
+}
+
+// newShaper returns nil if both rates are unlimited
+func newShaper(connRate, globalRate int64) *shaper {
+	if connRate <= 0 && globalRate <= 0 {
+		return nil
+	}
+	s := &shaper{
+		connRate: connRate,
+	}
+	if globalRate > 0 {
+		s.global = newTokenBucket(globalRate)
+	}
+	return s
+}
+
+// connBucket returns the bucket of a new connection, nil if connections are unlimited
+func (s *shaper) connBucket() *tokenBucket {
+	if s.connRate <= 0 {
+		return nil
+	}
+	return newTokenBucket(s.connRate)
+}
+
+func (s *shaper) wait(bucket *tokenBucket, n int) {
+	var d time.Duration
+	if bucket != nil {
+		d = bucket.take(n)
+	}
+	if s.global != nil {
+		if g := s.global.take(n); g > d {
+			d = g
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// write writes p with write in chunks of at most shapeChunk bytes, each one waiting
+// for the tokens of the connection bucket and the global bucket
+func (s *shaper) write(bucket *tokenBucket, write func([]byte) (int, error), p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > shapeChunk {
+			n = shapeChunk
+		}
+		s.wait(bucket, n)
+		m, err := write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// shapedConn shapes the stream data and datagrams sent on a quic connection,
+// so that handshake, ACK and other control packets are never queued behind them
+type shapedConn struct {
+	quic.EarlyConnection
+	shaper *shaper
+	bucket *tokenBucket
+}
+
+func (c *shapedConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	str, err := c.EarlyConnection.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &shapedStream{Stream: str, conn: c}, nil
+}
+
+func (c *shapedConn) OpenStream() (quic.Stream, error) {
+	str, err := c.EarlyConnection.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &shapedStream{Stream: str, conn: c}, nil
+}
+
+func (c *shapedConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	str, err := c.EarlyConnection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &shapedStream{Stream: str, conn: c}, nil
+}
+
+func (c *shapedConn) OpenUniStream() (quic.SendStream, error) {
+	str, err := c.EarlyConnection.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	return &shapedSendStream{SendStream: str, conn: c}, nil
+}
+
+func (c *shapedConn) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	str, err := c.EarlyConnection.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &shapedSendStream{SendStream: str, conn: c}, nil
+}
+
+func (c *shapedConn) SendMessage(p []byte) error {
+	c.shaper.wait(c.bucket, len(p))
+	return c.EarlyConnection.SendMessage(p)
+}
+
+type shapedStream struct {
+	quic.Stream
+	conn *shapedConn
+}
+
+func (s *shapedStream) Write(p []byte) (int, error) {
+	return s.conn.shaper.write(s.conn.bucket, s.Stream.Write, p)
+}
+
+type shapedSendStream struct {
+	quic.SendStream
+	conn *shapedConn
+}
+
+func (s *shapedSendStream) Write(p []byte) (int, error) {
+	return s.conn.shaper.write(s.conn.bucket, s.SendStream.Write, p)
+}
+
+// serveQUIC serves the connections accepted from ln, closing those over the per ip limit with H3_EXCESSIVE_LOAD
+func serveQUIC(ln quic.EarlyListener, server *webtransport.Server, limiter *connLimiter, shaper *shaper) error {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		ip := addrIP(conn.RemoteAddr())
+		if !limiter.acquire(ip) {
+			logger.Warn("too many connections",
+				zap.String("network", "udp"),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Int("max", limiter.max),
+			)
+			go func() {
+				// before the handshake the error code and reason are not sent to the client
+				select {
+				case <-conn.HandshakeComplete().Done():
+				case <-time.After(time.Second):
+				}
+				conn.CloseWithError(h3ExcessiveLoad, "too many connections")
+			}()
+			continue
+		}
+		var qconn quic.Connection = conn
+		if shaper != nil {
+			qconn = &shapedConn{EarlyConnection: conn, shaper: shaper, bucket: shaper.connBucket()}
+		}
+		go func() {
+			defer limiter.release(ip)
+			if err := server.ServeQUICConn(qconn); err != nil {
+				logger.Debug("serve conn error",
+					zap.String("raddr", conn.RemoteAddr().String()),
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+}
+
+// limitListener applies the per ip limit and shaping to tcp connections,
+// connections over the limit are accepted only to be answered 503 by rejectHandler
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+	shaper  *shaper
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := addrIP(conn.RemoteAddr())
+		if !l.limiter.acquire(ip) {
+			logger.Warn("too many connections",
+				zap.String("network", "tcp"),
+				zap.String("raddr", conn.RemoteAddr().String()),
+				zap.Int("max", l.limiter.max),
+			)
+			c := &limitConn{Conn: conn, ip: ip, listener: l, rejected: true}
+			c.timer = time.AfterFunc(rejectTimeout, func() { c.Close() })
+			return c, nil
+		}
+		c := &limitConn{Conn: conn, ip: ip, listener: l}
+		if l.shaper != nil {
+			c.bucket = l.shaper.connBucket()
+		}
+		return c, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	ip       string
+	listener *limitListener
+	once     sync.Once
+	rejected bool         // over the limit, not counted
+	timer    *time.Timer  // closes a rejected conn
+	bucket   *tokenBucket // per connection rate
+}
+
+func (c *limitConn) Write(p []byte) (int, error) {
+	if c.listener.shaper == nil || c.rejected {
+		return c.Conn.Write(p)
+	}
+	return c.listener.shaper.write(c.bucket, c.Conn.Write, p)
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() {
+		if c.rejected {
+			c.timer.Stop()
+			return
+		}
+		c.listener.limiter.release(c.ip)
+	})
+	return c.Conn.Close()
+}
+
+type rejectedKey struct{}
+
+// limitConnContext marks the requests of rejected connections, for http.Server.ConnContext
+func limitConnContext(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if lc, ok := c.(*limitConn); ok && lc.rejected {
+		return context.WithValue(ctx, rejectedKey{}, true)
+	}
+	return ctx
+}
+
+// rejectHandler answers 503 to the requests of connections over the per ip limit and closes them,
+// the tcp counterpart of H3_EXCESSIVE_LOAD
+func rejectHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(rejectedKey{}) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("Connection", "close")
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// go test -run ^TestLimitListener$ .
+func TestLimitListener(t *testing.T) {
+	logger = zap.NewNop()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:     rejectHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		ConnContext: limitConnContext,
+	}
+	go srv.Serve(&limitListener{Listener: ln, limiter: newConnLimiter(1)})
+	defer srv.Close()
+
+	cases := []struct {
+		status     int
+		retryAfter string
+		close      bool
+	}{
+		{http.StatusOK, "", false},
+		{http.StatusServiceUnavailable, "1", true},
+		{http.StatusServiceUnavailable, "1", true},
+	}
+	// the connections are kept open, so only the first one is below the limit
+	for i, v := range cases {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: qs\r\n\r\n")
+		rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%d expect: response, got: %v", i, err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != v.status || rsp.Header.Get("Retry-After") != v.retryAfter || rsp.Close != v.close {
+			t.Errorf("%d expect: %d %q %v, got: %d %q %v", i, v.status, v.retryAfter, v.close, rsp.StatusCode, rsp.Header.Get("Retry-After"), rsp.Close)
+		}
+	}
+}
+
+// fakeQUICConn hands out fakeStreams, the other methods of quic.EarlyConnection are not used
+type fakeQUICConn struct {
+	quic.EarlyConnection
+}
+
+func (c *fakeQUICConn) AcceptStream(context.Context) (quic.Stream, error) {
+	return &fakeStream{}, nil
+}
+
+type fakeStream struct {
+	quic.Stream
+	n int
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	s.n += len(p)
+	return len(p), nil
+}
+
+// go test -run ^TestShapedConn$ .
+func TestShapedConn(t *testing.T) {
+	s := newShaper(256<<10, 0)
+	cases := []struct {
+		name string
+		conn *shapedConn
+		size int
+		min  time.Duration
+		max  time.Duration
+	}{
+		// the first 16KiB is the burst, the rest is sent at 256KiB/s
+		{"first conn", &shapedConn{EarlyConnection: &fakeQUICConn{}, shaper: s, bucket: s.connBucket()}, 64 << 10, 150 * time.Millisecond, time.Second},
+		// a new connection gets its own bucket
+		{"second conn", &shapedConn{EarlyConnection: &fakeQUICConn{}, shaper: s, bucket: s.connBucket()}, 16 << 10, 0, 100 * time.Millisecond},
+	}
+	for _, v := range cases {
+		str, err := v.conn.AcceptStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		n, err := str.Write(make([]byte, v.size))
+		d := time.Since(start)
+		if err != nil || n != v.size || str.(*shapedStream).Stream.(*fakeStream).n != v.size {
+			t.Errorf("%s expect: %d written, got: %d %v", v.name, v.size, n, err)
+		}
+		if d < v.min || d > v.max {
+			t.Errorf("%s expect: [%v, %v], got: %v", v.name, v.min, v.max, d)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -40,8 +41,20 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&serverAddr1, "s1", serverAddr1, "server address1")
 	rootCmd.PersistentFlags().StringVar(&serverAddr2, "s2", serverAddr2, "server address2")
 
-	var rootDir = "."
-	var certPath = "."
+	qs := QuicServer{
+		root:      ".",
+		certPath:  ".",
+		hashes:    []string{"sha256"},
+		maxUpload: 1 << 30,
+		tcp:       true,
+		benchMax:  1 << 30,
+		casGrace:  24 * time.Hour,
+
+		maxStreams:       100,
+		idleTimeout:      30 * time.Second,
+		handshakeTimeout: 5 * time.Second,
+	}
+	configFile := ""
 	serverCmd := &cobra.Command{
 		Use:     "start",
 		Aliases: []string{"s"},
@@ -49,14 +62,62 @@ func main() {
 		Long: `qc server:
 * start tcp server
 qc server
+* require client certificate and apply per-path access policy
+qs start --client-ca ca.pem --policy policy.json
+* upload with PUT /api/file/<path> and compute sha256 and md5
+qs start --hash sha256,md5 --max-upload 1073741824 --quota 10737418240
+* listen on several addresses
+qs start --bind 0.0.0.0:443,[::]:443 --bind eth0:8443
+* list, stat and hash files as json: GET /api/ls?path=/dir&hash=sha256, /api/stat?path=/f, /api/hash?path=/f&alg=md5
+qs start --root /data/www
+* store uploads as deduplicated chunks, qc put only sends the chunks the server doesn't have
+qs start --cas-dir /data/cas
+* serve www/app.js.zst or www/app.js.gz for /app.js to clients accepting zstd or gzip,
+  text, json, xml... responses are compressed on the fly, uploads may be zstd or gzip encoded
+qs start --root www
+* relay WebTransport sessions on /api/wt?path=<channel> for a dashboard at https://example.com
+qs start --wt-origin https://example.com
+* serve /api/bench for qc bench, transfers are capped at --bench-max bytes
+qs start --bench --bench-max 1073741824
+* cap the uplink to 20MiB/s in total and 2MiB/s per connection, 4 connections per client ip
+qs start --global-rate 20M --conn-rate 2M --max-conns-per-ip 4 --max-streams 32
+* read options from a json file, keys are flag names, command line flags take precedence
+  {"root": "/data/www", "bind": ["0.0.0.0:443"], "global-rate": "20M", "idle-timeout": "1m"}
+qs start --config qs.json
 `,
 		Args: cobra.ExactArgs(0),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return QuicServer(rootDir, certPath, port)
+			if configFile != "" {
+				if err := loadConfig(cmd, configFile); err != nil {
+					return err
+				}
+			}
+			return qs.Start(port)
 		},
 	}
-	serverCmd.Flags().StringVar(&rootDir, "root", rootDir, "www root dir")
-	serverCmd.Flags().StringVar(&certPath, "cert", certPath, "cert path")
+	serverCmd.Flags().StringVar(&qs.root, "root", qs.root, "www root dir")
+	serverCmd.Flags().StringVar(&qs.certPath, "cert", qs.certPath, "cert path")
+	serverCmd.Flags().StringVar(&qs.clientCA, "client-ca", "", "client CA file, require client certificate if set")
+	serverCmd.Flags().StringVar(&qs.policyFile, "policy", "", "client access policy file(json), requires --client-ca")
+	serverCmd.Flags().StringSliceVar(&qs.hashes, "hash", qs.hashes, "upload hashes, comma separated list of sha256,sha1,md5")
+	serverCmd.Flags().Int64Var(&qs.maxUpload, "max-upload", qs.maxUpload, "max bytes of one upload, 0 means unlimited")
+	serverCmd.Flags().Var(&qs.binds, "bind", "listen addresses(ip:port or interface:port), comma separated or repeated, default :<port>")
+	serverCmd.Flags().BoolVar(&qs.tcp, "tcp", qs.tcp, "also serve HTTP/1.1 and HTTP/2 over TLS on tcp, advertising HTTP/3 with Alt-Svc")
+	serverCmd.Flags().StringVar(&qs.keyLogFile, "keylog", "", "append TLS keys to file for Wireshark, default $SSLKEYLOGFILE")
+	serverCmd.Flags().StringVar(&qs.qlogDir, "qlog-dir", "", "write a qlog trace per connection into dir")
+	serverCmd.Flags().StringVar(&qs.casDir, "cas-dir", "", "store uploads in a content addressed chunk store in dir, deduplicating repeated content")
+	serverCmd.Flags().DurationVar(&qs.casGrace, "cas-grace", qs.casGrace, "remove chunks no manifest refers to this long after they were sent")
+	serverCmd.Flags().StringSliceVar(&qs.wtOrigins, "wt-origin", nil, "browser origins allowed to open WebTransport sessions, * for any, default same origin")
+	serverCmd.Flags().BoolVar(&qs.bench, "bench", false, "serve /api/bench for qc bench, subject to --policy like other paths")
+	serverCmd.Flags().Int64Var(&qs.benchMax, "bench-max", qs.benchMax, "max bytes of one bench download or upload")
+	serverCmd.Flags().Int64Var(&qs.quota, "quota", 0, "max bytes of all files under root, 0 means unlimited")
+	serverCmd.Flags().IntVar(&qs.maxConnsPerIP, "max-conns-per-ip", 0, "max concurrent connections of one client ip, quic and tcp together, 0 means unlimited")
+	serverCmd.Flags().Int64Var(&qs.maxStreams, "max-streams", qs.maxStreams, "max concurrent request streams per quic connection")
+	serverCmd.Flags().StringVar(&qs.connRate, "conn-rate", "", "max bytes per second sent to one connection, with K/M/G suffix")
+	serverCmd.Flags().StringVar(&qs.globalRate, "global-rate", "", "max bytes per second sent to all clients, with K/M/G suffix")
+	serverCmd.Flags().DurationVar(&qs.idleTimeout, "idle-timeout", qs.idleTimeout, "close connections idle for this long")
+	serverCmd.Flags().DurationVar(&qs.handshakeTimeout, "handshake-timeout", qs.handshakeTimeout, "close connections not finishing the handshake in time")
+	serverCmd.Flags().StringVar(&configFile, "config", "", "read options from json file, keys are flag names")
 	rootCmd.AddCommand(serverCmd)
 
 	if err := rootCmd.Execute(); err != nil {
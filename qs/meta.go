@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// metadata api, GET only:
+//
+//	/api/ls?path=<dir>[&hash=sha256,md5]   -> {"path":dir,"entries":[fileInfo...]}
+//	/api/stat?path=<file>[&hash=sha256]    -> fileInfo
+//	/api/hash?path=<file>[&alg=sha256]     -> fileInfo with the hash of the file content
+//
+// files stored in the cas store are listed like regular files
+const (
+	lsPrefix   = "/api/ls"
+	statPrefix = "/api/stat"
+	hashPrefix = "/api/hash"
+)
+
+type listing struct {
+	Path    string      `json:"path"`
+	Entries []*fileInfo `json:"entries"`
+}
+
+// parseHashes returns the hash algorithms of a comma separated list
+func parseHashes(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	algs := strings.Split(v, ",")
+	for _, alg := range algs {
+		if _, ok := hashFuncs[alg]; !ok {
+			return nil, fmt.Errorf("unsupported hash %s", alg)
+		}
+	}
+	return algs, nil
+}
+
+// stat returns the info of urlPath, preferring the cas manifest like GET does
+func (a *fileAPI) stat(urlPath string) (*fileInfo, error) {
+	if a.cas != nil {
+		m, err := a.cas.loadManifest(urlPath)
+		if err == nil {
+			return m.fileInfo(urlPath), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	fi, err := os.Stat(a.localPath(urlPath))
+	if err != nil {
+		return nil, err
+	}
+	info := newFileInfo(urlPath, fi)
+	if urlPath == "/" {
+		info.Name = "/"
+	}
+	return info, nil
+}
+
+// open returns the content of urlPath from the cas store or below root
+func (a *fileAPI) open(urlPath string) (io.ReadCloser, error) {
+	if a.cas != nil {
+		m, err := a.cas.loadManifest(urlPath)
+		if err == nil {
+			return a.cas.reader(m), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return os.Open(a.localPath(urlPath))
+}
+
+// hashFile streams the content of urlPath through the algs hashes
+func (a *fileAPI) hashFile(urlPath string, algs []string) (map[string]string, error) {
+	f, err := a.open(urlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashers := map[string]hash.Hash{}
+	for _, alg := range algs {
+		hashers[alg] = hashFuncs[alg]()
+	}
+	if _, err := io.Copy(io.MultiWriter(hashWriters(hashers)...), f); err != nil {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for alg, h := range hashers {
+		sums[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// addHashes sets the algs hashes of a regular file, reusing the hashes stored at upload
+func (a *fileAPI) addHashes(info *fileInfo, algs []string) error {
+	if info.IsDir || len(algs) == 0 {
+		return nil
+	}
+	missing := []string{}
+	for _, alg := range algs {
+		if _, ok := info.Hash[alg]; !ok {
+			missing = append(missing, alg)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sums, err := a.hashFile(info.Path, missing)
+	if err != nil {
+		return err
+	}
+	if info.Hash == nil {
+		info.Hash = map[string]string{}
+	}
+	for alg, sum := range sums {
+		info.Hash[alg] = sum
+	}
+	return nil
+}
+
+// list returns the entries of the directory urlPath, merged with the cas manifests below it
+func (a *fileAPI) list(urlPath string) ([]*fileInfo, error) {
+	entries := map[string]*fileInfo{}
+	dirEntries, err := os.ReadDir(a.localPath(urlPath))
+	if err != nil && (a.cas == nil || !errors.Is(err, fs.ErrNotExist)) {
+		return nil, err
+	}
+	for _, v := range dirEntries {
+		fi, err := v.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+		entries[v.Name()] = newFileInfo(path.Join(urlPath, v.Name()), fi)
+	}
+
+	if a.cas != nil {
+		dir := strings.TrimSuffix(a.cas.manifestPath(urlPath), ".json")
+		manifests, merr := os.ReadDir(dir)
+		if merr != nil && !errors.Is(merr, fs.ErrNotExist) {
+			return nil, merr
+		}
+		if err != nil && len(manifests) == 0 {
+			return nil, err
+		}
+		for _, v := range manifests {
+			name := v.Name()
+			if v.IsDir() {
+				if _, ok := entries[name]; !ok {
+					fi, err := v.Info()
+					if err != nil {
+						continue
+					}
+					entries[name] = newFileInfo(path.Join(urlPath, name), fi)
+				}
+				continue
+			}
+			if !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			name = strings.TrimSuffix(name, ".json")
+			m, err := a.cas.loadManifest(path.Join(urlPath, name))
+			if err != nil {
+				continue
+			}
+			entries[name] = m.fileInfo(path.Join(urlPath, name))
+		}
+	}
+
+	infos := make([]*fileInfo, 0, len(entries))
+	for _, v := range entries {
+		infos = append(infos, v)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func metaStatus(err error) int {
+	if errors.Is(err, fs.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// serveMeta serves the ls, stat and hash api
+func (a *fileAPI) serveMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	urlPath := requestFilePath(r)
+	algs, err := parseHashes(r.URL.Query().Get("hash"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	info, err := a.stat(urlPath)
+	if err != nil && !(r.URL.Path == lsPrefix && a.cas != nil && errors.Is(err, fs.ErrNotExist)) {
+		writeError(w, metaStatus(err), err)
+		return
+	}
+
+	switch r.URL.Path {
+	case lsPrefix:
+		l := &listing{Path: urlPath, Entries: []*fileInfo{info}}
+		if info == nil || info.IsDir {
+			if l.Entries, err = a.list(urlPath); err != nil {
+				writeError(w, metaStatus(err), err)
+				return
+			}
+		}
+		for _, v := range l.Entries {
+			if err := a.addHashes(v, algs); err != nil {
+				writeError(w, metaStatus(err), err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, l)
+	case statPrefix:
+		if err := a.addHashes(info, algs); err != nil {
+			writeError(w, metaStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case hashPrefix:
+		if info.IsDir {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s is a directory", urlPath))
+			return
+		}
+		alg := r.URL.Query().Get("alg")
+		if alg == "" {
+			alg = "sha256"
+		}
+		if _, ok := hashFuncs[alg]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported hash %s", alg))
+			return
+		}
+		// always read the content, stored hashes may be stale if the file was replaced below root
+		if info.Hash, err = a.hashFile(urlPath, []string{alg}); err != nil {
+			writeError(w, metaStatus(err), err)
+			return
+		}
+		logger.Debug("hash",
+			zap.String("raddr", r.RemoteAddr),
+			zap.String("path", urlPath),
+			zap.String(alg, info.Hash[alg]),
+		)
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown api %s", r.URL.Path))
+	}
+}
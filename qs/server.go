@@ -1,20 +1,22 @@
 package main
 
 import (
-	"crypto/md5"
 	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
+	"net"
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	_ "net/http/pprof"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
 	"go.uber.org/zap"
+
+	"quicutil"
 )
 
 var (
@@ -28,99 +30,287 @@ func (b binds) String() string {
 }
 
 func (b *binds) Set(v string) error {
-	*b = strings.Split(v, ",")
+	*b = append(*b, strings.Split(v, ",")...)
 	return nil
 }
 
-// Size is needed by the /demo/upload handler to determine the size of the uploaded file
-type Size interface {
-	Size() int64
+func (b *binds) Type() string {
+	return "binds"
 }
 
-func setupHandler(www string) http.Handler {
+// expand resolves interface names(e.g. eth0:443) to the interface addresses
+func (b binds) expand() ([]string, error) {
+	addrs := []string{}
+	for _, v := range b {
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind %s: %w", v, err)
+		}
+		if host == "" || net.ParseIP(host) != nil {
+			addrs = append(addrs, v)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(host)
+		if err != nil { // not an interface, treat as host name
+			addrs = append(addrs, v)
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("get interface %s addrs err: %w", host, err)
+		}
+		for _, address := range ifaddrs {
+			ipnet, ok := address.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP.String()
+			if ipnet.IP.IsLinkLocalUnicast() && ipnet.IP.To4() == nil {
+				ip = ip + "%" + iface.Name
+			}
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs, nil
+}
+
+// setupHandler mounts the bench endpoint only if bench isn't nil
+func setupHandler(www string, api *fileAPI, hub *wtHub, bench http.Handler) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.Handle("/", http.FileServer(http.Dir(www)))
+	mux.Handle(fileAPIPrefix+"/", api)
+	mux.HandleFunc(casPrefix+"/", api.serveCAS)
+	mux.HandleFunc(lsPrefix, api.serveMeta)
+	mux.HandleFunc(statPrefix, api.serveMeta)
+	mux.HandleFunc(hashPrefix, api.serveMeta)
+	if bench != nil {
+		mux.Handle(benchPrefix, bench)
+	}
+	mux.Handle(wtPrefix, hub)
 
-	mux.HandleFunc("/demo/tile", func(w http.ResponseWriter, r *http.Request) {
-		// Small 40x40 png
-		w.Write([]byte{
-			0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
-			0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x28,
-			0x01, 0x03, 0x00, 0x00, 0x00, 0xb6, 0x30, 0x2a, 0x2e, 0x00, 0x00, 0x00,
-			0x03, 0x50, 0x4c, 0x54, 0x45, 0x5a, 0xc3, 0x5a, 0xad, 0x38, 0xaa, 0xdb,
-			0x00, 0x00, 0x00, 0x0b, 0x49, 0x44, 0x41, 0x54, 0x78, 0x01, 0x63, 0x18,
-			0x61, 0x00, 0x00, 0x00, 0xf0, 0x00, 0x01, 0xe2, 0xb8, 0x75, 0x22, 0x00,
-			0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
-		})
-	})
+	return compressHandler(www, mux)
+}
 
-	mux.HandleFunc("/demo/tiles", func(w http.ResponseWriter, r *http.Request) {
-		io.WriteString(w, "<html><head><style>img{width:40px;height:40px;}</style></head><body>")
-		for i := 0; i < 200; i++ {
-			fmt.Fprintf(w, `<img src="/demo/tile?cachebust=%d">`, i)
+type QuicServer struct {
+	root       string
+	certPath   string
+	clientCA   string
+	policyFile string
+	hashes     []string
+	maxUpload  int64
+	quota      int64
+	binds      binds
+	tcp        bool
+	keyLogFile string
+	qlogDir    string
+	wtOrigins  []string
+	casDir     string
+	casGrace   time.Duration
+	bench      bool
+	benchMax   int64
+
+	maxConnsPerIP    int
+	maxStreams       int64
+	connRate         string
+	globalRate       string
+	idleTimeout      time.Duration
+	handshakeTimeout time.Duration
+}
+
+func (s *QuicServer) Start(port uint32) error {
+	certFile, keyFile := path.Join(s.certPath, "cert.pem"), path.Join(s.certPath, "priv.key")
+	tlsConf, err := tlsConfig(certFile, keyFile, s.clientCA)
+	if err != nil {
+		return err
+	}
+
+	api, err := newFileAPI(s.root, s.casDir, s.casGrace, s.hashes, s.maxUpload, s.quota)
+	if err != nil {
+		return err
+	}
+	hub := newWTHub()
+	var bench http.Handler
+	if s.bench {
+		if s.benchMax <= 0 {
+			return fmt.Errorf("invalid bench max %d", s.benchMax)
 		}
-		io.WriteString(w, "</body></html>")
-	})
+		bench = &benchHandler{maxSize: s.benchMax}
+	}
+	handler := setupHandler(s.root, api, hub, bench)
+	if s.clientCA != "" {
+		var p *policy
+		if s.policyFile != "" {
+			p, err = loadPolicy(s.policyFile)
+			if err != nil {
+				return err
+			}
+		}
+		handler = accessControl(p, handler)
+	} else if s.policyFile != "" {
+		return errors.New("policy requires client ca")
+	}
+	keyLog, err := quicutil.OpenKeyLog(s.keyLogFile)
+	if err != nil {
+		return err
+	}
+	if keyLog != nil {
+		defer keyLog.Close()
+		tlsConf.KeyLogWriter = keyLog
+	}
+
+	connRate, err := parseRate(s.connRate)
+	if err != nil {
+		return err
+	}
+	globalRate, err := parseRate(s.globalRate)
+	if err != nil {
+		return err
+	}
+	limiter := newConnLimiter(s.maxConnsPerIP)
+	shaper := newShaper(connRate, globalRate)
 
-	mux.HandleFunc("/demo/echo", func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
+	quicConf := &quic.Config{
+		MaxIncomingStreams:   s.maxStreams,
+		MaxIdleTimeout:       s.idleTimeout,
+		HandshakeIdleTimeout: s.handshakeTimeout,
+		// webtransport datagrams, set by http3.Server.Serve which we don't use
+		EnableDatagrams: true,
+	}
+	if s.qlogDir != "" {
+		quicConf.Tracer, err = quicutil.QlogTracer(s.qlogDir)
 		if err != nil {
-			logger.Warn("read /echo body error",
-				zap.Error(err),
-			)
+			return err
 		}
-		w.Write(body)
-	})
+	}
+	if s.clientCA == "" {
+		// 0-RTT requests may be replayed, only allow them without client authentication
+		quicConf.Allow0RTT = func(net.Addr) bool { return true }
+		handler = earlyDataHandler(handler)
+	}
 
-	// accept file uploads and return the MD5 of the uploaded file
-	// maximum accepted file size is 1 GB
-	mux.HandleFunc("/demo/upload", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
-			err := r.ParseMultipartForm(1 << 30) // 1 GB
-			if err == nil {
-				var file multipart.File
-				file, _, err = r.FormFile("uploadfile")
-				if err == nil {
-					var size int64
-					if sizeInterface, ok := file.(Size); ok {
-						size = sizeInterface.Size()
-						b := make([]byte, size)
-						file.Read(b)
-						md5 := md5.Sum(b)
-						fmt.Fprintf(w, "%x", md5)
-						return
-					}
-					err = errors.New("couldn't get uploaded file size")
-				}
-			}
-			logger.Warn("receiving upload error",
-				zap.Error(err),
-			)
-		}
-		io.WriteString(w, `<html><body><form action="/demo/upload" method="post" enctype="multipart/form-data">
-				<input type="file" name="uploadfile"><br>
-				<input type="submit">
-			</form></body></html>`)
-	})
+	if len(s.binds) == 0 {
+		s.binds = binds{fmt.Sprintf(":%d", port)}
+	}
+	addrs, err := s.binds.expand()
+	if err != nil {
+		return err
+	}
 
-	return mux
-}
+	server := &webtransport.Server{
+		H3: http3.Server{
+			Handler:    handler,
+			TLSConfig:  tlsConf,
+			QuicConfig: quicConf,
+		},
+		CheckOrigin: checkOrigin(s.wtOrigins),
+	}
+	hub.server = server
 
-func QuicServer(www string, certPath string, port uint32) error {
-	handler := setupHandler(www)
-	quicConf := &quic.Config{}
+	errs := make(chan error, 2*len(addrs))
+	conns := []net.PacketConn{}
+	quicLns := []quic.EarlyListener{}
+	httpServers := []*http.Server{}
+	defer func() {
+		server.Close()
+		for _, v := range quicLns {
+			v.Close()
+		}
+		for _, v := range httpServers {
+			v.Close()
+		}
+		for _, v := range conns {
+			v.Close()
+		}
+	}()
 
-	addr := fmt.Sprintf(":%d", port)
-	logger.Info("start server",
-		zap.String("addr", addr),
-	)
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("listen udp %s err: %w", addr, err)
+		}
+		conns = append(conns, conn)
+		// accept connections ourselves to enforce the per ip limit and shape them
+		quicLn, err := quic.ListenEarly(conn, http3.ConfigureTLSConfig(tlsConf), quicConf)
+		if err != nil {
+			return fmt.Errorf("listen quic %s err: %w", addr, err)
+		}
+		quicLns = append(quicLns, quicLn)
+		go func() {
+			errs <- serveQUIC(quicLn, server, limiter, shaper)
+		}()
 
-	certFile, keyFile := path.Join(certPath, "cert.pem"), path.Join(certPath, "priv.key")
-	server := http3.Server{
-		Handler:    handler,
-		Addr:       addr,
-		QuicConfig: quicConf,
+		logger.Info("start server",
+			zap.String("network", "udp"),
+			zap.String("addr", conn.LocalAddr().String()),
+			zap.String("client-ca", s.clientCA),
+			zap.String("policy", s.policyFile),
+			zap.Int("max-conns-per-ip", s.maxConnsPerIP),
+			zap.Int64("conn-rate", connRate),
+			zap.Int64("global-rate", globalRate),
+		)
+
+		if !s.tcp {
+			continue
+		}
+		// same port as udp, so the Alt-Svc port matches when binding port 0
+		ln, err := net.Listen("tcp", conn.LocalAddr().String())
+		if err != nil {
+			return fmt.Errorf("listen tcp %s err: %w", conn.LocalAddr().String(), err)
+		}
+		httpServer := &http.Server{
+			Handler:     rejectHandler(altSvcHandler(conn.LocalAddr().(*net.UDPAddr).Port, handler)),
+			TLSConfig:   tlsConf.Clone(),
+			IdleTimeout: s.idleTimeout,
+			ConnContext: limitConnContext,
+		}
+		httpServer.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		if s.handshakeTimeout > 0 {
+			// also bounds the TLS handshake
+			httpServer.ReadHeaderTimeout = s.handshakeTimeout
+		}
+		httpServers = append(httpServers, httpServer)
+		tcpLn := &limitListener{Listener: ln, limiter: limiter, shaper: shaper}
+		go func() {
+			errs <- httpServer.ServeTLS(tcpLn, "", "")
+		}()
+
+		logger.Info("start server",
+			zap.String("network", "tcp"),
+			zap.String("addr", ln.Addr().String()),
+		)
 	}
-	return server.ListenAndServeTLS(certFile, keyFile)
+
+	return <-errs
+}
+
+// altSvcHandler advertises the HTTP/3 endpoint on the same port to HTTP/1.1 and HTTP/2 clients
+func altSvcHandler(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=2592000`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// earlyDataHandler answers 425 Too Early to unsafe requests received as 0-RTT data,
+// a replayed early data flight must not be able to repeat a write (RFC 8470)
+func earlyDataHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && !r.TLS.HandshakeComplete {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				logger.Warn("reject early data",
+					zap.String("raddr", r.RemoteAddr),
+					zap.String("method", r.Method),
+					zap.String("path", r.URL.Path),
+				)
+				http.Error(w, http.StatusText(http.StatusTooEarly), http.StatusTooEarly)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
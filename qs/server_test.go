@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// go test -run ^TestEarlyDataHandler$ .
+func TestEarlyDataHandler(t *testing.T) {
+	logger = zap.NewNop()
+	h := earlyDataHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cases := []struct {
+		method   string
+		complete bool
+		status   int
+	}{
+		{http.MethodGet, false, http.StatusOK},
+		{http.MethodHead, false, http.StatusOK},
+		{http.MethodPut, false, http.StatusTooEarly},
+		{http.MethodPost, false, http.StatusTooEarly},
+		{http.MethodDelete, false, http.StatusTooEarly},
+		{http.MethodPut, true, http.StatusOK},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, "/api/file/a", nil)
+		r.TLS = &tls.ConnectionState{HandshakeComplete: v.complete}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != v.status {
+			t.Errorf("%s complete=%v expect: %d, got: %d", v.method, v.complete, v.status, w.Code)
+		}
+	}
+}
+
+// go test -run ^TestBenchHandler$ .
+func TestBenchHandler(t *testing.T) {
+	h := &benchHandler{maxSize: 1 << 20}
+	cases := []struct {
+		method string
+		target string
+		body   string
+		status int
+		length int
+	}{
+		{http.MethodGet, "/api/bench?size=100000", "", http.StatusOK, 100000},
+		{http.MethodGet, "/api/bench?size=1048576", "", http.StatusOK, 1 << 20},
+		{http.MethodGet, "/api/bench?size=1048577", "", http.StatusRequestEntityTooLarge, -1},
+		{http.MethodGet, "/api/bench?size=-1", "", http.StatusBadRequest, -1},
+		{http.MethodPut, "/api/bench", "abc", http.StatusOK, -1},
+		{http.MethodPut, "/api/bench", strings.Repeat("a", 1<<20+1), http.StatusRequestEntityTooLarge, -1},
+	}
+	for _, v := range cases {
+		r := httptest.NewRequest(v.method, v.target, strings.NewReader(v.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != v.status {
+			t.Errorf("%s %s expect: %d, got: %d", v.method, v.target, v.status, w.Code)
+		}
+		if v.length >= 0 && w.Body.Len() != v.length {
+			t.Errorf("%s %s length expect: %d, got: %d", v.method, v.target, v.length, w.Body.Len())
+		}
+	}
+
+	mux := setupHandler(t.TempDir(), nil, nil, nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/bench?size=1", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bench disabled expect: %d, got: %d", http.StatusNotFound, w.Code)
+	}
+}
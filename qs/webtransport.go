@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.uber.org/zap"
+
+	"quicutil"
+)
+
+const (
+	wtPrefix = "/api/wt"
+	// wtWriteTimeout drops a receiver which doesn't keep up instead of stalling the sender
+	wtWriteTimeout = 10 * time.Second
+)
+
+// wtSession is a WebTransport session joined to a channel
+type wtSession struct {
+	*webtransport.Session
+	datagrams *quicutil.SessionDatagrams
+	channel   string
+	echo      bool
+}
+
+// wtHub relays WebTransport sessions joined to the same channel(?path=):
+// every bidi stream is forwarded to the other sessions as a uni stream and
+// every datagram as a datagram, with ?echo=1 the sender gets its data back too
+type wtHub struct {
+	server *webtransport.Server
+	sync.Mutex
+	channels map[string]map[*wtSession]struct{}
+}
+
+func newWTHub() *wtHub {
+	return &wtHub{
+		channels: map[string]map[*wtSession]struct{}{},
+	}
+}
+
+// checkOrigin allows the listed browser origins, "*" allows any,
+// nil keeps the webtransport-go same origin check
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	if len(origins) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" { // not a browser
+			return true
+		}
+		for _, v := range origins {
+			if v == "*" || v == origin {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (h *wtHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, webtransport requires extended CONNECT over HTTP/3", r.Method))
+		return
+	}
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("webtransport requires HTTP/3"))
+		return
+	}
+	conn, ok := hijacker.StreamCreator().(quicutil.DatagramConn)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("connection doesn't support datagrams"))
+		return
+	}
+
+	sess, err := h.server.Upgrade(w, r)
+	if err != nil {
+		logger.Warn("webtransport upgrade error",
+			zap.String("raddr", r.RemoteAddr),
+			zap.Error(err),
+		)
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	streamID := r.Body.(http3.HTTPStreamer).HTTPStream().StreamID()
+
+	s := &wtSession{
+		Session:   sess,
+		datagrams: quicutil.DatagramMuxOf(conn).Session(streamID),
+		channel:   requestFilePath(r),
+		echo:      r.URL.Query().Get("echo") == "1",
+	}
+	defer s.datagrams.Close()
+	h.join(s)
+	defer h.leave(s)
+
+	logger.Info("webtransport session",
+		zap.String("raddr", r.RemoteAddr),
+		zap.String("channel", s.channel),
+		zap.String("client", clientIdentity(r)),
+	)
+
+	go h.relayDatagrams(s)
+	for {
+		str, err := sess.AcceptStream(sess.Context())
+		if err != nil {
+			logger.Info("webtransport session closed",
+				zap.String("raddr", r.RemoteAddr),
+				zap.String("channel", s.channel),
+				zap.Error(err),
+			)
+			return
+		}
+		go h.relayStream(s, str)
+	}
+}
+
+func (h *wtHub) join(s *wtSession) {
+	h.Lock()
+	defer h.Unlock()
+	if h.channels[s.channel] == nil {
+		h.channels[s.channel] = map[*wtSession]struct{}{}
+	}
+	h.channels[s.channel][s] = struct{}{}
+}
+
+func (h *wtHub) leave(s *wtSession) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.channels[s.channel], s)
+	if len(h.channels[s.channel]) == 0 {
+		delete(h.channels, s.channel)
+	}
+}
+
+// receivers returns the sessions which get the data sent by s
+func (h *wtHub) receivers(s *wtSession) []*wtSession {
+	h.Lock()
+	defer h.Unlock()
+	sessions := make([]*wtSession, 0, len(h.channels[s.channel]))
+	for v := range h.channels[s.channel] {
+		if v != s {
+			sessions = append(sessions, v)
+		}
+	}
+	return sessions
+}
+
+func (h *wtHub) relayDatagrams(s *wtSession) {
+	for {
+		msg, err := s.datagrams.Receive(s.Context())
+		if err != nil {
+			return
+		}
+		if s.echo {
+			s.datagrams.Send(msg)
+		}
+		for _, v := range h.receivers(s) {
+			if err := v.datagrams.Send(msg); err != nil {
+				logger.Debug("relay datagram error",
+					zap.String("channel", s.channel),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// relayStream copies str to a new uni stream of every receiver, and back to str with echo,
+// the send direction of str is closed once everything has been relayed
+func (h *wtHub) relayStream(s *wtSession, str webtransport.Stream) {
+	dsts := []webtransport.SendStream{}
+	if s.echo {
+		dsts = append(dsts, str)
+	}
+	for _, v := range h.receivers(s) {
+		dst, err := v.OpenUniStream()
+		if err != nil {
+			logger.Debug("open uni stream error",
+				zap.String("channel", s.channel),
+				zap.Error(err),
+			)
+			continue
+		}
+		dsts = append(dsts, dst)
+	}
+
+	var n int64
+	buf := make([]byte, 32<<10)
+	for {
+		m, err := str.Read(buf)
+		for i := 0; i < len(dsts) && m > 0; {
+			dsts[i].SetWriteDeadline(time.Now().Add(wtWriteTimeout))
+			if _, err := dsts[i].Write(buf[:m]); err != nil {
+				dsts[i].CancelWrite(0)
+				dsts = append(dsts[:i], dsts[i+1:]...)
+				continue
+			}
+			i++
+		}
+		n += int64(m)
+		if err != nil {
+			break
+		}
+	}
+	for _, v := range dsts {
+		v.Close()
+	}
+	if !s.echo {
+		// tells the sender everything has been relayed
+		str.Close()
+	}
+
+	logger.Debug("relay stream done",
+		zap.String("channel", s.channel),
+		zap.Int64("bytes", n),
+	)
+}